@@ -16,33 +16,200 @@ limitations under the License.
 package actions
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/AltoStack/dynamodump/core"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+// BackupOptions holds the settings of a backup of the DynamoDB table TableName
+// to the folder Prefix of Bucket, an s3 bucket or a file:// URL. AddDate adds a
+// subfolder named after the current UTC date to Prefix. The table is scanned
+// by Segments parallel workers reading BatchSize items at once, waiting
+// WaitPeriod between batches unless ThroughputRatio is set. DynamoRegion is the
+// region of the table, and the s3 bucket is accessed in S3Region with the role
+// RoleAssumed of the account S3AccountID
+type BackupOptions struct {
+	TableName       string
+	BatchSize       int64
+	Segments        int64
+	WaitPeriod      time.Duration
+	ThroughputRatio float64
+	Bucket          string
+	Prefix          string
+	AddDate         bool
+	Resume          bool
+	Compression     string
+	Format          string
+	TransformFile   string
+	Encryption      EncryptionKey
+	Upload          core.S3UploadOptions
+	DynamoRegion    string
+	RoleAssumed     string
+	S3AccountID     string
+	S3Region        string
+	Retry           *core.RetryPolicy
+	ShutdownTimeout time.Duration
+}
+
 // Table manages the consumer from a given DynamoDB table and a producer
-// to a given s3 bucket
-func TableBackup(tableName string, batchSize int64, waitPeriod time.Duration, bucket, prefix string, addDate bool, dynamoRegion, roleAssumed, s3AccountID, s3Region string) {
-	if addDate {
+// to a given s3 bucket. When Resume is set, the backup continues from the
+// checkpoint left in the s3 folder by a previous run that didn't complete.
+// Once ctx is done, the scan stops and the data scanned so far is written
+// within ShutdownTimeout, along with a manifest marked as incomplete. The rules
+// of TransformFile, if any, are applied to the items before writing them.
+// With the core.FormatAWSExport format, the items are written in the layout of
+// the native DynamoDB exports instead
+func TableBackup(ctx context.Context, opts BackupOptions) error {
+	if opts.AddDate {
+		if opts.Resume {
+			return fmt.Errorf("A backup can't be resumed when a date suffix is added to the folder")
+		}
 		t := time.Now().UTC()
-		prefix += "/" + t.Format("2006-01-02-15-04-05")
+		opts.Prefix += "/" + t.Format("2006-01-02-15-04-05")
 	}
 
-	if dynamoRegion == "" || s3Region == "" {
-		log.Fatal("Error. Missing fields dynamoRegion or s3Region")
+	if opts.DynamoRegion == "" || opts.S3Region == "" && !core.IsLocalStorage(opts.Bucket) {
+		return fmt.Errorf("Missing fields dynamoRegion or s3Region")
+	}
+	if err := checkSegments(opts.Segments); err != nil {
+		return err
+	}
+	if err := core.ValidateCompression(opts.Compression); err != nil {
+		return err
+	}
+	switch opts.Format {
+	case "", core.FormatDataPipeline:
+	case core.FormatAWSExport:
+		if opts.Resume || (opts.Compression != "" && opts.Compression != core.CompressionNone) || opts.Encryption.KeyFile != "" || opts.Encryption.KMSKeyID != "" {
+			return fmt.Errorf("The %s format can't be resumed, is always gzipped and can't be encrypted", core.FormatAWSExport)
+		}
+	default:
+		return fmt.Errorf("Unsupported format %s, must be %s or %s", opts.Format, core.FormatDataPipeline, core.FormatAWSExport)
+	}
+	if err := opts.Upload.Validate(); err != nil {
+		return err
+	}
+	if err := checkThroughputRatio(opts.ThroughputRatio); err != nil {
+		return err
+	}
+	if err := opts.Retry.Validate(); err != nil {
+		return fmt.Errorf("Invalid retry policy: %s", err)
+	}
+	transform, err := loadTransform(opts.TransformFile)
+	if err != nil {
+		return err
 	}
 
-	proc := core.NewAwsHelper(dynamoRegion, "", "")
-	dest := core.NewAwsHelper(s3Region, s3AccountID, roleAssumed)
+	proc, err := newAwsHelper(opts.DynamoRegion, "", "")
+	if err != nil {
+		return err
+	}
+	dest, err := newAwsHelper(opts.S3Region, opts.S3AccountID, opts.RoleAssumed)
+	if err != nil {
+		return err
+	}
+	proc.Retry = opts.Retry
+	proc.Transform = transform
+	proc.ShutdownTimeout = opts.ShutdownTimeout
+	dest.Retry = opts.Retry
+	defer opts.Retry.LogReport()
+	if proc.ReadLimiter, _, err = capacityLimiters(proc, opts.TableName, opts.ThroughputRatio); err != nil {
+		return err
+	}
+	dest.Compression = opts.Compression
+	dest.Upload = opts.Upload
+	if dest.Keys, err = opts.Encryption.keyProvider(dest, false); err != nil {
+		return err
+	}
 
-	go proc.ChannelToS3(bucket, prefix, 10*1024*1024, dest)
+	proc.Progress = core.NewScanProgress(opts.TableName, opts.Segments)
+	if opts.Resume {
+		checkpoint, err := loadCheckpoint(dest, opts.TableName, opts.Bucket, opts.Prefix)
+		if err != nil {
+			return err
+		}
+		if checkpoint != nil {
+			if checkpoint.TotalSegments != opts.Segments {
+				log.Printf("[WARNING] Resuming with the %d segments of the interrupted backup\n", checkpoint.TotalSegments)
+				opts.Segments = checkpoint.TotalSegments
+			}
+			log.Printf("Resuming the backup of %s, %d files already written\n", opts.TableName, len(checkpoint.Manifest.Entries))
+			proc.Progress = core.ResumeScanProgress(checkpoint)
+			dest.ManifestS3 = checkpoint.Manifest
+		}
+	}
 
-	err := proc.TableToChannel(tableName, batchSize, waitPeriod)
+	// Keep the schema and settings of the table along with its data
+	def, err := proc.DescribeTableDefinition(opts.TableName)
 	if err != nil {
-		log.Fatal(err.Error())
+		return fmt.Errorf("Unable to describe the table %s: %w", opts.TableName, err)
 	}
+	if err := dest.TableDefinitionToS3(ctx, opts.Bucket, opts.Prefix, def); err != nil {
+		return err
+	}
+
+	// Errors of the s3 writer are collected once the scan is over. The scan
+	// stops as soon as the writer fails, instead of going on for it to drain
+	// the channel
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	proc.StopScan = cancel
+	s3Errs := make(chan error, 1)
+	go func() {
+		if opts.Format == core.FormatAWSExport {
+			s3Errs <- proc.ChannelToExport(ctx, opts.Bucket, opts.Prefix, 10*1024*1024, dest)
+			return
+		}
+		s3Errs <- proc.ChannelToS3(ctx, opts.Bucket, opts.Prefix, 10*1024*1024, dest)
+	}()
 
+	scanErr := proc.TableToChannel(scanCtx, opts.TableName, opts.BatchSize, opts.WaitPeriod, opts.Segments)
 	proc.Wg.Wait()
+	// The s3 writer wraps the error of the scan once it has flushed its data
+	if err := <-s3Errs; err != nil {
+		return err
+	}
+	return scanErr
+}
+
+// loadCheckpoint retrieves the checkpoint of an interrupted backup. Returns nil
+// if there is none, and an error if the backup is already complete or belongs
+// to another table
+func loadCheckpoint(dest *core.AwsHelper, tableName, bucket, prefix string) (*core.S3Checkpoint, error) {
+	if exists, err := dest.ExistsInS3(bucket, fmt.Sprintf("%s/_SUCCESS", prefix)); err != nil {
+		return nil, fmt.Errorf("Unable to retrieve the _SUCCESS flag information: %w", err)
+	} else if exists {
+		return nil, fmt.Errorf("The backup in the provided folder is already complete")
+	}
+
+	checkpoint, err := dest.LoadCheckpointFromS3(bucket, fmt.Sprintf("%s/%s", prefix, core.CheckpointFileName))
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			log.Println("[WARNING] No checkpoint found in the provided folder, starting the backup from scratch")
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to load the checkpoint: %w", err)
+	}
+	if checkpoint.TableName != tableName {
+		return nil, fmt.Errorf("The checkpoint belongs to a backup of the table %s", checkpoint.TableName)
+	}
+	if err := checkSegments(checkpoint.TotalSegments); err != nil {
+		return nil, fmt.Errorf("Invalid checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// checkSegments returns an error if the table can't be scanned with the given
+// number of segments
+func checkSegments(segments int64) error {
+	if segments < 1 {
+		return fmt.Errorf("The number of segments must be at least 1")
+	}
+	return nil
 }
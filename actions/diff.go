@@ -0,0 +1,117 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AltoStack/dynamodump/core"
+)
+
+// BackupDiff compares the backup in the given s3 folder to the backup in
+// toPrefix, or to the live table toTable, and prints a json report of the
+// added, removed and modified items on the standard output. The items are
+// keyed by keyAttributes if set, else by the key schema stored in the first
+// backup, else by the one of toTable. Returns whether both are identical
+func BackupDiff(ctx context.Context, bucket, fromPrefix, toPrefix, toTable string, keyAttributes []string, batchSize int64, waitPeriod time.Duration, encryption EncryptionKey, dynamoRegion, roleAssumed, s3AccountID, s3Region string, retry *core.RetryPolicy) (bool, error) {
+	if (toPrefix == "") == (toTable == "") {
+		return false, fmt.Errorf("Exactly one of the backup or the table to compare to must be set")
+	}
+	if toTable != "" && dynamoRegion == "" {
+		return false, fmt.Errorf("Missing field dynamoRegion")
+	}
+	if err := retry.Validate(); err != nil {
+		return false, fmt.Errorf("Invalid retry policy: %s", err)
+	}
+	proc, err := newAwsHelper(s3Region, s3AccountID, roleAssumed)
+	if err != nil {
+		return false, err
+	}
+	proc.Retry = retry
+	defer retry.LogReport()
+	if proc.Keys, err = encryption.keyProvider(proc, true); err != nil {
+		return false, err
+	}
+	var table *core.AwsHelper
+	if toTable != "" {
+		if table, err = newAwsHelper(dynamoRegion, "", ""); err != nil {
+			return false, err
+		}
+		table.Retry = retry
+	}
+
+	def, err := diffKeySchema(bucket, fromPrefix, toTable, keyAttributes, proc, table)
+	if err != nil {
+		return false, err
+	}
+	from := core.StorageURL(bucket, fromPrefix)
+	to := core.StorageURL(bucket, toPrefix)
+	if toTable != "" {
+		to = toTable
+	}
+	differ := core.NewDiffer(def, from, to)
+
+	log.Printf("Loading the items of %s\n", from)
+	if err := proc.BackupItems(ctx, bucket, fromPrefix, differ.AddFrom); err != nil {
+		return false, fmt.Errorf("Unable to read the backup %s: %w", from, err)
+	}
+	log.Printf("Comparing the items of %s\n", to)
+	if toTable != "" {
+		err = table.TableItems(ctx, toTable, batchSize, waitPeriod, differ.CompareTo)
+	} else {
+		err = proc.BackupItems(ctx, bucket, toPrefix, differ.CompareTo)
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to read %s: %w", to, err)
+	}
+
+	report := differ.Report()
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return false, fmt.Errorf("while doing a marshal on the report: %s", err)
+	}
+	fmt.Println(string(data))
+	log.Printf("%d items added, %d removed, %d modified and %d unchanged\n", report.Summary.Added, report.Summary.Removed, report.Summary.Modified, report.Summary.Unchanged)
+	return report.Identical(), nil
+}
+
+// diffKeySchema returns the definition holding the key schema used to compare
+// the items
+func diffKeySchema(bucket, fromPrefix, toTable string, keyAttributes []string, proc, table *core.AwsHelper) (*core.TableDefinition, error) {
+	if len(keyAttributes) > 0 {
+		def := &core.TableDefinition{}
+		for _, attribute := range keyAttributes {
+			def.KeySchema = append(def.KeySchema, core.KeyDefinition{AttributeName: attribute})
+		}
+		return def, nil
+	}
+	def, err := proc.LoadTableDefinitionFromS3(bucket, fmt.Sprintf("%s/%s", fromPrefix, core.TableDefinitionFileName))
+	if err == nil {
+		return def, nil
+	}
+	if table == nil {
+		return nil, fmt.Errorf("Unable to load the key schema of the backup, it can be set with the key attributes: %w", err)
+	}
+	log.Printf("[WARNING] Unable to load the key schema of the backup, using the one of %s: %s\n", toTable, err)
+	if def, err = table.DescribeKeySchema(toTable); err != nil {
+		return nil, fmt.Errorf("Unable to describe the table %s: %w", toTable, err)
+	}
+	return def, nil
+}
@@ -0,0 +1,48 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"fmt"
+
+	"github.com/AltoStack/dynamodump/core"
+)
+
+// EncryptionKey holds the key used to wrap the data keys of the backup files,
+// either a local KeyFile or a KMSKeyID
+type EncryptionKey struct {
+	KeyFile  string
+	KMSKeyID string
+}
+
+// keyProvider returns the key provider matching the EncryptionKey, using the
+// session of the given helper for KMS. Returns nil when no key is set and
+// useKMS is false
+func (k EncryptionKey) keyProvider(h *core.AwsHelper, useKMS bool) (core.KeyProvider, error) {
+	switch {
+	case k.KeyFile != "" && k.KMSKeyID != "":
+		return nil, fmt.Errorf("Only one of the encryption key file or the KMS key ID can be set")
+	case k.KeyFile != "":
+		keys, err := core.NewLocalKeyProvider(k.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load the encryption key: %w", err)
+		}
+		return keys, nil
+	case k.KMSKeyID != "" || useKMS:
+		return core.NewKMSKeyProvider(h, k.KMSKeyID), nil
+	}
+	return nil, nil
+}
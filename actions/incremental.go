@@ -0,0 +1,204 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AltoStack/dynamodump/core"
+)
+
+// TableIncrementalBackup reads the changes of the given DynamoDB table from
+// its stream and writes them to a new folder of the incremental backups
+// following the full backup in the given s3 folder, or the latest complete one
+// of its dated subfolders if AddDate is set. It starts where the last
+// incremental backup stopped, or from the oldest record of the stream for the
+// first one. When follow is set, a new incremental backup is written every
+// follow period until ctx is done, switching to a newer full backup as soon as
+// one is complete. Once ctx is done, the changes read so far are written
+// within ShutdownTimeout along with the positions reached in the stream. The
+// scan settings, Resume, Format and TransformFile are not used
+func TableIncrementalBackup(ctx context.Context, opts BackupOptions, follow time.Duration) error {
+	if opts.DynamoRegion == "" || opts.S3Region == "" && !core.IsLocalStorage(opts.Bucket) {
+		return fmt.Errorf("Missing fields dynamoRegion or s3Region")
+	}
+	if err := core.ValidateCompression(opts.Compression); err != nil {
+		return err
+	}
+	if err := opts.Upload.Validate(); err != nil {
+		return err
+	}
+	if err := opts.Retry.Validate(); err != nil {
+		return fmt.Errorf("Invalid retry policy: %s", err)
+	}
+
+	proc, err := newAwsHelper(opts.DynamoRegion, "", "")
+	if err != nil {
+		return err
+	}
+	dest, err := newAwsHelper(opts.S3Region, opts.S3AccountID, opts.RoleAssumed)
+	if err != nil {
+		return err
+	}
+	proc.Retry = opts.Retry
+	proc.ShutdownTimeout = opts.ShutdownTimeout
+	dest.Retry = opts.Retry
+	defer opts.Retry.LogReport()
+	dest.Compression = opts.Compression
+	dest.Upload = opts.Upload
+	if dest.Keys, err = opts.Encryption.keyProvider(dest, false); err != nil {
+		return err
+	}
+
+	streamArn, err := proc.TableStreamArn(opts.TableName)
+	if err != nil {
+		return err
+	}
+	var progress *core.StreamProgress
+	for {
+		base := opts.Prefix
+		if opts.AddDate {
+			if base, err = dest.LatestBackupFolder(ctx, opts.Bucket, opts.Prefix); err != nil {
+				return fmt.Errorf("Unable to find the latest full backup: %w", err)
+			}
+		}
+		progress, err = incrementalBackup(ctx, opts.TableName, streamArn, opts.WaitPeriod, opts.Bucket, base, progress, proc, dest)
+		if err != nil || follow <= 0 {
+			return err
+		}
+		log.Printf("Next incremental backup in %s\n", follow)
+		timer := time.NewTimer(follow)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// incrementalBackup writes the changes following the last incremental backup
+// of the full backup in the given s3 folder. If there is none yet, the stream
+// is read from the given progress of the previous full backup, or from its
+// oldest record if nil. Returns the positions reached in the stream
+func incrementalBackup(ctx context.Context, tableName, streamArn string, waitPeriod time.Duration, bucket, base string, progress *core.StreamProgress, proc, dest *core.AwsHelper) (*core.StreamProgress, error) {
+	if err := checkBaseBackup(dest, tableName, bucket, base); err != nil {
+		return nil, err
+	}
+	resumed, previous, err := loadStreamProgress(ctx, dest, streamArn, bucket, base)
+	switch {
+	case err != nil:
+		return nil, err
+	case resumed != nil:
+		progress = resumed
+	case progress != nil:
+		log.Printf("First incremental backup of %s, reading the stream where the previous full backup stopped\n", core.StorageURL(bucket, base))
+	default:
+		log.Println("[WARNING] No previous incremental backup, reading the stream from its oldest record. The full backup must be less than 24 hours old for no change to be missed")
+		progress = core.NewStreamProgress()
+	}
+	dest.ManifestS3 = core.S3Manifest{Base: core.StorageURL(bucket, base), Previous: previous}
+
+	folder := fmt.Sprintf("%s/%s/%s", base, core.ChangesFolderName, time.Now().UTC().Format("2006-01-02-15-04-05"))
+	changes, err := proc.StreamToS3(ctx, streamArn, progress, waitPeriod, bucket, folder, 10*1024*1024, dest)
+	log.Printf("%d changes written to %s\n", changes, core.StorageURL(bucket, folder))
+	return progress, err
+}
+
+// checkBaseBackup checks that the full backup in the given s3 folder is
+// complete and belongs to the given table
+func checkBaseBackup(dest *core.AwsHelper, tableName, bucket, prefix string) error {
+	if exists, err := dest.ExistsInS3(bucket, fmt.Sprintf("%s/_SUCCESS", prefix)); err != nil {
+		return fmt.Errorf("Unable to retrieve the _SUCCESS flag information: %w", err)
+	} else if !exists {
+		return fmt.Errorf("The full backup in the provided folder is not complete")
+	}
+	def, err := dest.LoadTableDefinitionFromS3(bucket, fmt.Sprintf("%s/%s", prefix, core.TableDefinitionFileName))
+	if err != nil {
+		log.Printf("[WARNING] Unable to load the table definition of the full backup: %s\n", err)
+		return nil
+	}
+	if def.TableName != tableName {
+		return fmt.Errorf("The full backup belongs to the table %s", def.TableName)
+	}
+	return nil
+}
+
+// loadStreamProgress returns the positions reached in the stream by the last
+// incremental backup of the full backup in the given folder, along with the
+// URL of its manifest. Returns a nil progress if there is no incremental
+// backup yet
+func loadStreamProgress(ctx context.Context, dest *core.AwsHelper, streamArn, bucket, prefix string) (*core.StreamProgress, string, error) {
+	manifests, err := dest.ChangesManifests(ctx, bucket, prefix)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to list the incremental backups: %w", err)
+	}
+	if len(manifests) == 0 {
+		return nil, "", nil
+	}
+
+	last := manifests[len(manifests)-1]
+	if err := dest.LoadManifestFromS3(bucket, last); err != nil {
+		return nil, "", fmt.Errorf("Unable to load the manifest of the last incremental backup: %w", err)
+	}
+	if dest.ManifestS3.StreamArn != streamArn {
+		return nil, "", fmt.Errorf("The stream of the table changed since the last incremental backup, a new full backup is needed")
+	}
+	log.Printf("Resuming the stream where %s stopped\n", core.StorageURL(bucket, last))
+	return core.ResumeStreamProgress(dest.ManifestS3.Shards), core.StorageURL(bucket, last), nil
+}
+
+// loadChanges loads the manifests of the incremental backups of the full
+// backup in the given s3 folder, oldest first, checking that each one follows
+// the previous one. The full backup, whose manifest is loaded in proc, must be
+// over by until
+func loadChanges(ctx context.Context, proc *core.AwsHelper, bucket, prefix string, until time.Time) ([]core.S3Manifest, error) {
+	switch end := proc.ManifestS3.EndTime; {
+	case end == nil:
+		log.Println("[WARNING] The end of the full backup is not recorded in its manifest, changes made before it may be replayed")
+	case until.Before(*end):
+		return nil, fmt.Errorf("The full backup ended at %s, the table can't be restored as it was before", end.Format(time.RFC3339))
+	}
+
+	paths, err := proc.ChangesManifests(ctx, bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list the incremental backups: %w", err)
+	}
+	base := core.StorageURL(bucket, prefix)
+	loaded := proc.ManifestS3
+	defer func() { proc.ManifestS3 = loaded }()
+
+	manifests := []core.S3Manifest{}
+	previous := ""
+	for _, path := range paths {
+		if err := proc.LoadManifestFromS3(bucket, path); err != nil {
+			return nil, fmt.Errorf("Unable to load the manifest of an incremental backup: %w", err)
+		}
+		url := core.StorageURL(bucket, path)
+		switch {
+		case proc.ManifestS3.Base != base:
+			return nil, fmt.Errorf("The incremental backup %s belongs to the full backup %s", url, proc.ManifestS3.Base)
+		case proc.ManifestS3.Previous != previous:
+			return nil, fmt.Errorf("The incremental backup %s doesn't follow %s, some changes may be missing", url, previous)
+		}
+		manifests = append(manifests, proc.ManifestS3)
+		previous = url
+	}
+	return manifests, nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/AltoStack/dynamodump/core"
+)
+
+// TableBackupToWriter scans the given DynamoDB table and writes its items to
+// the given writer, one json document per line as in the backup files,
+// without any manifest. Once ctx is done, the scan stops and the items scanned
+// so far are written. The rules of transformFile, if any, are applied to the
+// items before writing them
+func TableBackupToWriter(ctx context.Context, tableName string, batchSize, segments int64, waitPeriod time.Duration, throughputRatio float64, transformFile string, w io.Writer, dynamoRegion string, retry *core.RetryPolicy) error {
+	if dynamoRegion == "" {
+		return fmt.Errorf("Missing field dynamoRegion")
+	}
+	if err := checkSegments(segments); err != nil {
+		return err
+	}
+	if err := checkThroughputRatio(throughputRatio); err != nil {
+		return err
+	}
+	if err := retry.Validate(); err != nil {
+		return fmt.Errorf("Invalid retry policy: %s", err)
+	}
+	transform, err := loadTransform(transformFile)
+	if err != nil {
+		return err
+	}
+
+	proc, err := newAwsHelper(dynamoRegion, "", "")
+	if err != nil {
+		return err
+	}
+	proc.Retry = retry
+	proc.Transform = transform
+	defer retry.LogReport()
+	if proc.ReadLimiter, _, err = capacityLimiters(proc, tableName, throughputRatio); err != nil {
+		return err
+	}
+
+	// The scan stops as soon as a write fails, instead of going on for the
+	// writer to drain the channel
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w = &cancelWriter{w: w, cancel: cancel}
+
+	// The writer wraps the error of the scan once it has written its items
+	results := make(chan writeResult, 1)
+	go func() {
+		count, err := proc.ChannelToWriter(w)
+		results <- writeResult{count: count, err: err}
+	}()
+	scanErr := proc.TableToChannel(ctx, tableName, batchSize, waitPeriod, segments)
+	result := <-results
+	proc.Wg.Wait()
+	log.Printf("%d items of %s written\n", result.count, tableName)
+	if result.err != nil {
+		return result.err
+	}
+	return scanErr
+}
+
+// writeResult is the outcome of ChannelToWriter
+type writeResult struct {
+	count int64
+	err   error
+}
+
+// cancelWriter cancels a context once a write to the underlying writer fails
+type cancelWriter struct {
+	w      io.Writer
+	cancel context.CancelFunc
+}
+
+func (c *cancelWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		c.cancel()
+	}
+	return n, err
+}
+
+// TableRestoreFromReader restores the items read from the given reader, one
+// json document per line as in the backup files, into the given existing
+// table. A non-empty table aborts the restore unless appendToTable is set. The
+// rules of transformFile, if any, are applied to the items before writing
+// them, then their key attributes are computed from the given keyTemplates.
+// The restore stops as soon as ctx is done
+func TableRestoreFromReader(ctx context.Context, tableName string, batchSize int64, waitPeriod time.Duration, throughputRatio float64, transformFile string, keyTemplates map[string]string, appendToTable bool, r io.Reader, dynamoAccountID, dynamoRegion, roleAssumed string, retry *core.RetryPolicy) error {
+	if err := checkThroughputRatio(throughputRatio); err != nil {
+		return err
+	}
+	if err := retry.Validate(); err != nil {
+		return fmt.Errorf("Invalid retry policy: %s", err)
+	}
+	transform, err := loadTransform(transformFile)
+	if err != nil {
+		return err
+	}
+	proc, err := newAwsHelper(dynamoRegion, "", "")
+	if err != nil {
+		return err
+	}
+	proc.Transform = transform
+	dest, err := newAwsHelper(dynamoRegion, dynamoAccountID, roleAssumed)
+	if err != nil {
+		return err
+	}
+	proc.Retry = retry
+	dest.Retry = retry
+	defer retry.LogReport()
+
+	itemsCount, err := dest.CheckTableEmpty(tableName)
+	if err != nil {
+		return fmt.Errorf("Unable to retrieve the target table informations: %w", err)
+	}
+	switch {
+	case itemsCount > 0 && !appendToTable:
+		return fmt.Errorf("The target table is not empty")
+	case itemsCount == -1:
+		return fmt.Errorf("The target table does not exists: %w", core.ErrTableNotFound)
+	case itemsCount < -1:
+		return fmt.Errorf("The target table is not in ACTIVE state, so not writable")
+	}
+	if len(keyTemplates) > 0 {
+		target, err := targetKeySchema(tableName, nil, dest)
+		if err != nil {
+			return err
+		}
+		if proc.KeyRemap, err = core.NewKeyRemap(keyTemplates, target); err != nil {
+			return fmt.Errorf("Invalid key templates: %w", err)
+		}
+	}
+	if _, dest.WriteLimiter, err = capacityLimiters(dest, tableName, throughputRatio); err != nil {
+		return err
+	}
+
+	// The error of the reader takes precedence over the error of the writes
+	writeErrs := make(chan error, 1)
+	proc.Wg.Add(1)
+	go func() {
+		writeErrs <- proc.ChannelToTable(ctx, tableName, batchSize, waitPeriod, dest)
+	}()
+	reader := ioutil.NopCloser(r)
+	err = proc.ReaderToChannel(ctx, &reader)
+	close(proc.DataPipe)
+	writeErr := <-writeErrs
+	proc.Wg.Wait()
+	if err != nil {
+		return fmt.Errorf("Unable to read the items: %w", err)
+	}
+	if writeErr != nil {
+		return fmt.Errorf("Unable to import the items to Dynamo: %w", writeErr)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AltoStack/dynamodump/core"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// struct to mock the Dynamo calls of a scan that never ends
+type mockEndlessDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func (m *mockEndlessDynamoDBClient) ScanPagesWithContext(ctx aws.Context, params *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	for {
+		page := &dynamodb.ScanOutput{
+			ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1), TableName: params.TableName},
+			Count:            aws.Int64(1),
+			Items:            []map[string]*dynamodb.AttributeValue{{"artist": {S: aws.String("Queen")}}},
+		}
+		if !pager(page, false) {
+			return ctx.Err()
+		}
+	}
+}
+
+// failingWriter fails every write, as a closed standard output
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestTableBackupToWriterFailure(t *testing.T) {
+	previous := newAwsHelper
+	t.Cleanup(func() { newAwsHelper = previous })
+	newAwsHelper = func(region, accountID, accountRole string) (*core.AwsHelper, error) {
+		return &core.AwsHelper{DynamoSvc: &mockEndlessDynamoDBClient{}, DataPipe: make(chan map[string]*dynamodb.AttributeValue)}, nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- TableBackupToWriter(context.Background(), "myTable", 10, 1, 0, 0, "", failingWriter{}, "eu-west-1", core.NewRetryPolicy())
+	}()
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "broken pipe" {
+			t.Fatalf("Expecting the error of the writer, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The scan didn't stop once the writer failed")
+	}
+}
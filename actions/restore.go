@@ -16,58 +16,436 @@ limitations under the License.
 package actions
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"time"
 
 	"github.com/AltoStack/dynamodump/core"
 )
 
-func TableRestore(tableName string, batchSize int64, waitPeriod time.Duration, bucket, prefix string, appendToTable, forceRestore bool, dynamoAccountID, dynamoRegion, roleAssumed, s3AccountID, s3Region string) {
-	proc := core.NewAwsHelper(s3Region, s3AccountID, "")
-	dest := core.NewAwsHelper(dynamoRegion, dynamoAccountID, roleAssumed)
+// TableCreation holds the settings used by TableRestore to create the target
+// table when it doesn't exist. The table is built from DefinitionFile if set,
+// else from the table SourceTable if set, else from the table definition
+// stored in the backup. The billing mode and capacity override the ones of the
+// definition when set
+type TableCreation struct {
+	DefinitionFile     string
+	SourceTable        string
+	BillingMode        string
+	ReadCapacityUnits  int64
+	WriteCapacityUnits int64
+}
+
+// TableReplacement holds the settings used by TableRestore to empty a
+// non-empty target table before restoring. The items of the table are deleted,
+// unless Recreate is set to drop the table and create it again from its
+// description. Confirm must be the name of the target table
+type TableReplacement struct {
+	Recreate bool
+	Confirm  string
+}
+
+// TableSync holds the settings used by TableRestore to make the target table
+// match the backup exactly, deleting the items of the table missing from the
+// backup once it is restored. With DryRun, nothing is written nor deleted and
+// only the report is printed
+type TableSync struct {
+	DryRun bool
+}
+
+// PointInTime holds the settings used by TableRestore to replay the changes
+// recorded by the incremental backups of the restored backup, up to Until
+type PointInTime struct {
+	Until time.Time
+}
+
+// RestoreOptions holds the settings of a restore of the backup in the folder
+// Prefix of Bucket, an s3 bucket or a file:// URL, into the DynamoDB table
+// TableName. The items are written BatchSize at once, waiting WaitPeriod
+// between batches unless ThroughputRatio is set. A non-empty table is only
+// written to with AppendToTable, and a backup without _SUCCESS flag is only
+// restored with ForceRestore. DynamoRegion is the region of the table, accessed
+// with the role RoleAssumed of the account DynamoAccountID, and the s3 bucket
+// is read in S3Region from the account S3AccountID
+type RestoreOptions struct {
+	TableName        string
+	BatchSize        int64
+	WaitPeriod       time.Duration
+	ThroughputRatio  float64
+	Bucket           string
+	Prefix           string
+	DeadLetterPrefix string
+	TransformFile    string
+	KeyTemplates     map[string]string
+	Conflicts        core.ConflictPolicy
+	AppendToTable    bool
+	ForceRestore     bool
+	Create           *TableCreation
+	Replace          *TableReplacement
+	Sync             *TableSync
+	PointInTime      *PointInTime
+	Encryption       EncryptionKey
+	DynamoAccountID  string
+	DynamoRegion     string
+	RoleAssumed      string
+	S3AccountID      string
+	S3Region         string
+	Retry            *core.RetryPolicy
+}
+
+// TableRestore restores the backup found in the given s3 folder, or the native
+// DynamoDB export it holds, into the given table. A missing table is created
+// first when Create is set, a non-empty table is emptied first when Replace is
+// set, and the items missing from the backup are deleted once restored when
+// Sync is set. When PointInTime is set, the changes of the incremental
+// backups of the backup are replayed once it is restored, up to the given time.
+// The restore stops as soon as ctx is done. When DeadLetterPrefix is set, the
+// items rejected by the table are written to that folder of the bucket instead
+// of failing the restore. The rules of TransformFile, if any, are applied to
+// the items before writing them, then their key attributes are computed from
+// the given KeyTemplates. The items already in the table are handled following
+// the Conflicts policy, a non-overwriting policy allowing to restore into a
+// non-empty table
+func TableRestore(ctx context.Context, opts RestoreOptions) error {
+	if err := checkThroughputRatio(opts.ThroughputRatio); err != nil {
+		return err
+	}
+	if err := opts.Retry.Validate(); err != nil {
+		return fmt.Errorf("Invalid retry policy: %s", err)
+	}
+	if err := opts.Conflicts.Validate(); err != nil {
+		return err
+	}
+	if opts.Replace != nil && opts.Replace.Confirm != opts.TableName {
+		return fmt.Errorf("The replacement of the table must be confirmed with its name %s", opts.TableName)
+	}
+	if opts.Replace != nil && opts.Sync != nil {
+		return fmt.Errorf("A table can't be replaced and synchronized at the same time")
+	}
+	if opts.PointInTime != nil && (opts.TransformFile != "" || len(opts.KeyTemplates) > 0 || opts.Conflicts.Conditional() || opts.Sync != nil) {
+		return fmt.Errorf("The changes can't be replayed along with transformation rules, key templates, conditional writes or a sync")
+	}
+	transform, err := loadTransform(opts.TransformFile)
+	if err != nil {
+		return err
+	}
+	proc, err := newAwsHelper(opts.S3Region, opts.S3AccountID, "")
+	if err != nil {
+		return err
+	}
+	proc.Transform = transform
+	dest, err := newAwsHelper(opts.DynamoRegion, opts.DynamoAccountID, opts.RoleAssumed)
+	if err != nil {
+		return err
+	}
+	proc.Retry = opts.Retry
+	dest.Retry = opts.Retry
+	defer opts.Retry.LogReport()
 
 	// Check if the table exists and has data in it. If so, abort
-	itemsCount, err := dest.CheckTableEmpty(tableName)
+	itemsCount, err := dest.CheckTableEmpty(opts.TableName)
 	if err != nil {
-		log.Fatalf("[ERROR] Unable to retrieve the target table informations: %s\nAborting...\n", err)
+		return fmt.Errorf("Unable to retrieve the target table informations: %w", err)
 	}
 	switch {
-	case itemsCount > 0 && !appendToTable:
-		log.Fatalf("[ERROR] The target table is not empty. Aborting...\n")
-	case itemsCount == -1:
-		log.Fatalf("[ERROR] The target table does not exists. Aborting...\n")
+	case itemsCount > 0 && !opts.AppendToTable && !opts.Conflicts.Conditional() && opts.Replace == nil && opts.Sync == nil:
+		return fmt.Errorf("The target table is not empty")
+	case itemsCount == -1 && (opts.Create == nil || opts.Sync != nil && opts.Sync.DryRun):
+		return fmt.Errorf("The target table does not exists: %w", core.ErrTableNotFound)
 	case itemsCount < -1:
-		log.Fatalf("[ERROR] The target table is not in ACTIVE state, so not writable. Aborting...\n")
+		return fmt.Errorf("The target table is not in ACTIVE state, so not writable")
+	}
+
+	complete, err := loadBackupManifest(ctx, proc, opts.Bucket, opts.Prefix, opts.ForceRestore)
+	if err != nil {
+		return err
+	}
+	// The items missing from an incomplete backup would be deleted
+	if opts.Sync != nil && !opts.Sync.DryRun && !complete {
+		return fmt.Errorf("A table can only be synchronized with a complete backup, --sync-dry-run can still list the differences")
+	}
+	var changes []core.S3Manifest
+	if opts.PointInTime != nil {
+		if changes, err = loadChanges(ctx, proc, opts.Bucket, opts.Prefix, opts.PointInTime.Until); err != nil {
+			return err
+		}
+	}
+
+	// Everything is set up before the target table is created or emptied, so
+	// that an invalid setting leaves it untouched
+	var def *core.TableDefinition
+	if itemsCount == -1 {
+		if def, err = tableDefinitionToCreate(opts.TableName, opts.Bucket, opts.Prefix, opts.Create, proc, dest); err != nil {
+			return err
+		}
+	}
+	// A recreated table gets the key schema it is described with
+	var target *core.TableDefinition
+	if len(opts.KeyTemplates) > 0 || opts.Conflicts.Conditional() || opts.Sync != nil {
+		if target, err = targetKeySchema(opts.TableName, def, dest); err != nil {
+			return err
+		}
+	}
+	if len(opts.KeyTemplates) > 0 {
+		if proc.KeyRemap, err = core.NewKeyRemap(opts.KeyTemplates, target); err != nil {
+			return fmt.Errorf("Invalid key templates: %w", err)
+		}
+	}
+	if dest.Conflicts, err = opts.Conflicts.ForTable(target); err != nil {
+		return err
+	}
+	if opts.Sync != nil {
+		proc.SyncKeys = core.NewKeySet(target)
+		dest.DryRun = opts.Sync.DryRun
+	}
+
+	// Encrypted files without a key file are expected to be wrapped by KMS,
+	// which doesn't need the key ID to unwrap
+	if proc.Keys, err = opts.Encryption.keyProvider(proc, true); err != nil {
+		return err
+	}
+	// The capacity of a table to create is only known once created
+	if itemsCount != -1 {
+		if dest.ReadLimiter, dest.WriteLimiter, err = capacityLimiters(dest, opts.TableName, opts.ThroughputRatio); err != nil {
+			return err
+		}
+	}
+	dest.ManifestS3 = proc.ManifestS3
+	if opts.DeadLetterPrefix != "" {
+		if dest.DeadLetter, err = newDeadLetter(opts.Bucket, opts.DeadLetterPrefix, opts.Encryption, opts.Retry, opts.S3AccountID, opts.S3Region); err != nil {
+			return err
+		}
+	}
+
+	if itemsCount >= 0 && opts.Replace != nil {
+		if def, err = replaceTable(ctx, opts.TableName, opts.BatchSize, opts.WaitPeriod, opts.Replace, dest); err != nil {
+			return err
+		}
+	}
+	if itemsCount == -1 {
+		if err := dest.CreateTableFromDefinition(def); err != nil {
+			return fmt.Errorf("Unable to create the target table: %w", err)
+		}
+		if dest.ReadLimiter, dest.WriteLimiter, err = capacityLimiters(dest, opts.TableName, opts.ThroughputRatio); err != nil {
+			return err
+		}
+	}
+	// For each file in the manifest pull the file, decode each line and add them to a batch and push them into the table (batch size, then wait and continue)
+	err = proc.S3ToDynamo(ctx, opts.TableName, opts.BatchSize, opts.WaitPeriod, dest)
+	if dest.DeadLetter != nil {
+		// The rejected items are kept even if the restore didn't complete
+		if dlErr := closeDeadLetter(dest.DeadLetter); dlErr != nil && err == nil {
+			err = dlErr
+		}
+	}
+	if dest.Conflicts != nil {
+		log.Printf("%d items already in the table were skipped\n", dest.Conflicts.Skipped())
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to import the full s3 actions to Dynamo: %w", err)
+	}
+	if opts.Sync != nil {
+		if err := syncTable(ctx, target, opts.BatchSize, opts.WaitPeriod, opts.Sync, proc, dest); err != nil {
+			return err
+		}
+	}
+	if opts.PointInTime != nil {
+		if err := replayChanges(ctx, opts.TableName, opts.BatchSize, opts.WaitPeriod, opts.PointInTime.Until, changes, proc, dest); err != nil {
+			return err
+		}
+	}
+
+	// TTL and tags are applied once the data is in, so no item expires during
+	// the restore
+	if def != nil {
+		if err := dest.ApplyTableSettings(def); err != nil {
+			return fmt.Errorf("Unable to apply the TTL and tags to the target table: %w", err)
+		}
 	}
+	return nil
+}
 
+// syncTable deletes the items of the target table missing from the backup, or
+// only lists them for a dry run, and prints the report on the standard output
+func syncTable(ctx context.Context, target *core.TableDefinition, batchSize int64, waitPeriod time.Duration, tableSync *TableSync, proc, dest *core.AwsHelper) error {
+	report, err := dest.DeleteExtraItems(ctx, target, proc.SyncKeys, batchSize, waitPeriod, tableSync.DryRun)
+	if err != nil {
+		return fmt.Errorf("Unable to delete the items missing from the backup, %d deleted: %w", report.Deletes, err)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("while doing a marshal on the report: %s", err)
+	}
+	fmt.Println(string(data))
+	log.Printf("%d items written and %d items deleted from %s\n", report.Puts, report.Deletes, target.TableName)
+	return nil
+}
+
+// loadBackupManifest loads the manifest of the backup in the given s3 folder,
+// or the data files of the native DynamoDB export it holds, in
+// proc.ManifestS3. A backup without _SUCCESS flag is only loaded when
+// forceRestore is set. Returns whether the backup is complete
+func loadBackupManifest(ctx context.Context, proc *core.AwsHelper, bucket, prefix string, forceRestore bool) (bool, error) {
 	// Check if a file "_SUCCESS" is present in the directory
-	if exists, err := proc.ExistsInS3(bucket, fmt.Sprintf("%s/_SUCCESS", prefix)); !exists {
-		switch {
-		case err != nil:
-			log.Fatalf("[ERROR] Unable to retrieve the _SUCCESS flag information: %s\nAborting...\n", err)
-		case !exists:
-			if forceRestore {
-				log.Println("[WARNING] _SUCCESS flag is missing, data may not be accurate")
-				log.Println("[WARNING] -force-restore flag enabled, continue..")
-			} else {
-				log.Println("[ERROR] Unable to find a _SUCCESS flag in the provided folder. Are you sure the actions was successful?")
-				log.Println("[ERROR] Please enable -force-restore flag if you wish to continue anyway")
-				log.Fatalf("[ERROR] Aborting...")
+	exists, err := proc.ExistsInS3(bucket, fmt.Sprintf("%s/_SUCCESS", prefix))
+	if err != nil {
+		return false, fmt.Errorf("Unable to retrieve the _SUCCESS flag information: %w", err)
+	}
+	if !exists {
+		// The native exports have no _SUCCESS flag, their summary is only
+		// written once complete
+		exportFolder, err := proc.FindExport(ctx, bucket, prefix)
+		if err != nil {
+			return false, fmt.Errorf("Unable to look for a DynamoDB export: %w", err)
+		}
+		if exportFolder != "" {
+			log.Printf("Restoring the DynamoDB export %s\n", core.StorageURL(bucket, exportFolder))
+			if err := proc.LoadExportManifest(ctx, bucket, exportFolder); err != nil {
+				return false, fmt.Errorf("Unable to load the export manifest: %w", err)
 			}
+			return true, nil
+		}
+		if !forceRestore {
+			log.Println("[ERROR] Please enable -force-restore flag if you wish to continue anyway")
+			return false, fmt.Errorf("Unable to find a _SUCCESS flag in the provided folder. Are you sure the actions was successful?")
 		}
+		log.Println("[WARNING] _SUCCESS flag is missing, data may not be accurate")
+		log.Println("[WARNING] -force-restore flag enabled, continue..")
 	}
 
 	// Pull the manifest from s3 and load it to memory
-	err = proc.LoadManifestFromS3(bucket, fmt.Sprintf("%s/manifest", prefix))
+	if err := proc.LoadManifestFromS3(bucket, fmt.Sprintf("%s/manifest", prefix)); err != nil {
+		return false, fmt.Errorf("Unable to load the manifest flag information: %w", err)
+	}
+	if proc.ManifestS3.Incomplete {
+		log.Println("[WARNING] The manifest belongs to an interrupted backup, data may not be accurate")
+	}
+	return exists && !proc.ManifestS3.Incomplete, nil
+}
+
+// replayChanges replays the changes of the given incremental backups, in
+// order, up to the given time
+func replayChanges(ctx context.Context, tableName string, batchSize int64, waitPeriod time.Duration, until time.Time, changes []core.S3Manifest, proc, dest *core.AwsHelper) error {
+	total := core.ReplayReport{}
+	for _, manifest := range changes {
+		proc.ManifestS3 = manifest
+		report, err := proc.ChangesToDynamo(ctx, tableName, until, batchSize, waitPeriod, dest)
+		total.Puts += report.Puts
+		total.Deletes += report.Deletes
+		total.Skipped += report.Skipped
+		if report.Last.After(total.Last) {
+			total.Last = report.Last
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to replay the changes, %d written and %d deleted: %w", total.Puts, total.Deletes, err)
+		}
+	}
+	log.Printf("%d changes of %d incremental backups replayed: %d items written, %d deleted and %d later changes skipped\n", total.Puts+total.Deletes, len(changes), total.Puts, total.Deletes, total.Skipped)
+	if total.Skipped == 0 {
+		last := "none"
+		if !total.Last.IsZero() {
+			last = total.Last.Format(time.RFC3339)
+		}
+		log.Printf("[WARNING] No change was recorded after %s, the last change replayed is from %s\n", until.Format(time.RFC3339), last)
+	}
+	return nil
+}
+
+// replaceTable empties the given table, deleting its items or recreating it.
+// Returns the definition of the recreated table, whose TTL and tags are
+// applied once the data is restored. The items are deleted within the
+// capacity limiters of dest
+func replaceTable(ctx context.Context, tableName string, batchSize int64, waitPeriod time.Duration, replace *TableReplacement, dest *core.AwsHelper) (*core.TableDefinition, error) {
+	if replace.Recreate {
+		def, err := dest.DescribeTableDefinition(tableName)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to describe the target table: %w", err)
+		}
+		if err := dest.DeleteTable(tableName); err != nil {
+			return nil, fmt.Errorf("Unable to delete the target table: %w", err)
+		}
+		if err := dest.CreateTableFromDefinition(def); err != nil {
+			return nil, fmt.Errorf("Unable to recreate the target table: %w", err)
+		}
+		return def, nil
+	}
+
+	def, err := dest.DescribeKeySchema(tableName)
 	if err != nil {
-		log.Fatalf("[ERROR] Unable to load the manifest flag information: %s\nAborting...\n", err)
+		return nil, fmt.Errorf("Unable to describe the target table: %w", err)
 	}
+	deleted, err := dest.TruncateTable(ctx, def, batchSize, waitPeriod)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to delete the items of the target table, %d deleted: %w", deleted, err)
+	}
+	log.Printf("%d items deleted from %s before the restore\n", deleted, tableName)
+	return nil, nil
+}
 
-	dest.ManifestS3 = proc.ManifestS3
-	// For each file in the manifest pull the file, decode each line and add them to a batch and push them into the table (batch size, then wait and continue)
-	err = proc.S3ToDynamo(tableName, batchSize, waitPeriod, dest)
+// tableDefinitionToCreate retrieves the definition of the table to create
+// depending on the given TableCreation and applies its overrides
+func tableDefinitionToCreate(tableName, bucket, prefix string, create *TableCreation, proc, dest *core.AwsHelper) (*core.TableDefinition, error) {
+	var def *core.TableDefinition
+	var err error
+	switch {
+	case create.DefinitionFile != "":
+		var data []byte
+		if data, err = ioutil.ReadFile(create.DefinitionFile); err == nil {
+			def, err = core.ParseTableDefinition(data)
+		}
+	case create.SourceTable != "":
+		def, err = dest.DescribeTableDefinition(create.SourceTable)
+	default:
+		def, err = proc.LoadTableDefinitionFromS3(bucket, fmt.Sprintf("%s/%s", prefix, core.TableDefinitionFileName))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve the definition of the table to create: %w", err)
+	}
+
+	if err := def.Override(tableName, create.BillingMode, create.ReadCapacityUnits, create.WriteCapacityUnits); err != nil {
+		return nil, fmt.Errorf("Invalid definition for the table to create: %w", err)
+	}
+	return def, nil
+}
+
+// targetKeySchema returns the definition of the target table, described
+// unless it was just created from def
+func targetKeySchema(tableName string, def *core.TableDefinition, dest *core.AwsHelper) (*core.TableDefinition, error) {
+	if def != nil {
+		return def, nil
+	}
+	def, err := dest.DescribeKeySchema(tableName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe the target table: %w", err)
+	}
+	return def, nil
+}
+
+// newDeadLetter creates the DeadLetter receiving the rejected items in the
+// given s3 folder, encrypted with the given key if any
+func newDeadLetter(bucket, prefix string, encryption EncryptionKey, retry *core.RetryPolicy, s3AccountID, s3Region string) (*core.DeadLetter, error) {
+	h, err := newAwsHelper(s3Region, s3AccountID, "")
 	if err != nil {
-		log.Fatalf("[ERROR] Unable to import the full s3 actions to Dynamo: %s\nAborting...\n", err)
+		return nil, err
+	}
+	h.Retry = retry
+	if h.Keys, err = encryption.keyProvider(h, false); err != nil {
+		return nil, err
+	}
+	return core.NewDeadLetter(h, bucket, prefix), nil
+}
+
+// closeDeadLetter writes the remaining rejected items, even once the restore
+// was interrupted
+func closeDeadLetter(d *core.DeadLetter) error {
+	if err := d.Close(context.Background()); err != nil {
+		return fmt.Errorf("Unable to write the dead letter: %w", err)
+	}
+	if count := d.Count(); count > 0 {
+		log.Printf("[WARNING] %d items rejected by the table were written to %s\n", count, core.StorageURL(d.Bucket, d.Folder))
 	}
+	return nil
 }
@@ -0,0 +1,245 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AltoStack/dynamodump/core"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// struct to mock the Dynamo calls on a non-empty table whose item count is not
+// refreshed yet, recording the calls modifying it
+type mockTargetDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	mu    sync.Mutex
+	calls []string
+	empty bool
+}
+
+func (m *mockTargetDynamoDBClient) record(call string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, call)
+}
+
+func (m *mockTargetDynamoDBClient) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		TableName:   input.TableName,
+		TableStatus: aws.String("ACTIVE"),
+		ItemCount:   aws.Int64(0),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("artist"), KeyType: aws.String("HASH")},
+		},
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("artist"), AttributeType: aws.String("S")},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(5), WriteCapacityUnits: aws.Int64(5)},
+	}}, nil
+}
+
+func (m *mockTargetDynamoDBClient) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	// Counting the items leaves the table untouched
+	if aws.StringValue(input.Select) == dynamodb.SelectCount {
+		if m.empty {
+			return &dynamodb.ScanOutput{Count: aws.Int64(0)}, nil
+		}
+		return &dynamodb.ScanOutput{Count: aws.Int64(1)}, nil
+	}
+	m.record("Scan")
+	return &dynamodb.ScanOutput{}, nil
+}
+
+func (m *mockTargetDynamoDBClient) DeleteTable(input *dynamodb.DeleteTableInput) (*dynamodb.DeleteTableOutput, error) {
+	m.record("DeleteTable")
+	return &dynamodb.DeleteTableOutput{}, nil
+}
+
+func (m *mockTargetDynamoDBClient) ScanPagesWithContext(ctx aws.Context, params *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	m.record("Scan")
+	return nil
+}
+
+func (m *mockTargetDynamoDBClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	m.record("BatchWriteItem")
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+// mockTargetTable replaces the helpers of the actions with ones using a mock
+// of a non-empty table, restored once the test is over
+func mockTargetTable(t *testing.T) *mockTargetDynamoDBClient {
+	mock := &mockTargetDynamoDBClient{}
+	previous := newAwsHelper
+	t.Cleanup(func() { newAwsHelper = previous })
+	newAwsHelper = func(region, accountID, accountRole string) (*core.AwsHelper, error) {
+		sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(region)}))
+		return &core.AwsHelper{AwsSession: sess, DynamoSvc: mock, DataPipe: make(chan map[string]*dynamodb.AttributeValue)}, nil
+	}
+	return mock
+}
+
+// writeBackup writes a backup of one item in a local folder, flagged as
+// complete or not, and returns its location
+func writeBackup(t *testing.T, complete bool) string {
+	bucket := "file://" + t.TempDir()
+	ctx := context.Background()
+	h := &core.AwsHelper{}
+	if err := h.DumpBuffer(ctx, bucket, "backup", bytes.NewBufferString("{\"artist\":{\"s\":\"Queen\"}}\n"), 1); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if complete {
+		end := time.Now().UTC()
+		h.ManifestS3.EndTime = &end
+	}
+	manifest, err := json.Marshal(h.ManifestS3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := h.UploadToS3(ctx, bucket, "backup/manifest", manifest); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if complete {
+		if err := h.UploadToS3(ctx, bucket, "backup/_SUCCESS", []byte{}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	return bucket
+}
+
+// restoreOptions returns the options of a restore of the backup written by
+// writeBackup into the mocked table
+func restoreOptions(bucket string) RestoreOptions {
+	return RestoreOptions{
+		TableName:    "myTable",
+		BatchSize:    25,
+		WaitPeriod:   time.Millisecond,
+		Bucket:       bucket,
+		Prefix:       "backup",
+		Conflicts:    core.ConflictPolicy{Mode: core.OnConflictOverwrite},
+		DynamoRegion: "eu-west-1",
+		S3Region:     "eu-west-1",
+		Retry:        core.NewRetryPolicy(),
+	}
+}
+
+func TestTableRestoreInvalidSetup(t *testing.T) {
+	mock := mockTargetTable(t)
+	bucket := writeBackup(t, true)
+
+	restoreTest := []struct {
+		name         string
+		keyTemplates map[string]string
+		encryption   EncryptionKey
+	}{
+		{name: "unknown key attribute", keyTemplates: map[string]string{"PK": "${artist}"}},
+		{name: "invalid template", keyTemplates: map[string]string{"artist": "${artist"}},
+		{name: "missing key file", encryption: EncryptionKey{KeyFile: filepath.Join(t.TempDir(), "missing.key")}},
+	}
+	for _, test := range restoreTest {
+		for _, recreate := range []bool{false, true} {
+			opts := restoreOptions(bucket)
+			opts.KeyTemplates = test.keyTemplates
+			opts.Encryption = test.encryption
+			opts.Replace = &TableReplacement{Recreate: recreate, Confirm: "myTable"}
+			err := TableRestore(context.Background(), opts)
+			if err == nil {
+				t.Fatalf("%s: expecting an error", test.name)
+			}
+			if len(mock.calls) != 0 {
+				t.Fatalf("%s: expecting the table to be left untouched, got %v", test.name, mock.calls)
+			}
+		}
+	}
+}
+
+func TestTableRestoreNotEmpty(t *testing.T) {
+	mock := mockTargetTable(t)
+	bucket := writeBackup(t, true)
+
+	// The items are looked for even though the item count of the table is 0
+	opts := restoreOptions(bucket)
+	if err := TableRestore(context.Background(), opts); err == nil {
+		t.Fatal("Expecting the restore into a non-empty table to be refused")
+	}
+	if len(mock.calls) != 0 {
+		t.Fatalf("Expecting the table to be left untouched, got %v", mock.calls)
+	}
+}
+
+func TestTableRestoreReplace(t *testing.T) {
+	mock := mockTargetTable(t)
+	bucket := writeBackup(t, true)
+
+	// The table is truncated even when no item was found, as some may have
+	// been written since
+	mock.empty = true
+	opts := restoreOptions(bucket)
+	opts.Replace = &TableReplacement{Confirm: "myTable"}
+	if err := TableRestore(context.Background(), opts); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(mock.calls) == 0 || mock.calls[0] != "Scan" {
+		t.Fatalf("Expecting the table to be truncated before the restore, got %v", mock.calls)
+	}
+}
+
+func TestTableRestoreUntil(t *testing.T) {
+	mock := mockTargetTable(t)
+	bucket := writeBackup(t, true)
+
+	opts := restoreOptions(bucket)
+	opts.AppendToTable = true
+	opts.PointInTime = &PointInTime{Until: time.Now().Add(-time.Hour)}
+	if err := TableRestore(context.Background(), opts); err == nil {
+		t.Fatal("Expecting a restore before the end of the backup to be refused")
+	}
+	if len(mock.calls) != 0 {
+		t.Fatalf("Expecting the table to be left untouched, got %v", mock.calls)
+	}
+
+	opts.PointInTime = &PointInTime{Until: time.Now()}
+	if err := TableRestore(context.Background(), opts); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestTableRestoreSyncIncomplete(t *testing.T) {
+	mock := mockTargetTable(t)
+	bucket := writeBackup(t, false)
+
+	// Even forced, the items missing from the backup are not deleted
+	opts := restoreOptions(bucket)
+	opts.ForceRestore = true
+	opts.Sync = &TableSync{}
+	err := TableRestore(context.Background(), opts)
+	if err == nil {
+		t.Fatal("Expecting the sync of an incomplete backup to be refused")
+	}
+	if len(mock.calls) != 0 {
+		t.Fatalf("Expecting the table to be left untouched, got %v", mock.calls)
+	}
+}
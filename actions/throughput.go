@@ -0,0 +1,50 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/AltoStack/dynamodump/core"
+)
+
+// maxThroughputRatio is the highest ratio of the capacity of a table that can
+// be targeted, as for the AWS DataPipeline
+const maxThroughputRatio = 1.5
+
+// checkThroughputRatio returns an error if the throughput ratio is out of
+// bounds
+func checkThroughputRatio(ratio float64) error {
+	if ratio < 0 || ratio > maxThroughputRatio {
+		return fmt.Errorf("The throughput ratio must be between 0 (disabled) and %.1f", maxThroughputRatio)
+	}
+	return nil
+}
+
+// capacityLimiters returns the read and write limiters targeting the given
+// ratio of the capacity of the table. Returns nil limiters if ratio is 0
+func capacityLimiters(h *core.AwsHelper, tableName string, ratio float64) (*core.CapacityLimiter, *core.CapacityLimiter, error) {
+	if ratio == 0 {
+		return nil, nil, nil
+	}
+	read, write, err := h.TableCapacity(tableName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to retrieve the capacity of the table %s: %w", tableName, err)
+	}
+	log.Printf("Targeting %.0f%% of the capacity of %s: %.1f reads and %.1f writes per second\n", ratio*100, tableName, read*ratio, write*ratio)
+	return core.NewCapacityLimiter(read * ratio), core.NewCapacityLimiter(write * ratio), nil
+}
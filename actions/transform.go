@@ -0,0 +1,35 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"fmt"
+
+	"github.com/AltoStack/dynamodump/core"
+)
+
+// loadTransform loads the transform rules of the given file. Returns nil if no
+// file is given
+func loadTransform(path string) (*core.Transform, error) {
+	if path == "" {
+		return nil, nil
+	}
+	t, err := core.LoadTransformFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load the transform file: %w", err)
+	}
+	return t, nil
+}
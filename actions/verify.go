@@ -0,0 +1,47 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// BackupVerify checks the backup in the given s3 folder without restoring it
+// and prints a json report on the standard output. Returns whether the backup
+// is valid, and an error if the check couldn't be run
+func BackupVerify(bucket, prefix string, encryption EncryptionKey, roleAssumed, s3AccountID, s3Region string) (bool, error) {
+	proc, err := newAwsHelper(s3Region, s3AccountID, roleAssumed)
+	if err != nil {
+		return false, err
+	}
+	if proc.Keys, err = encryption.keyProvider(proc, true); err != nil {
+		return false, err
+	}
+
+	report := proc.VerifyBackup(bucket, prefix)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return false, fmt.Errorf("while doing a marshal on the report: %s", err)
+	}
+	fmt.Println(string(data))
+
+	if !report.Valid {
+		log.Printf("[ERROR] %d problems found in the backup\n", len(report.Problems))
+	}
+	return report.Valid, nil
+}
@@ -16,9 +16,12 @@ limitations under the License.
 package cmd
 
 import (
+	"log"
+	"os"
 	"time"
 
 	"github.com/AltoStack/dynamodump/actions"
+	"github.com/AltoStack/dynamodump/core"
 
 	"github.com/spf13/cobra"
 )
@@ -28,27 +31,107 @@ func init() {
 
 	backupCmd.Flags().StringVarP(&dynamoTableName, "dynamo-table-name", "t", "", "Name of the Dynamo table to actions. Environment variable: DYN_DYNAMO_TABLE_NAME (required)")
 	backupCmd.Flags().Int64VarP(&dynamoBatchSize, "dynamo-table-batch-size", "s", 1000, "Max number of records to read from the Dynamo table at once. Environment variable: DYN_DYNAMO_TABLE_BATCH_SIZE")
+	backupCmd.Flags().Int64VarP(&dynamoSegments, "dynamo-table-segments", "n", 1, "Number of parallel workers scanning the Dynamo table, each one reading a segment of the table. Environment variable: DYN_DYNAMO_TABLE_SEGMENTS")
 	backupCmd.Flags().StringVarP(&dynamoTableAccountID, "dynamo-table-account-id", "x", "", "AccountID that will be used to access the dynamoDB")
 	backupCmd.Flags().StringVarP(&dynamoTableRegion, "dynamo-table-region", "o", "", "AWS region of the Dynamo table. Environment variable: DYN_DYNAMO_TABLE_REGION (required)")
 	backupCmd.Flags().Int64VarP(&waitTime, "dynamo-table-batch-wait-time", "w", 100, "Number of milliseconds to wait between batches. Environment variable: DYN_WAIT_TIME")
+	backupCmd.Flags().Float64Var(&throughputRatio, "throughput-ratio", 0, "Ratio of the capacity of the Dynamo table to consume, between 0 and 1.5, replacing the wait time between batches. "+
+		"On-demand tables use their maximum throughput, or the per-table limits of the account when it is unset. 0 disables it. Environment variable: DYN_THROUGHPUT_RATIO")
 	backupCmd.Flags().StringVarP(&roleAssumed, "assume-role", "g", "OrganizationAccountAccessRole", "Role that will be used to access the s3 Bucket")
 	backupCmd.Flags().StringVarP(&s3BucketAccountID, "s3-bucket-account-id", "e", "", "AccountID that will be used to access the s3 Bucket")
-	backupCmd.Flags().StringVarP(&s3BucketName, "s3-bucket-name", "b", "", "Name of the S3 bucket where to put the actions. Environment variable: DYN_S3_BUCKET_NAME (required)")
-	backupCmd.Flags().StringVarP(&s3BucketRegion, "s3-bucket-region", "d", "", "AWS region of the s3 Bucket. Environment variable: DYN_S3_BUCKET_REGION (required)")
-	backupCmd.Flags().StringVarP(&s3BucketFolderName, "s3-bucket-folder-name", "f", "", "Path inside the S3 bucket where to put actions. Environment variable: DYN_S3_BUCKET_FOLDER_NAME (required)")
+	backupCmd.Flags().StringVarP(&s3BucketName, "s3-bucket-name", "b", "", "Name of the S3 bucket where to put the actions, or a file:// URL of a local folder. Environment variable: DYN_S3_BUCKET_NAME (required unless --output -)")
+	backupCmd.Flags().StringVarP(&s3BucketRegion, "s3-bucket-region", "d", "", "AWS region of the s3 Bucket. Environment variable: DYN_S3_BUCKET_REGION (required for an S3 bucket unless --output -)")
+	backupCmd.Flags().StringVarP(&s3BucketFolderName, "s3-bucket-folder-name", "f", "", "Path inside the S3 bucket where to put actions. Environment variable: DYN_S3_BUCKET_FOLDER_NAME (required unless --output -)")
 	backupCmd.Flags().BoolVarP(&s3DateSuffix, "s3-bucket-folder-name-suffix", "p", false, "Adds an autogenerated suffix folder named using the UTC date in the format YYYY-mm-dd-HH24-MI-SS to the provided S3 folder. Environment variable: DYN_S3_BUCKET_NAME_SUFFIX")
+	backupCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", core.DefaultShutdownTimeout, "Time given to the backup to write the data scanned so far and an incomplete manifest once interrupted by SIGINT or SIGTERM. Environment variable: DYN_SHUTDOWN_TIMEOUT")
+
+	backupCmd.Flags().BoolVarP(&resumeBackup, "resume", "r", false, "Resumes an interrupted backup from the checkpoint left in the S3 folder. Can't be used along with the folder name suffix. Environment variable: DYN_RESUME")
+	backupCmd.Flags().BoolVar(&incrementalBackup, "incremental", false, "Writes the changes read from the stream of the table since the last incremental backup, instead of scanning it, to the incremental folder of the full backup in the S3 folder. "+
+		"With the folder name suffix, the full backup is the latest complete one of the dated subfolders of the S3 folder. Can't be used along with --resume, --transform-file or --format. Environment variable: DYN_INCREMENTAL")
+	backupCmd.Flags().StringVar(&outputPath, "output", "", "Writes the items to the standard output with -, one json document per line, instead of S3. Can't be used along with --incremental, --resume, --compression, --format or the encryption. Environment variable: DYN_OUTPUT")
+	backupCmd.Flags().DurationVar(&followInterval, "follow", 0, "Along with --incremental, keeps recording the changes of the table, writing an incremental backup every given period until interrupted by SIGINT or SIGTERM. 0 writes a single one. Environment variable: DYN_FOLLOW")
+
+	backupCmd.Flags().StringVarP(&compression, "compression", "c", core.CompressionNone, "Compression of the data files: none, gzip or zstd. Restores detect it automatically. Environment variable: DYN_COMPRESSION")
+	backupCmd.Flags().StringVar(&backupFormat, "format", core.FormatDataPipeline, "Format of the backup: data-pipeline, or aws-export for the layout of the native DynamoDB exports to S3 (gzipped DynamoDB JSON). "+
+		"aws-export can't be used along with --incremental, --resume, --compression or the encryption. Environment variable: DYN_FORMAT")
+	backupCmd.Flags().StringVar(&transformFile, "transform-file", "", "Path to a json file holding the rules renaming, deleting, setting, copying or converting attributes of each item before writing it. Environment variable: DYN_TRANSFORM_FILE")
+
+	backupCmd.Flags().StringVar(&encryptionKey.KeyFile, "encryption-key-file", "", "Path to a file holding a 256 bits key (raw, hex or base64) wrapping the keys encrypting each data file. Environment variable: DYN_ENCRYPTION_KEY_FILE")
+	backupCmd.Flags().StringVar(&encryptionKey.KMSKeyID, "kms-key-id", "", "ID of the KMS key wrapping the keys encrypting each data file. Environment variable: DYN_KMS_KEY_ID")
+	backupCmd.Flags().StringVar(&uploadOptions.StorageClass, "s3-storage-class", "STANDARD_IA", "Storage class of the uploaded files: STANDARD, STANDARD_IA, ONEZONE_IA, INTELLIGENT_TIERING, GLACIER, GLACIER_IR, DEEP_ARCHIVE or REDUCED_REDUNDANCY. "+
+		"Files in GLACIER or DEEP_ARCHIVE must be restored in s3 before a restore. Environment variable: DYN_S3_STORAGE_CLASS")
+	backupCmd.Flags().StringVar(&uploadOptions.SSEKMSKeyID, "s3-sse-kms-key-id", "", "ID of the KMS key used for the server side encryption of the uploaded files (SSE-KMS) instead of AES256. Environment variable: DYN_S3_SSE_KMS_KEY_ID")
+	backupCmd.Flags().StringToStringVar(&uploadOptions.Tags, "s3-tags", nil, "Tags of the uploaded files, as key=value pairs separated by commas. Environment variable: DYN_S3_TAGS")
+	backupCmd.Flags().StringVar(&uploadOptions.ObjectLockMode, "s3-object-lock-mode", "", "Object Lock retention mode of the uploaded files: GOVERNANCE or COMPLIANCE. Environment variable: DYN_S3_OBJECT_LOCK_MODE")
+	backupCmd.Flags().StringVar(&objectLockRetainUntil, "s3-object-lock-retain-until", "", "Date until which the uploaded files are locked, in the RFC3339 format (e.g. 2030-01-02T15:04:05Z). Environment variable: DYN_S3_OBJECT_LOCK_RETAIN_UNTIL")
+
+	addRetryFlags(backupCmd.Flags())
 
 	backupCmd.MarkFlagRequired("dynamo-table-name")
 	backupCmd.MarkFlagRequired("dynamo-table-region")
-	backupCmd.MarkFlagRequired("s3-bucket-name")
-	backupCmd.MarkFlagRequired("s3-bucket-region")
-	backupCmd.MarkFlagRequired("s3-bucket-folder-name")
 }
 
 var backupCmd = &cobra.Command{
 	Use:   "backup",
 	Short: "Backup a DynamoDB Table to S3",
 	Run: func(cmd *cobra.Command, args []string) {
-		actions.TableBackup(dynamoTableName, dynamoBatchSize, time.Duration(waitTime)*time.Millisecond, s3BucketName, s3BucketFolderName, s3DateSuffix, dynamoTableRegion, roleAssumed, s3BucketAccountID, s3BucketRegion)
+		if objectLockRetainUntil != "" {
+			retainUntil, err := time.Parse(time.RFC3339, objectLockRetainUntil)
+			if err != nil {
+				log.Fatalf("Error. Invalid object lock retain until date: %s", err)
+			}
+			uploadOptions.ObjectLockRetainUntil = retainUntil
+		}
+		retryPolicy.SetCodeAttempts(retryCodes)
+		ctx, stop := signalContext()
+		defer stop()
+		if outputPath != "" {
+			if outputPath != "-" {
+				log.Fatalf("Error. Unsupported output %s, only - is supported", outputPath)
+			}
+			if incrementalBackup || resumeBackup || compression != core.CompressionNone || backupFormat != core.FormatDataPipeline || encryptionKey.KeyFile != "" || encryptionKey.KMSKeyID != "" {
+				log.Fatalf("Error. --incremental, --resume, --compression, --format and the encryption can't be used along with --output")
+			}
+			if err := actions.TableBackupToWriter(ctx, dynamoTableName, dynamoBatchSize, dynamoSegments, time.Duration(waitTime)*time.Millisecond, throughputRatio, transformFile, os.Stdout, dynamoTableRegion, retryPolicy); err != nil {
+				exitWithError(err)
+			}
+			return
+		}
+		requireFlags(cmd, "s3-bucket-name", "s3-bucket-folder-name")
+		requireS3Region(cmd)
+		opts := actions.BackupOptions{
+			TableName:       dynamoTableName,
+			BatchSize:       dynamoBatchSize,
+			Segments:        dynamoSegments,
+			WaitPeriod:      time.Duration(waitTime) * time.Millisecond,
+			ThroughputRatio: throughputRatio,
+			Bucket:          s3BucketName,
+			Prefix:          s3BucketFolderName,
+			AddDate:         s3DateSuffix,
+			Resume:          resumeBackup,
+			Compression:     compression,
+			Format:          backupFormat,
+			TransformFile:   transformFile,
+			Encryption:      encryptionKey,
+			Upload:          uploadOptions,
+			DynamoRegion:    dynamoTableRegion,
+			RoleAssumed:     roleAssumed,
+			S3AccountID:     s3BucketAccountID,
+			S3Region:        s3BucketRegion,
+			Retry:           retryPolicy,
+			ShutdownTimeout: shutdownTimeout,
+		}
+		if incrementalBackup {
+			if resumeBackup || transformFile != "" || backupFormat != core.FormatDataPipeline {
+				log.Fatalf("Error. --resume, --transform-file and --format can't be used along with --incremental")
+			}
+			if err := actions.TableIncrementalBackup(ctx, opts, followInterval); err != nil {
+				exitWithError(err)
+			}
+			return
+		}
+		if err := actions.TableBackup(ctx, opts); err != nil {
+			exitWithError(err)
+		}
 	},
 }
@@ -0,0 +1,72 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/AltoStack/dynamodump/actions"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().StringVarP(&roleAssumed, "assume-role", "g", "OrganizationAccountAccessRole", "Role that will be used to access the s3 Bucket")
+	diffCmd.Flags().StringVarP(&s3BucketAccountID, "s3-bucket-account-id", "e", "", "AccountID that will be used to access the s3 Bucket")
+	diffCmd.Flags().StringVarP(&s3BucketName, "s3-bucket-name", "b", "", "Name of the S3 bucket where the backups are, or a file:// URL of a local folder. Environment variable: DYN_S3_BUCKET_NAME (required)")
+	diffCmd.Flags().StringVarP(&s3BucketFolderName, "s3-bucket-folder-name", "f", "", "Path inside the S3 bucket of the backup to compare from. Environment variable: DYN_S3_BUCKET_FOLDER_NAME (required)")
+	diffCmd.Flags().StringVarP(&s3BucketRegion, "s3-bucket-region", "d", "", "AWS region of the s3 Bucket. Environment variable: DYN_S3_BUCKET_REGION (required for an S3 bucket)")
+	diffCmd.Flags().StringVar(&diffToFolderName, "to-s3-bucket-folder-name", "", "Path inside the S3 bucket of the backup to compare to. Environment variable: DYN_TO_S3_BUCKET_FOLDER_NAME")
+	diffCmd.Flags().StringVarP(&dynamoTableName, "dynamo-table-name", "t", "", "Name of the Dynamo table to compare to, instead of a backup. Environment variable: DYN_DYNAMO_TABLE_NAME")
+	diffCmd.Flags().StringVarP(&dynamoTableRegion, "dynamo-table-region", "o", "", "AWS region of the Dynamo table. Environment variable: DYN_DYNAMO_TABLE_REGION")
+	diffCmd.Flags().Int64VarP(&dynamoBatchSize, "dynamo-table-batch-size", "s", 1000, "Max number of records to read from the Dynamo table at once. Environment variable: DYN_DYNAMO_TABLE_BATCH_SIZE")
+	diffCmd.Flags().Int64VarP(&waitTime, "dynamo-table-batch-wait-time", "w", 100, "Number of milliseconds to wait between batches. Environment variable: DYN_WAIT_TIME")
+	diffCmd.Flags().StringSliceVar(&diffKeyAttributes, "key-attributes", nil, "Attributes of the primary key identifying the items, separated by commas. Defaults to the key schema stored in the backup. Environment variable: DYN_KEY_ATTRIBUTES")
+	diffCmd.Flags().StringVar(&encryptionKey.KeyFile, "encryption-key-file", "", "Path to the key file used to encrypt the backups, if any. Environment variable: DYN_ENCRYPTION_KEY_FILE")
+
+	addRetryFlags(diffCmd.Flags())
+
+	diffCmd.MarkFlagRequired("s3-bucket-name")
+	diffCmd.MarkFlagRequired("s3-bucket-folder-name")
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Compare a backup in S3 to another backup or to a DynamoDB Table",
+	Long: `
+Compares the items of a backup to the items of another backup, or of a live
+table, matching them by primary key. A json report of the added, removed and
+modified items, along with their modified attributes, is printed on the
+standard output and the command exits with a non-zero code if any difference
+is found.
+  `,
+	Run: func(cmd *cobra.Command, args []string) {
+		requireS3Region(cmd)
+		retryPolicy.SetCodeAttempts(retryCodes)
+		ctx, stop := signalContext()
+		defer stop()
+		identical, err := actions.BackupDiff(ctx, s3BucketName, s3BucketFolderName, diffToFolderName, dynamoTableName, diffKeyAttributes, dynamoBatchSize, time.Duration(waitTime)*time.Millisecond, encryptionKey, dynamoTableRegion, roleAssumed, s3BucketAccountID, s3BucketRegion, retryPolicy)
+		if err != nil {
+			exitWithError(err)
+		}
+		if !identical {
+			os.Exit(exitError)
+		}
+	},
+}
@@ -16,9 +16,12 @@ limitations under the License.
 package cmd
 
 import (
+	"log"
+	"os"
 	"time"
 
 	"github.com/AltoStack/dynamodump/actions"
+	"github.com/AltoStack/dynamodump/core"
 
 	"github.com/spf13/cobra"
 )
@@ -31,26 +34,113 @@ func init() {
 	restoreCmd.Flags().StringVarP(&dynamoTableAccountID, "dynamo-table-account-id", "x", "", "AccountID that will be used to access the dynamoDB")
 	restoreCmd.Flags().StringVarP(&dynamoTableRegion, "dynamo-table-region", "o", "", "AWS region of the Dynamo table. Environment variable: DYN_DYNAMO_TABLE_REGION (required)")
 	restoreCmd.Flags().BoolVarP(&dynamoAppendRestore, "dynamo-append-restore", "z", false, "Appends the rows to a non-empty table when restoring instead of aborting. Environment variable: DYN_DYNAMO_RESTORE_APPEND")
+	restoreCmd.Flags().StringVar(&conflictPolicy.Mode, "on-conflict", core.OnConflictOverwrite, "How to restore the items already in the table: overwrite, skip or newer-wins. skip and newer-wins use conditional writes and allow to restore into a non-empty table. Environment variable: DYN_ON_CONFLICT")
+	restoreCmd.Flags().StringVar(&conflictPolicy.VersionAttribute, "version-attribute", "", "Number or timestamp attribute compared by --on-conflict newer-wins, the item with the highest one is kept. Environment variable: DYN_VERSION_ATTRIBUTE")
+	restoreCmd.Flags().IntVar(&conflictPolicy.Workers, "on-conflict-workers", core.DefaultConflictWorkers, "Number of items written in parallel by the conditional writes of --on-conflict skip and newer-wins. Environment variable: DYN_ON_CONFLICT_WORKERS")
 	restoreCmd.Flags().BoolVarP(&forceRestore, "force-restore", "p", false, "Force restore even if the _SUCCESS file is absent")
-	restoreCmd.Flags().Int64VarP(&waitTime, "dynamo-table-batch-wait-time", "w", 100, "Number of milliseconds to wait between batches. If a ProvisionedThroughputExceededException is encountered, "+
-		"the script will wait twice that amount of time before retrying. Environment variable: DYN_WAIT_TIME")
+	restoreCmd.Flags().Int64VarP(&waitTime, "dynamo-table-batch-wait-time", "w", 100, "Number of milliseconds to wait between batches. Throttled batches are retried following the --retry-* flags. Environment variable: DYN_WAIT_TIME")
+	restoreCmd.Flags().Float64Var(&throughputRatio, "throughput-ratio", 0, "Ratio of the capacity of the Dynamo table to consume, between 0 and 1.5, replacing the wait time between batches. "+
+		"On-demand tables use their maximum throughput, or the per-table limits of the account when it is unset. 0 disables it. Environment variable: DYN_THROUGHPUT_RATIO")
 	restoreCmd.Flags().StringVarP(&roleAssumed, "assume-role", "g", "OrganizationAccountAccessRole", "Role that will be used to access the s3 Bucket")
 	restoreCmd.Flags().StringVarP(&s3BucketAccountID, "s3-bucket-account-id", "e", "", "AccountID that will be used to access the s3 Bucket")
-	restoreCmd.Flags().StringVarP(&s3BucketName, "s3-bucket-name", "b", "", "Name of the S3 bucket where to put the actions. Environment variable: DYN_S3_BUCKET_NAME (required)")
-	restoreCmd.Flags().StringVarP(&s3BucketFolderName, "s3-bucket-folder-name", "f", "", "Path inside the S3 bucket where to put actions. Environment variable: DYN_S3_BUCKET_FOLDER_NAME (required)")
-	restoreCmd.Flags().StringVarP(&s3BucketRegion, "s3-bucket-region", "d", "", "AWS region of the s3 Bucket. Environment variable: DYN_S3_BUCKET_REGION (required)")
+	restoreCmd.Flags().StringVarP(&s3BucketName, "s3-bucket-name", "b", "", "Name of the S3 bucket where to put the actions, or a file:// URL of a local folder. Environment variable: DYN_S3_BUCKET_NAME (required unless --input -)")
+	restoreCmd.Flags().StringVarP(&s3BucketFolderName, "s3-bucket-folder-name", "f", "", "Path inside the S3 bucket where to put actions. Environment variable: DYN_S3_BUCKET_FOLDER_NAME (required unless --input -)")
+	restoreCmd.Flags().StringVarP(&s3BucketRegion, "s3-bucket-region", "d", "", "AWS region of the s3 Bucket. Environment variable: DYN_S3_BUCKET_REGION (required for an S3 bucket unless --input -)")
+
+	restoreCmd.Flags().BoolVar(&createTable, "create-table", false, "Creates the target table if it does not exist, from --table-definition, --source-table or the table definition stored in the backup. Environment variable: DYN_CREATE_TABLE")
+	restoreCmd.Flags().StringVar(&tableCreation.DefinitionFile, "table-definition", "", "Path to a local table definition file used to create the target table. Environment variable: DYN_TABLE_DEFINITION")
+	restoreCmd.Flags().StringVar(&tableCreation.SourceTable, "source-table", "", "Name of an existing table whose definition is copied to create the target table. Environment variable: DYN_SOURCE_TABLE")
+	restoreCmd.Flags().StringVar(&tableCreation.BillingMode, "billing-mode", "", "Billing mode of the created table, PROVISIONED or PAY_PER_REQUEST. Defaults to the one of the definition. Environment variable: DYN_BILLING_MODE")
+	restoreCmd.Flags().Int64Var(&tableCreation.ReadCapacityUnits, "read-capacity", 0, "Read capacity units of the created table when provisioned. Defaults to the one of the definition. Environment variable: DYN_READ_CAPACITY")
+	restoreCmd.Flags().Int64Var(&tableCreation.WriteCapacityUnits, "write-capacity", 0, "Write capacity units of the created table when provisioned. Defaults to the one of the definition. Environment variable: DYN_WRITE_CAPACITY")
+
+	restoreCmd.Flags().BoolVar(&replaceTable, "replace", false, "Deletes the items of a non-empty target table before restoring. Requires --confirm-replace. Environment variable: DYN_REPLACE")
+	restoreCmd.Flags().BoolVar(&tableReplacement.Recreate, "replace-recreate", false, "Along with --replace, deletes the target table and creates it again from its description instead of deleting its items. Environment variable: DYN_REPLACE_RECREATE")
+	restoreCmd.Flags().StringVar(&tableReplacement.Confirm, "confirm-replace", "", "Name of the target table, confirming it can be emptied by --replace. Environment variable: DYN_CONFIRM_REPLACE")
+
+	restoreCmd.Flags().BoolVar(&syncTable, "sync", false, "Makes the target table match the backup exactly, deleting the items missing from the backup once restored. Environment variable: DYN_SYNC")
+	restoreCmd.Flags().BoolVar(&syncDryRun, "sync-dry-run", false, "Along with --sync, prints the report of the items that would be written and deleted without changing the table. Environment variable: DYN_SYNC_DRY_RUN")
+
+	restoreCmd.Flags().StringVar(&inputPath, "input", "", "Reads the items from the standard input with -, one json document per line, instead of S3. The table must exist. "+
+		"Can't be used along with --create-table, --replace, --sync, --until, --dead-letter-prefix nor --on-conflict skip or newer-wins. Environment variable: DYN_INPUT")
+	restoreCmd.Flags().StringVar(&restoreUntil, "until", "", "Replays the changes recorded by the incremental backups of the backup once restored, up to the given date in the RFC3339 format (e.g. 2030-01-02T15:04:05Z). Environment variable: DYN_UNTIL")
+
+	restoreCmd.Flags().StringVar(&encryptionKey.KeyFile, "encryption-key-file", "", "Path to a file holding a 256 bits key (raw, hex or base64) wrapping the keys encrypting each data file. Environment variable: DYN_ENCRYPTION_KEY_FILE")
+	restoreCmd.Flags().StringVar(&encryptionKey.KMSKeyID, "kms-key-id", "", "ID of the KMS key wrapping the keys encrypting each data file. Environment variable: DYN_KMS_KEY_ID")
+	restoreCmd.Flags().StringVar(&deadLetterPrefix, "dead-letter-prefix", "", "Path inside the S3 bucket where to write the items rejected by the table, in the backup format, instead of failing the restore. Environment variable: DYN_DEAD_LETTER_PREFIX")
+	restoreCmd.Flags().StringVar(&transformFile, "transform-file", "", "Path to a json file holding the rules renaming, deleting, setting, copying or converting attributes of each item before writing it. Environment variable: DYN_TRANSFORM_FILE")
+	restoreCmd.Flags().StringToStringVar(&keyTemplates, "key-template", nil, "Templates computing the key attributes of the target table from the attributes of each item, as attribute=template pairs separated by commas (e.g. PK=USER#${userId},SK=PROFILE). Environment variable: DYN_KEY_TEMPLATE")
+
+	addRetryFlags(restoreCmd.Flags())
 
 	restoreCmd.MarkFlagRequired("dynamo-table-name")
 	restoreCmd.MarkFlagRequired("dynamo-table-region")
-	restoreCmd.MarkFlagRequired("s3-bucket-name")
-	restoreCmd.MarkFlagRequired("s3-bucket-region")
-	restoreCmd.MarkFlagRequired("s3-bucket-folder-name")
 }
 
 var restoreCmd = &cobra.Command{
 	Use:   "restore",
 	Short: "Restore a DynamoDB Table from S3",
 	Run: func(cmd *cobra.Command, args []string) {
-		actions.TableRestore(dynamoTableName, dynamoBatchSize, time.Duration(waitTime)*time.Millisecond, s3BucketName, s3BucketFolderName, dynamoAppendRestore, forceRestore, dynamoTableAccountID, dynamoTableRegion, roleAssumed, s3BucketAccountID, s3BucketRegion)
+		if inputPath != "" {
+			if inputPath != "-" {
+				log.Fatalf("Error. Unsupported input %s, only - is supported", inputPath)
+			}
+			if createTable || replaceTable || syncTable || restoreUntil != "" || deadLetterPrefix != "" || conflictPolicy.Conditional() {
+				log.Fatalf("Error. --create-table, --replace, --sync, --until, --dead-letter-prefix and --on-conflict skip or newer-wins can't be used along with --input")
+			}
+			retryPolicy.SetCodeAttempts(retryCodes)
+			ctx, stop := signalContext()
+			defer stop()
+			err := actions.TableRestoreFromReader(ctx, dynamoTableName, dynamoBatchSize, time.Duration(waitTime)*time.Millisecond, throughputRatio, transformFile, keyTemplates, dynamoAppendRestore, os.Stdin, dynamoTableAccountID, dynamoTableRegion, roleAssumed, retryPolicy)
+			if err != nil {
+				exitWithError(err)
+			}
+			return
+		}
+		requireFlags(cmd, "s3-bucket-name", "s3-bucket-folder-name")
+		requireS3Region(cmd)
+		opts := actions.RestoreOptions{
+			TableName:        dynamoTableName,
+			BatchSize:        dynamoBatchSize,
+			WaitPeriod:       time.Duration(waitTime) * time.Millisecond,
+			ThroughputRatio:  throughputRatio,
+			Bucket:           s3BucketName,
+			Prefix:           s3BucketFolderName,
+			DeadLetterPrefix: deadLetterPrefix,
+			TransformFile:    transformFile,
+			KeyTemplates:     keyTemplates,
+			Conflicts:        conflictPolicy,
+			AppendToTable:    dynamoAppendRestore,
+			ForceRestore:     forceRestore,
+			Encryption:       encryptionKey,
+			DynamoAccountID:  dynamoTableAccountID,
+			DynamoRegion:     dynamoTableRegion,
+			RoleAssumed:      roleAssumed,
+			S3AccountID:      s3BucketAccountID,
+			S3Region:         s3BucketRegion,
+			Retry:            retryPolicy,
+		}
+		if createTable {
+			opts.Create = &tableCreation
+		}
+		if replaceTable {
+			opts.Replace = &tableReplacement
+		}
+		if syncTable {
+			opts.Sync = &actions.TableSync{DryRun: syncDryRun}
+		}
+		if restoreUntil != "" {
+			until, err := time.Parse(time.RFC3339, restoreUntil)
+			if err != nil {
+				log.Fatalf("Error. Invalid until date: %s", err)
+			}
+			opts.PointInTime = &actions.PointInTime{Until: until}
+		}
+		retryPolicy.SetCodeAttempts(retryCodes)
+		ctx, stop := signalContext()
+		defer stop()
+		if err := actions.TableRestore(ctx, opts); err != nil {
+			exitWithError(err)
+		}
 	},
 }
@@ -16,7 +16,18 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/AltoStack/dynamodump/actions"
+	"github.com/AltoStack/dynamodump/core"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -24,19 +35,58 @@ import (
 )
 
 var (
-	dynamoTableAccountID string
-	dynamoTableName      string
-	dynamoBatchSize      int64
-	dynamoAppendRestore  bool
-	dynamoTableRegion    string
-	forceRestore         bool
-	roleAssumed          string
-	s3BucketAccountID    string
-	s3BucketName         string
-	s3BucketFolderName   string
-	s3BucketRegion       string
-	s3DateSuffix         bool
-	waitTime             int64
+	backupFormat          string
+	compression           string
+	conflictPolicy        core.ConflictPolicy
+	createTable           bool
+	dynamoTableAccountID  string
+	dynamoTableName       string
+	dynamoBatchSize       int64
+	dynamoSegments        int64
+	dynamoAppendRestore   bool
+	dynamoTableRegion     string
+	deadLetterPrefix      string
+	diffKeyAttributes     []string
+	diffToFolderName      string
+	encryptionKey         actions.EncryptionKey
+	followInterval        time.Duration
+	forceRestore          bool
+	incrementalBackup     bool
+	inputPath             string
+	keyTemplates          map[string]string
+	objectLockRetainUntil string
+	outputPath            string
+	replaceTable          bool
+	restoreUntil          string
+	resumeBackup          bool
+	retryCodes            map[string]int64
+	retryPolicy           = core.NewRetryPolicy()
+	roleAssumed           string
+	s3BucketAccountID     string
+	s3BucketName          string
+	s3BucketFolderName    string
+	s3BucketRegion        string
+	s3DateSuffix          bool
+	shutdownTimeout       time.Duration
+	syncDryRun            bool
+	syncTable             bool
+	tableCreation         actions.TableCreation
+	tableReplacement      actions.TableReplacement
+	throughputRatio       float64
+	transformFile         string
+	uploadOptions         core.S3UploadOptions
+	waitTime              int64
+)
+
+// Exit codes of the commands, depending on the error that stopped them
+const (
+	exitError     = 1
+	exitNotFound  = 2
+	exitThrottled = 3
+	exitUpload    = 4
+	// exitInterrupted is the code used by shells for a command stopped by
+	// SIGINT
+	exitInterrupted = 130
 )
 
 var rootCmd = &cobra.Command{
@@ -88,3 +138,76 @@ func presetRequiredFlags(cmd *cobra.Command) {
 		}
 	})
 }
+
+// addRetryFlags adds the flags of the retry policy of the AWS calls
+func addRetryFlags(flags *pflag.FlagSet) {
+	flags.IntVar(&retryPolicy.MaxAttempts, "retry-max-attempts", core.DefaultRetryMaxAttempts, "Max number of attempts of a throttled or failing AWS call. Environment variable: DYN_RETRY_MAX_ATTEMPTS")
+	flags.DurationVar(&retryPolicy.BaseDelay, "retry-base-delay", core.DefaultRetryBaseDelay, "Delay before the first retry, doubled on each attempt with a random jitter. Environment variable: DYN_RETRY_BASE_DELAY")
+	flags.DurationVar(&retryPolicy.MaxDelay, "retry-max-delay", core.DefaultRetryMaxDelay, "Max delay between two attempts. Environment variable: DYN_RETRY_MAX_DELAY")
+	flags.DurationVar(&retryPolicy.MaxElapsed, "retry-max-elapsed", core.DefaultRetryMaxElapsed, "Max time spent retrying a call. Environment variable: DYN_RETRY_MAX_ELAPSED")
+	flags.StringToInt64Var(&retryCodes, "retry-codes", nil, "Max attempts per error code, as code=attempts pairs separated by commas (e.g. ThrottlingException=20). "+
+		"0 uses --retry-max-attempts and a negative value disables the retries of the code. Environment variable: DYN_RETRY_CODES")
+}
+
+// requireFlags stops the command if one of the given flags is not set, for the
+// flags only required when the command reads or writes S3
+func requireFlags(cmd *cobra.Command, names ...string) {
+	missing := []string{}
+	for _, name := range names {
+		if !cmd.Flags().Changed(name) {
+			missing = append(missing, fmt.Sprintf("%q", name))
+		}
+	}
+	if len(missing) > 0 {
+		log.Fatalf("Error. Required flag(s) %s not set", strings.Join(missing, ", "))
+	}
+}
+
+// requireS3Region stops the command if the region of the s3 bucket is not set,
+// unless the backups are in a local folder
+func requireS3Region(cmd *cobra.Command) {
+	if !core.IsLocalStorage(s3BucketName) {
+		requireFlags(cmd, "s3-bucket-region")
+	}
+}
+
+// exitWithError logs the given error and exits with the code matching it
+func exitWithError(err error) {
+	log.Printf("[ERROR] %s\nAborting...\n", err)
+	os.Exit(exitCode(err))
+}
+
+// exitCode returns the exit code matching the given error
+func exitCode(err error) int {
+	var throttling *core.ThrottlingError
+	var upload *core.UploadError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, core.ErrTableNotFound), errors.Is(err, core.ErrManifestNotFound):
+		return exitNotFound
+	case errors.As(err, &throttling):
+		return exitThrottled
+	case errors.As(err, &upload):
+		return exitUpload
+	}
+	return exitError
+}
+
+// signalContext returns a context canceled on SIGINT or SIGTERM. A second
+// signal stops the process right away
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("[WARNING] %s received, shutting down...\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/AltoStack/dynamodump/actions"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVarP(&roleAssumed, "assume-role", "g", "OrganizationAccountAccessRole", "Role that will be used to access the s3 Bucket")
+	verifyCmd.Flags().StringVarP(&s3BucketAccountID, "s3-bucket-account-id", "e", "", "AccountID that will be used to access the s3 Bucket")
+	verifyCmd.Flags().StringVarP(&s3BucketName, "s3-bucket-name", "b", "", "Name of the S3 bucket where the backup is, or a file:// URL of a local folder. Environment variable: DYN_S3_BUCKET_NAME (required)")
+	verifyCmd.Flags().StringVarP(&s3BucketFolderName, "s3-bucket-folder-name", "f", "", "Path inside the S3 bucket where the backup is. Environment variable: DYN_S3_BUCKET_FOLDER_NAME (required)")
+	verifyCmd.Flags().StringVarP(&s3BucketRegion, "s3-bucket-region", "d", "", "AWS region of the s3 Bucket. Environment variable: DYN_S3_BUCKET_REGION (required for an S3 bucket)")
+	verifyCmd.Flags().StringVar(&encryptionKey.KeyFile, "encryption-key-file", "", "Path to the key file used to encrypt the backup, if any. Environment variable: DYN_ENCRYPTION_KEY_FILE")
+
+	verifyCmd.MarkFlagRequired("s3-bucket-name")
+	verifyCmd.MarkFlagRequired("s3-bucket-folder-name")
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify a backup in S3 without restoring it",
+	Long: `
+Checks the _SUCCESS flag and the manifest of a backup, then downloads each of its
+files to check its checksum and that each line is a valid item. A json report is
+printed on the standard output and the command exits with a non-zero code if any
+problem is found.
+  `,
+	Run: func(cmd *cobra.Command, args []string) {
+		requireS3Region(cmd)
+		valid, err := actions.BackupVerify(s3BucketName, s3BucketFolderName, encryptionKey, roleAssumed, s3BucketAccountID, s3BucketRegion)
+		if err != nil {
+			exitWithError(err)
+		}
+		if !valid {
+			os.Exit(exitError)
+		}
+	},
+}
@@ -0,0 +1,337 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	// FormatDataPipeline is the format of the backups written by ChannelToS3,
+	// compatible with the AWS DataPipeline
+	FormatDataPipeline = "data-pipeline"
+	// FormatAWSExport is the DynamoDB JSON format of the native "Export to
+	// S3" of DynamoDB, written by ChannelToExport
+	FormatAWSExport = "aws-export"
+
+	// ExportFolderName is the folder of the exports under their prefix
+	ExportFolderName = "AWSDynamoDB"
+	// ExportSummaryFileName is the name of the summary of an export
+	ExportSummaryFileName = "manifest-summary.json"
+	// ExportFilesFileName is the name of the list of the data files of an
+	// export
+	ExportFilesFileName = "manifest-files.json"
+	// exportOutputFormat is the only output format of the exports supported
+	exportOutputFormat = "DYNAMODB_JSON"
+)
+
+// ExportSummary is the manifest-summary.json file of a native DynamoDB export
+type ExportSummary struct {
+	Version            string    `json:"version"`
+	ExportArn          string    `json:"exportArn,omitempty"`
+	StartTime          time.Time `json:"startTime"`
+	EndTime            time.Time `json:"endTime"`
+	TableArn           string    `json:"tableArn,omitempty"`
+	TableID            string    `json:"tableId,omitempty"`
+	ExportTime         time.Time `json:"exportTime"`
+	S3Bucket           string    `json:"s3Bucket"`
+	S3Prefix           string    `json:"s3Prefix"`
+	S3SseAlgorithm     string    `json:"s3SseAlgorithm,omitempty"`
+	S3SseKmsKeyID      string    `json:"s3SseKmsKeyId,omitempty"`
+	ManifestFilesS3Key string    `json:"manifestFilesS3Key"`
+	BilledSizeBytes    int64     `json:"billedSizeBytes"`
+	ItemCount          int64     `json:"itemCount"`
+	OutputFormat       string    `json:"outputFormat"`
+}
+
+// ExportFile is a line of the manifest-files.json file of a native DynamoDB
+// export, describing one of its data files
+type ExportFile struct {
+	ItemCount     int64  `json:"itemCount"`
+	MD5Checksum   string `json:"md5Checksum"`
+	ETag          string `json:"etag"`
+	DataFileS3Key string `json:"dataFileS3Key"`
+}
+
+// exportLine is a line of the data files of a native DynamoDB export
+type exportLine struct {
+	Item map[string]*dynamodb.AttributeValue `json:"Item"`
+}
+
+// genExportID returns an ID named like the ones of the native exports, which
+// sort by date
+func genExportID(t time.Time) string {
+	return fmt.Sprintf("%013d-%s", t.UnixNano()/int64(time.Millisecond), hex.EncodeToString(ksuid.New().Payload()[:4]))
+}
+
+// exportAttributeValue returns the DynamoDB JSON representation of the given
+// value
+func exportAttributeValue(v *dynamodb.AttributeValue) map[string]interface{} {
+	switch {
+	case v.S != nil:
+		return map[string]interface{}{"S": *v.S}
+	case v.N != nil:
+		return map[string]interface{}{"N": *v.N}
+	case v.B != nil:
+		return map[string]interface{}{"B": v.B}
+	case v.BOOL != nil:
+		return map[string]interface{}{"BOOL": *v.BOOL}
+	case v.NULL != nil:
+		return map[string]interface{}{"NULL": *v.NULL}
+	case v.SS != nil:
+		return map[string]interface{}{"SS": v.SS}
+	case v.NS != nil:
+		return map[string]interface{}{"NS": v.NS}
+	case v.BS != nil:
+		return map[string]interface{}{"BS": v.BS}
+	case v.L != nil:
+		list := make([]interface{}, len(v.L))
+		for i, child := range v.L {
+			list[i] = exportAttributeValue(child)
+		}
+		return map[string]interface{}{"L": list}
+	case v.M != nil:
+		return map[string]interface{}{"M": exportAttributeMap(v.M)}
+	}
+	return map[string]interface{}{}
+}
+
+// exportAttributeMap returns the DynamoDB JSON representation of the given
+// item
+func exportAttributeMap(attrs map[string]*dynamodb.AttributeValue) map[string]interface{} {
+	item := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		item[k] = exportAttributeValue(v)
+	}
+	return item
+}
+
+// decodeLine decodes an item of a file of the given format
+func decodeLine(data []byte, format string) (map[string]*dynamodb.AttributeValue, error) {
+	if format == FormatAWSExport {
+		line := exportLine{}
+		if err := json.Unmarshal(data, &line); err != nil {
+			return nil, err
+		}
+		if line.Item == nil {
+			return nil, fmt.Errorf("no Item attribute")
+		}
+		return line.Item, nil
+	}
+	res := map[string]*dynamodb.AttributeValue{}
+	return res, json.Unmarshal(data, &res)
+}
+
+// FindExport returns the folder of the native DynamoDB export in the given
+// folder: the folder itself if it holds a manifest-summary.json file, or else
+// the most recent export of its AWSDynamoDB subfolder. Returns an empty string
+// if there is none
+func (h *AwsHelper) FindExport(ctx context.Context, bucketName, s3Folder string) (string, error) {
+	storage, err := h.Storage(bucketName)
+	if err != nil {
+		return "", err
+	}
+	if exists, err := storage.Head(ctx, fmt.Sprintf("%s/%s", s3Folder, ExportSummaryFileName)); err != nil || exists {
+		return s3Folder, err
+	}
+	keys, err := storage.List(ctx, fmt.Sprintf("%s/%s", s3Folder, ExportFolderName))
+	if err != nil {
+		return "", err
+	}
+	// The exports in progress have no summary yet
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") {
+			continue
+		}
+		folder := strings.TrimSuffix(key, "/")
+		exists, err := storage.Head(ctx, fmt.Sprintf("%s/%s", folder, ExportSummaryFileName))
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return folder, nil
+		}
+	}
+	return "", nil
+}
+
+// LoadExportManifest loads the data files of the native DynamoDB export in the
+// given folder in the ManifestS3 attribute of the struct. The files are looked
+// for in that folder, so the export can be moved
+func (h *AwsHelper) LoadExportManifest(ctx context.Context, bucketName, exportFolder string) error {
+	summary := ExportSummary{}
+	if err := h.loadJSON(ctx, bucketName, fmt.Sprintf("%s/%s", exportFolder, ExportSummaryFileName), &summary); err != nil {
+		return manifestError(bucketName, fmt.Sprintf("%s/%s", exportFolder, ExportSummaryFileName), err)
+	}
+	if summary.OutputFormat != exportOutputFormat {
+		return fmt.Errorf("Unsupported output format %s of the export, must be %s", summary.OutputFormat, exportOutputFormat)
+	}
+
+	filesPath := fmt.Sprintf("%s/%s", exportFolder, ExportFilesFileName)
+	doc, err := h.GetFromS3(ctx, bucketName, filesPath)
+	if err != nil {
+		return manifestError(bucketName, filesPath, err)
+	}
+	defer (*doc).Close()
+	h.ManifestS3 = S3Manifest{Name: "DynamoDB-export", Version: 3, Entries: []S3ManifestEntry{}, EndTime: &summary.ExportTime}
+	scanner := newLineScanner(*doc)
+	for scanner.Scan() {
+		file := ExportFile{}
+		if err := json.Unmarshal(scanner.Bytes(), &file); err != nil {
+			return fmt.Errorf("Unable to decode %s: %s", StorageURL(bucketName, filesPath), err)
+		}
+		key := fmt.Sprintf("%s/data/%s", exportFolder, path.Base(file.DataFileS3Key))
+		entry := S3ManifestEntry{URL: StorageURL(bucketName, key), Mandatory: true, Format: FormatAWSExport, ItemCount: aws.Int64(file.ItemCount), MD5: file.MD5Checksum}
+		if strings.HasSuffix(key, ".gz") {
+			entry.Compression = CompressionGzip
+		}
+		h.ManifestS3.Entries = append(h.ManifestS3.Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	h.ManifestS3.computeTotals()
+	if h.ManifestS3.Totals.Items != summary.ItemCount {
+		return fmt.Errorf("The data files of the export hold %d items instead of %d", h.ManifestS3.Totals.Items, summary.ItemCount)
+	}
+	return nil
+}
+
+// loadJSON downloads and decodes the given json file
+func (h *AwsHelper) loadJSON(ctx context.Context, bucketName, filePath string, v interface{}) error {
+	doc, err := h.GetFromS3(ctx, bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	defer (*doc).Close()
+	data, err := ioutil.ReadAll(*doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ChannelToExport reads from the given channel and writes its items to a new
+// export of the given folder, in the layout of the native "Export to S3" of
+// DynamoDB: gzipped data files of about s3BufferSize, listed by the
+// manifest-files.json file and summed up by the manifest-summary.json file.
+// On failure, the rest of the channel is drained so its producer doesn't
+// block. If the scan failed or the context is done, the summary is not
+// written. Once the context is done, the uploads are given the
+// ShutdownTimeout of the struct to complete
+func (h *AwsHelper) ChannelToExport(ctx context.Context, bucketName, s3Folder string, s3BufferSize int, destination *AwsHelper) error {
+	defer h.Wg.Done()
+	uploadCtx, cancel := shutdownContext(ctx, h.shutdownTimeout())
+	defer cancel()
+
+	summary := ExportSummary{Version: "2020-06-30", StartTime: time.Now().UTC(), S3Bucket: bucketName, S3Prefix: s3Folder, OutputFormat: exportOutputFormat}
+	summary.ExportTime = summary.StartTime
+	exportFolder := fmt.Sprintf("%s/%s/%s", s3Folder, ExportFolderName, genExportID(summary.StartTime))
+	files := []ExportFile{}
+
+	var buff bytes.Buffer
+	var itemCount int64
+	for elem := range h.DataPipe {
+		data, err := json.Marshal(map[string]interface{}{"Item": exportAttributeMap(elem)})
+		if err != nil {
+			h.drain()
+			return fmt.Errorf("while converting to json: %v\nError: %s", elem, err)
+		}
+		buff.Write(data)
+		buff.WriteString("\n")
+		itemCount++
+		if buff.Len() >= s3BufferSize {
+			file, err := destination.dumpExportFile(uploadCtx, bucketName, exportFolder, &buff, itemCount)
+			if err != nil {
+				h.drain()
+				return err
+			}
+			files = append(files, file)
+			itemCount = 0
+		}
+	}
+	if buff.Len() > 0 {
+		file, err := destination.dumpExportFile(uploadCtx, bucketName, exportFolder, &buff, itemCount)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	if h.scanErr != nil {
+		log.Printf("[WARNING] The export is incomplete, %d files were written without summary\n", len(files))
+		return fmt.Errorf("the export is incomplete: %w", h.scanErr)
+	}
+
+	var list bytes.Buffer
+	for _, file := range files {
+		data, err := json.Marshal(file)
+		if err != nil {
+			return fmt.Errorf("while doing a marshal on the export files: %s", err)
+		}
+		list.Write(data)
+		list.WriteString("\n")
+		summary.ItemCount += file.ItemCount
+	}
+	summary.ManifestFilesS3Key = fmt.Sprintf("%s/%s", exportFolder, ExportFilesFileName)
+	if err := destination.uploadControlToS3(uploadCtx, bucketName, summary.ManifestFilesS3Key, list.Bytes()); err != nil {
+		return err
+	}
+	summary.EndTime = time.Now().UTC()
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("while doing a marshal on the export summary: %s", err)
+	}
+	return destination.uploadControlToS3(uploadCtx, bucketName, fmt.Sprintf("%s/%s", exportFolder, ExportSummaryFileName), data)
+}
+
+// dumpExportFile gzips the content of the given buffer to a new data file of
+// the given export, and resets the said buffer. Returns the line of the file
+// in the manifest-files.json file
+func (h *AwsHelper) dumpExportFile(ctx context.Context, bucketName, exportFolder string, buff *bytes.Buffer, itemCount int64) (ExportFile, error) {
+	data, err := compress(CompressionGzip, buff.Bytes())
+	if err != nil {
+		return ExportFile{}, fmt.Errorf("while compressing the data with %s: %s", CompressionGzip, err)
+	}
+	sum := md5.Sum(data)
+	file := ExportFile{
+		ItemCount:     itemCount,
+		MD5Checksum:   base64.StdEncoding.EncodeToString(sum[:]),
+		ETag:          hex.EncodeToString(sum[:]),
+		DataFileS3Key: fmt.Sprintf("%s/data/%s.json.gz", exportFolder, genNewFileName()),
+	}
+	if err := h.UploadToS3(ctx, bucketName, file.DataFileS3Key, data); err != nil {
+		return ExportFile{}, err
+	}
+	buff.Reset()
+	return file, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestDecodeExportLine(t *testing.T) {
+	// Line of a data file written by DynamoDB
+	line := []byte(`{"Item":{"artist":{"S":"Queen"},"year":{"N":"1970"},"albums":{"L":[{"M":{"title":{"S":"Jazz"}}}]},"tags":{"SS":["rock"]},"cover":{"B":"AQI="},"live":{"BOOL":true}}}`)
+	item, err := decodeLine(line, FormatAWSExport)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *item["artist"].S != "Queen" || *item["year"].N != "1970" || *item["albums"].L[0].M["title"].S != "Jazz" ||
+		*item["tags"].SS[0] != "rock" || string(item["cover"].B) != "\x01\x02" || !*item["live"].BOOL {
+		t.Fatalf("Unexpected item %v", item)
+	}
+	if _, err := decodeLine([]byte(`{"artist":{"S":"Queen"}}`), FormatAWSExport); err == nil {
+		t.Fatal("Expecting an error for a line without Item")
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynamodump")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	location := "file://" + dir
+	ctx := context.Background()
+
+	items := []map[string]*dynamodb.AttributeValue{
+		{"artist": {S: aws.String("Queen")}, "albums": {L: []*dynamodb.AttributeValue{}}},
+		{"artist": {S: aws.String("Muse")}, "members": {M: map[string]*dynamodb.AttributeValue{"singer": {S: aws.String("Matt")}}}},
+		{"artist": {S: aws.String("Blur")}, "cover": {B: []byte{1, 2}}},
+	}
+	h := &AwsHelper{DataPipe: make(chan map[string]*dynamodb.AttributeValue)}
+	h.Wg.Add(1)
+	go func() {
+		for _, item := range items {
+			h.DataPipe <- item
+		}
+		close(h.DataPipe)
+	}()
+	// A tiny buffer writes a data file per item
+	if err := h.ChannelToExport(ctx, location, "exports", 1, &AwsHelper{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	reader := &AwsHelper{}
+	folder, err := reader.FindExport(ctx, location, "exports")
+	if err != nil || folder == "" {
+		t.Fatalf("Expecting to find the export, got %q (%v)", folder, err)
+	}
+	if err := reader.LoadExportManifest(ctx, location, folder); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(reader.ManifestS3.Entries) != 3 || reader.ManifestS3.Totals.Items != 3 {
+		t.Fatalf("Expecting 3 data files of one item, got %+v", reader.ManifestS3)
+	}
+
+	read := []map[string]*dynamodb.AttributeValue{}
+	for _, entry := range reader.ManifestS3.Entries {
+		location, key, ok := splitStorageURL(entry.URL)
+		if !ok || entry.Compression != CompressionGzip || entry.Format != FormatAWSExport {
+			t.Fatalf("Unexpected entry %+v", entry)
+		}
+		data, err := reader.entryReader(ctx, location, key, entry)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		reader.DataPipe = make(chan map[string]*dynamodb.AttributeValue, 1)
+		if err := reader.readerToChannel(ctx, &data, entry.Format); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		read = append(read, <-reader.DataPipe)
+	}
+	artists := map[string]map[string]*dynamodb.AttributeValue{}
+	for _, item := range read {
+		artists[*item["artist"].S] = item
+	}
+	if albums := artists["Queen"]["albums"]; albums == nil || albums.L == nil || len(albums.L) != 0 {
+		t.Fatalf("Expecting an empty list, got %v", albums)
+	}
+	if *artists["Muse"]["members"].M["singer"].S != "Matt" || string(artists["Blur"]["cover"].B) != "\x01\x02" {
+		t.Fatalf("Unexpected items %v", read)
+	}
+
+	// The data files are checked against the MD5 checksum of the export
+	entry := reader.ManifestS3.Entries[0]
+	fileLocation, fileKey, _ := splitStorageURL(entry.URL)
+	if entry.MD5 == "" {
+		t.Fatalf("Expecting the MD5 checksum of the file, got %+v", entry)
+	}
+	if err := ioutil.WriteFile(fileKey, []byte("altered"), 0600); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := reader.entryReader(ctx, fileLocation, fileKey, entry); err == nil {
+		t.Fatal("Expecting an altered data file to be rejected")
+	}
+
+	// The export can also be given directly
+	if found, err := reader.FindExport(ctx, location, folder); err != nil || found != folder {
+		t.Fatalf("Expecting the export folder %s, got %q (%v)", folder, found, err)
+	}
+	if found, err := reader.FindExport(ctx, location, "missing"); err != nil || found != "" {
+		t.Fatalf("Expecting no export, got %q (%v)", found, err)
+	}
+}
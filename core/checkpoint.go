@@ -0,0 +1,214 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// CheckpointFileName is the name of the checkpoint file written in the backup
+// folder while the backup is running
+const CheckpointFileName = "checkpoint"
+
+// S3CheckpointSegment represents the progress of one segment of the scan.
+// Dumped is the number of items following LastEvaluatedKey that have already
+// been written, as a file can be dumped in the middle of a page
+type S3CheckpointSegment struct {
+	Segment          int64                            `json:"segment"`
+	LastEvaluatedKey map[string]*CustomAttributeValue `json:"lastEvaluatedKey,omitempty"`
+	Dumped           int64                            `json:"dumped,omitempty"`
+	Done             bool                             `json:"done"`
+}
+
+// S3Checkpoint represents the checkpoint stored in the s3 folder of a running
+// backup. It holds the scan progress of each segment and the manifest of the
+// files already written
+type S3Checkpoint struct {
+	TableName     string                `json:"tableName"`
+	TotalSegments int64                 `json:"totalSegments"`
+	Segments      []S3CheckpointSegment `json:"segments"`
+	Manifest      S3Manifest            `json:"manifest"`
+}
+
+// sealedCheckpoint is the content of the checkpoint file of an encrypted
+// backup, as the LastEvaluatedKey values are items of the table
+type sealedCheckpoint struct {
+	Encryption *S3EncryptionInfo `json:"encryption"`
+	Checkpoint []byte            `json:"checkpoint"`
+}
+
+// ScanProgress keeps track of the LastEvaluatedKey of each segment of a scan so
+// that it can be checkpointed and resumed later on. The items sent to the
+// channel and the items received by its consumer are counted, so that a
+// checkpoint only happens once the progress accounts for every item received
+type ScanProgress struct {
+	mu            sync.Mutex
+	counted       *sync.Cond
+	tableName     string
+	totalSegments int64
+	segments      []S3CheckpointSegment
+	sentItems     int64
+	receivedItems int64
+}
+
+// NewScanProgress creates a ScanProgress for a scan starting from scratch
+func NewScanProgress(tableName string, totalSegments int64) *ScanProgress {
+	p := &ScanProgress{tableName: tableName, totalSegments: totalSegments}
+	p.counted = sync.NewCond(&p.mu)
+	for i := int64(0); i < totalSegments; i++ {
+		p.segments = append(p.segments, S3CheckpointSegment{Segment: i})
+	}
+	return p
+}
+
+// ResumeScanProgress creates a ScanProgress starting where the given
+// checkpoint stopped
+func ResumeScanProgress(checkpoint *S3Checkpoint) *ScanProgress {
+	p := NewScanProgress(checkpoint.TableName, checkpoint.TotalSegments)
+	for _, seg := range checkpoint.Segments {
+		if seg.Segment >= 0 && seg.Segment < p.totalSegments {
+			p.segments[seg.Segment] = seg
+		}
+	}
+	return p
+}
+
+// segment returns the key the given segment should start from, the number of
+// items following it already dumped and whether the segment has already been
+// scanned entirely
+func (p *ScanProgress) segment(segment int64) (map[string]*dynamodb.AttributeValue, int64, bool) {
+	if p == nil {
+		return nil, 0, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seg := p.segments[segment]
+	return fromCustomAttributeMap(seg.LastEvaluatedKey), seg.Dumped, seg.Done
+}
+
+// sent records that an item of a segment following its LastEvaluatedKey has
+// been sent to the channel
+func (p *ScanProgress) sent(segment int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.segments[segment].Dumped++
+	p.sentItems++
+	p.counted.Broadcast()
+}
+
+// received records that the consumer of the channel got an item
+func (p *ScanProgress) received() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.receivedItems++
+}
+
+// update records that all the items of a segment up to lastEvaluatedKey have
+// been sent to the channel, as well as the given number of items following it
+func (p *ScanProgress) update(segment int64, lastEvaluatedKey map[string]*dynamodb.AttributeValue, dumped int64, done bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.segments[segment].LastEvaluatedKey = toCustomAttributeMap(lastEvaluatedKey)
+	p.segments[segment].Dumped = dumped
+	p.segments[segment].Done = done
+}
+
+// Checkpoint returns a snapshot of the progress along with the given manifest.
+// A segment can receive its item before counting it, so the snapshot waits for
+// every item received to be counted
+func (p *ScanProgress) Checkpoint(manifest S3Manifest) S3Checkpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.sentItems < p.receivedItems {
+		p.counted.Wait()
+	}
+	segments := make([]S3CheckpointSegment, len(p.segments))
+	copy(segments, p.segments)
+	return S3Checkpoint{TableName: p.tableName, TotalSegments: p.totalSegments, Segments: segments, Manifest: manifest}
+}
+
+// LoadCheckpointFromS3 downloads and decodes the checkpoint file of a backup,
+// decrypting it with the Keys of the helper if it is encrypted
+func (h *AwsHelper) LoadCheckpointFromS3(bucketName, checkpointPath string) (*S3Checkpoint, error) {
+	doc, err := h.GetFromS3(context.Background(), bucketName, checkpointPath)
+	if err != nil {
+		return nil, err
+	}
+	defer (*doc).Close()
+	buff := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buff, *doc); err != nil {
+		return nil, err
+	}
+
+	data := buff.Bytes()
+	sealed := &sealedCheckpoint{}
+	if err := json.Unmarshal(data, sealed); err != nil {
+		return nil, err
+	}
+	if sealed.Encryption != nil {
+		reader, err := decryptReader(h.Keys, sealed.Encryption, ioutil.NopCloser(bytes.NewReader(sealed.Checkpoint)), CheckpointFileName)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decrypt the checkpoint: %w", err)
+		}
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	checkpoint := &S3Checkpoint{}
+	return checkpoint, json.Unmarshal(data, checkpoint)
+}
+
+// checkpointToS3 writes the current scan progress and the manifest of the
+// destination to the checkpoint file of the backup folder. It must be called
+// right after a DumpBuffer, as every item counted as sent at that point has
+// been written to s3. The checkpoint is encrypted like the data files when
+// the destination has Keys
+func (h *AwsHelper) checkpointToS3(ctx context.Context, bucketName, s3Folder string, destination *AwsHelper) error {
+	if h.Progress == nil {
+		return nil
+	}
+	data, err := json.Marshal(h.Progress.Checkpoint(destination.ManifestS3))
+	if err != nil {
+		return fmt.Errorf("while doing a marshal on the checkpoint: %s", err)
+	}
+	if destination.Keys != nil {
+		sealed := sealedCheckpoint{}
+		if sealed.Checkpoint, sealed.Encryption, err = encrypt(destination.Keys, data, CheckpointFileName); err != nil {
+			return fmt.Errorf("while encrypting the checkpoint: %s", err)
+		}
+		if data, err = json.Marshal(sealed); err != nil {
+			return fmt.Errorf("while doing a marshal on the checkpoint: %s", err)
+		}
+	}
+	return destination.uploadControlToS3(ctx, bucketName, fmt.Sprintf("%s/%s", s3Folder, CheckpointFileName), data)
+}
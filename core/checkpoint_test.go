@@ -0,0 +1,125 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestCheckpointMidPage(t *testing.T) {
+	// The scan is interrupted once 2 items of the single page are received
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &AwsHelper{DynamoSvc: &mockDynamoDBClient{}, DataPipe: make(chan map[string]*dynamodb.AttributeValue), Progress: NewScanProgress("myTable", 1)}
+	go func() {
+		received := 0
+		for range h.DataPipe {
+			h.Progress.received()
+			if received++; received == 2 {
+				cancel()
+				break
+			}
+		}
+		h.Wg.Done()
+	}()
+	h.TableToChannel(ctx, "myTable", 10, time.Millisecond, 1)
+	h.Wg.Wait()
+
+	checkpoint := h.Progress.Checkpoint(S3Manifest{})
+	if seg := checkpoint.Segments[0]; seg.Done || seg.LastEvaluatedKey != nil || seg.Dumped != 2 {
+		t.Fatalf("Expecting 2 items of the first page to be dumped, got %+v", seg)
+	}
+
+	// The items already dumped are skipped once resumed
+	h = &AwsHelper{DynamoSvc: &mockDynamoDBClient{}, DataPipe: make(chan map[string]*dynamodb.AttributeValue), Progress: ResumeScanProgress(&checkpoint)}
+	read := []map[string]*dynamodb.AttributeValue{}
+	go func() {
+		for elem := range h.DataPipe {
+			read = append(read, elem)
+		}
+		h.Wg.Done()
+	}()
+	if err := h.TableToChannel(context.Background(), "myTable", 10, time.Millisecond, 1); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	h.Wg.Wait()
+	if len(read) != 1 || !reflect.DeepEqual(read[0], dataSet[2]) {
+		t.Fatalf("Expecting only the last item to be scanned, got %v", read)
+	}
+	if seg := h.Progress.Checkpoint(S3Manifest{}).Segments[0]; !seg.Done || seg.Dumped != 0 {
+		t.Fatalf("Expecting the segment to be done, got %+v", seg)
+	}
+}
+
+func TestCheckpointEncryption(t *testing.T) {
+	keys, err := NewLocalKeyProvider(writeKeyFile(t, "key.hex", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	dir := t.TempDir()
+	location := "file://" + dir
+	ctx := context.Background()
+
+	startKey := map[string]*dynamodb.AttributeValue{"artist": {S: aws.String("Queen")}}
+	h := &AwsHelper{Progress: NewScanProgress("myTable", 1)}
+	h.Progress.update(0, startKey, 1, false)
+	dest := &AwsHelper{Keys: keys}
+	if err := h.checkpointToS3(ctx, location, "backup", dest); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The key values are not stored in plaintext
+	data, err := ioutil.ReadFile(filepath.Join(dir, "backup", CheckpointFileName))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bytes.Contains(data, []byte("Queen")) {
+		t.Fatalf("Expecting an encrypted checkpoint, got %s", data)
+	}
+
+	checkpoint, err := dest.LoadCheckpointFromS3(location, "backup/"+CheckpointFileName)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	seg := checkpoint.Segments[0]
+	if checkpoint.TableName != "myTable" || seg.Dumped != 1 || !reflect.DeepEqual(fromCustomAttributeMap(seg.LastEvaluatedKey), startKey) {
+		t.Fatalf("Unexpected checkpoint %+v", checkpoint)
+	}
+	if _, err := (&AwsHelper{}).LoadCheckpointFromS3(location, "backup/"+CheckpointFileName); err == nil {
+		t.Fatal("Expecting an error without the key")
+	}
+
+	// The checkpoints of unencrypted backups are still plain json
+	if err := h.checkpointToS3(ctx, location, "plain", &AwsHelper{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if data, err = ioutil.ReadFile(filepath.Join(dir, "plain", CheckpointFileName)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	plain := &S3Checkpoint{}
+	if err := json.Unmarshal(data, plain); err != nil || plain.Segments[0].Dumped != 1 {
+		t.Fatalf("Expecting a plain checkpoint, got %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// CompressionNone leaves the data files uncompressed
+	CompressionNone = "none"
+	// CompressionGzip compresses the data files with gzip
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses the data files with zstd
+	CompressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ValidateCompression checks that the given codec is supported
+func ValidateCompression(codec string) error {
+	switch codec {
+	case "", CompressionNone, CompressionGzip, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("Unsupported compression %s, must be one of %s, %s or %s", codec, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+}
+
+// compressionExtension returns the extension added to the name of the files
+// compressed with the given codec
+func compressionExtension(codec string) string {
+	switch codec {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// compress compresses the given data with the given codec
+func compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		var buff bytes.Buffer
+		w := gzip.NewWriter(&buff)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buff.Bytes(), nil
+	case CompressionZstd:
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(data, nil), nil
+	default:
+		return nil, ValidateCompression(codec)
+	}
+}
+
+// decompressedReadCloser closes both the decompressing reader and the
+// underlying one
+type decompressedReadCloser struct {
+	io.Reader
+	closers []func() error
+}
+
+// Close closes the decompressing reader and the underlying one
+func (r *decompressedReadCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// decompressReader wraps the given reader to decompress it with the given
+// codec. When no codec is given, as for the files of older backups, it is
+// detected from the first bytes of the data, falling back on uncompressed data
+func decompressReader(codec string, r io.ReadCloser) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	if codec == "" {
+		codec = CompressionNone
+		if magic, _ := buffered.Peek(len(zstdMagic)); bytes.HasPrefix(magic, gzipMagic) {
+			codec = CompressionGzip
+		} else if bytes.Equal(magic, zstdMagic) {
+			codec = CompressionZstd
+		}
+	}
+
+	switch codec {
+	case CompressionNone:
+		return &decompressedReadCloser{Reader: buffered, closers: []func() error{r.Close}}, nil
+	case CompressionGzip:
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return &decompressedReadCloser{Reader: gz, closers: []func() error{gz.Close, r.Close}}, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return &decompressedReadCloser{Reader: zr, closers: []func() error{func() error { zr.Close(); return nil }, r.Close}}, nil
+	default:
+		return nil, ValidateCompression(codec)
+	}
+}
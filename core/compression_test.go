@@ -0,0 +1,47 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := []byte("{\"artist\":{\"s\":\"Queen\"}}\n{\"artist\":{\"s\":\"Metallica\"}}\n")
+	for _, codec := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		compressed, err := compress(codec, data)
+		if err != nil {
+			t.Fatalf("Unexpected error compressing with %s: %s", codec, err)
+		}
+		// Decompress with the codec from the manifest, then by detecting it
+		for _, declared := range []string{codec, ""} {
+			r, err := decompressReader(declared, ioutil.NopCloser(bytes.NewReader(compressed)))
+			if err != nil {
+				t.Fatalf("Unexpected error decompressing %s: %s", codec, err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Unexpected error reading %s: %s", codec, err)
+			}
+			r.Close()
+			if !bytes.Equal(out, data) {
+				t.Fatalf("Data compressed with %s mismatch. Expecting: %s\nGot: %s\n", codec, data, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Modes of a ConflictPolicy
+const (
+	// OnConflictOverwrite replaces the items already in the table
+	OnConflictOverwrite = "overwrite"
+	// OnConflictSkip keeps the items already in the table
+	OnConflictSkip = "skip"
+	// OnConflictNewerWins replaces the items already in the table holding a
+	// lower version attribute
+	OnConflictNewerWins = "newer-wins"
+)
+
+// DefaultConflictWorkers is the default number of items written in parallel
+// by the conditional writes
+const DefaultConflictWorkers = 10
+
+// ConflictPolicy tells how to restore the items already present in the target
+// table. Except for overwrite, the items are written one by one with
+// conditional PutItem calls, by Workers items in parallel
+type ConflictPolicy struct {
+	// Mode defaults to overwrite
+	Mode string
+	// VersionAttribute is compared by newer-wins, it can be a number or a
+	// string such as an ISO 8601 timestamp
+	VersionAttribute string
+	Workers          int
+
+	keyAttribute string
+	skipped      int64
+}
+
+// Validate checks the consistency of the conflict policy
+func (p ConflictPolicy) Validate() error {
+	switch p.Mode {
+	case "", OnConflictOverwrite, OnConflictSkip:
+	case OnConflictNewerWins:
+		if p.VersionAttribute == "" {
+			return fmt.Errorf("A version attribute is required by the %s mode", OnConflictNewerWins)
+		}
+	default:
+		return fmt.Errorf("Unsupported conflict mode %s, must be %s, %s or %s", p.Mode, OnConflictOverwrite, OnConflictSkip, OnConflictNewerWins)
+	}
+	if p.Workers < 0 {
+		return fmt.Errorf("The number of workers can't be negative")
+	}
+	return nil
+}
+
+// Conditional tells if the items are written with conditional writes
+func (p ConflictPolicy) Conditional() bool {
+	return p.Mode == OnConflictSkip || p.Mode == OnConflictNewerWins
+}
+
+// ForTable returns the policy applied to the table of the given definition,
+// nil if the items are simply overwritten
+func (p ConflictPolicy) ForTable(def *TableDefinition) (*ConflictPolicy, error) {
+	if !p.Conditional() {
+		return nil, nil
+	}
+	if len(def.KeySchema) == 0 {
+		return nil, fmt.Errorf("The key schema of the table %s is unknown", def.TableName)
+	}
+	if p.Workers == 0 {
+		p.Workers = DefaultConflictWorkers
+	}
+	p.keyAttribute = def.KeySchema[0].AttributeName
+	p.skipped = 0
+	return &p, nil
+}
+
+// Skipped returns the number of items skipped as already in the table
+func (p *ConflictPolicy) Skipped() int64 {
+	return atomic.LoadInt64(&p.skipped)
+}
+
+// condition sets the condition of the PutItem writing the given item
+func (p *ConflictPolicy) condition(input *dynamodb.PutItemInput) {
+	input.ExpressionAttributeNames = map[string]*string{"#key": aws.String(p.keyAttribute)}
+	input.ConditionExpression = aws.String("attribute_not_exists(#key)")
+	// An item without version only replaces a missing item
+	version, ok := input.Item[p.VersionAttribute]
+	if p.Mode != OnConflictNewerWins || !ok {
+		return
+	}
+	input.ExpressionAttributeNames["#version"] = aws.String(p.VersionAttribute)
+	input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":version": version}
+	input.ConditionExpression = aws.String("attribute_not_exists(#key) OR attribute_not_exists(#version) OR #version < :version")
+}
+
+// putItems writes the given requests with conditional PutItem calls, using the
+// workers of the ConflictPolicy. The first error stops the other workers
+func (h *AwsHelper) putItems(ctx context.Context, tableName string, reqs []*dynamodb.WriteRequest, source string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	items := make(chan map[string]*dynamodb.AttributeValue)
+	for i := 0; i < h.Conflicts.Workers && i < len(reqs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				if err := h.putItem(ctx, tableName, item, source); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+
+send:
+	for _, req := range reqs {
+		select {
+		case items <- req.PutRequest.Item:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(items)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// putItem writes an item with a conditional PutItem, retrying the failed
+// calls. An item failing the condition is counted as skipped
+func (h *AwsHelper) putItem(ctx context.Context, tableName string, item map[string]*dynamodb.AttributeValue, source string) error {
+	input := &dynamodb.PutItemInput{
+		TableName:              aws.String(tableName),
+		Item:                   item,
+		ReturnConsumedCapacity: aws.String("TOTAL"),
+	}
+	h.Conflicts.condition(input)
+	r := h.retryPolicy().newRetrier(ctx, "PutItem")
+	for {
+		h.WriteLimiter.Wait()
+		result, err := h.DynamoSvc.PutItemWithContext(ctx, input)
+		code := errorCode(err)
+		switch {
+		case err == nil:
+			h.WriteLimiter.Consume(consumedUnits(result.ConsumedCapacity))
+			return nil
+		case code == dynamodb.ErrCodeConditionalCheckFailedException:
+			atomic.AddInt64(&h.Conflicts.skipped, 1)
+			return nil
+		case rejectedCodes[code]:
+			if err := h.rejectItem(ctx, err, source, item); err != nil {
+				return fmt.Errorf("unrecoverable error during put item: %w", err)
+			}
+			return nil
+		case r.retry(err):
+			continue
+		}
+		return fmt.Errorf("unrecoverable error during put item: %w", r.giveUp(tableError(tableName, err)))
+	}
+}
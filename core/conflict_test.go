@@ -0,0 +1,142 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// struct to mock the PutItem calls of a table already holding Queen, with a
+// version 2, throttling the given number of calls first
+type mockConditionalDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	mu        sync.Mutex
+	written   []string
+	throttles int
+}
+
+func (m *mockConditionalDynamoDBClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	m.mu.Lock()
+	if m.throttles > 0 {
+		m.throttles--
+		m.mu.Unlock()
+		return nil, awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "Bla bla", nil)
+	}
+	m.mu.Unlock()
+	artist := aws.StringValue(input.Item["artist"].S)
+	condition := aws.StringValue(input.ConditionExpression)
+	if artist == "Queen" {
+		version, ok := input.ExpressionAttributeValues[":version"]
+		if condition == "attribute_not_exists(#key)" || !ok || aws.StringValue(version.N) <= "2" {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.written = append(m.written, artist)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestPutItemsOnConflict(t *testing.T) {
+	def := &TableDefinition{TableName: "myTable", KeySchema: []KeyDefinition{{AttributeName: "artist", KeyType: "HASH"}}}
+	tests := []struct {
+		mode    string
+		version string
+		written int
+		skipped int64
+	}{
+		{OnConflictSkip, "3", 2, 1},
+		{OnConflictNewerWins, "1", 2, 1},
+		{OnConflictNewerWins, "3", 3, 0},
+	}
+
+	for _, test := range tests {
+		reqs := []*dynamodb.WriteRequest{}
+		for _, item := range dataSet {
+			copied := map[string]*dynamodb.AttributeValue{"version": {N: aws.String(test.version)}}
+			for k, v := range item {
+				copied[k] = v
+			}
+			reqs = append(reqs, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: copied}})
+		}
+
+		mock := &mockConditionalDynamoDBClient{}
+		policy := ConflictPolicy{Mode: test.mode, VersionAttribute: "version", Workers: 2}
+		if err := policy.Validate(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		h := &AwsHelper{DynamoSvc: mock}
+		var err error
+		if h.Conflicts, err = policy.ForTable(def); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := h.writeBatch(context.Background(), "myTable", reqs, ""); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(mock.written) != test.written || h.Conflicts.Skipped() != test.skipped {
+			t.Fatalf("%s with version %s: expecting %d items written and %d skipped, got %v and %d", test.mode, test.version, test.written, test.skipped, mock.written, h.Conflicts.Skipped())
+		}
+	}
+}
+
+func TestPutItemsThrottled(t *testing.T) {
+	def := &TableDefinition{TableName: "myTable", KeySchema: []KeyDefinition{{AttributeName: "artist", KeyType: "HASH"}}}
+	reqs := []*dynamodb.WriteRequest{}
+	for _, item := range dataSet {
+		reqs = append(reqs, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+	}
+
+	// Without retry policy set, the throttled call is retried with the default
+	// one
+	mock := &mockConditionalDynamoDBClient{throttles: 1}
+	h := &AwsHelper{DynamoSvc: mock}
+	var err error
+	if h.Conflicts, err = (ConflictPolicy{Mode: OnConflictSkip, Workers: 1}).ForTable(def); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := h.writeBatch(context.Background(), "myTable", reqs, ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(mock.written) != len(dataSet)-1 || h.Conflicts.Skipped() != 1 {
+		t.Fatalf("Expecting %d items written and 1 skipped, got %v and %d", len(dataSet)-1, mock.written, h.Conflicts.Skipped())
+	}
+}
+
+func TestConflictPolicyValidate(t *testing.T) {
+	invalid := []ConflictPolicy{
+		{Mode: "keep"},
+		{Mode: OnConflictNewerWins},
+		{Mode: OnConflictSkip, Workers: -1},
+	}
+	for _, policy := range invalid {
+		if err := policy.Validate(); err == nil {
+			t.Fatalf("Expecting an error for %v", policy)
+		}
+	}
+
+	overwrite, err := ConflictPolicy{}.ForTable(&TableDefinition{})
+	if err != nil || overwrite != nil {
+		t.Fatalf("Expecting no policy to overwrite the items, got %v and %v", overwrite, err)
+	}
+}
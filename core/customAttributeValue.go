@@ -45,7 +45,7 @@ func (attr *CustomAttributeValue) Unmarshal(out *dynamodb.AttributeValue) {
 	out.NULL = attr.NULL
 	out.S = attr.S
 	out.SS = attr.SS
-	if len(attr.L) > 0 {
+	if attr.L != nil {
 		out.L = []*dynamodb.AttributeValue{}
 	}
 	for _, child := range attr.L {
@@ -54,7 +54,7 @@ func (attr *CustomAttributeValue) Unmarshal(out *dynamodb.AttributeValue) {
 		out.L = append(out.L, &translated)
 	}
 
-	if len(attr.M) > 0 {
+	if attr.M != nil {
 		out.M = make(map[string]*dynamodb.AttributeValue)
 	}
 	for k, v := range attr.M {
@@ -76,7 +76,7 @@ func (attr *CustomAttributeValue) Marshal(in *dynamodb.AttributeValue) {
 	attr.S = in.S
 	attr.SS = in.SS
 
-	if len(in.L) > 0 {
+	if in.L != nil {
 		attr.L = []*CustomAttributeValue{}
 	}
 	for _, child := range in.L {
@@ -85,7 +85,7 @@ func (attr *CustomAttributeValue) Marshal(in *dynamodb.AttributeValue) {
 		attr.L = append(attr.L, &translated)
 	}
 
-	if len(in.M) > 0 {
+	if in.M != nil {
 		attr.M = make(map[string]*CustomAttributeValue)
 	}
 	for k, v := range in.M {
@@ -95,12 +95,41 @@ func (attr *CustomAttributeValue) Marshal(in *dynamodb.AttributeValue) {
 	}
 }
 
+// MarshalJSON keeps the empty lists and maps, which omitempty would drop,
+// leaving an attribute without any type
+func (attr CustomAttributeValue) MarshalJSON() ([]byte, error) {
+	// The L and M fields of plain, which has no MarshalJSON method, are
+	// shadowed by pointers only omitted when unset
+	type plain CustomAttributeValue
+	out := struct {
+		plain
+		L *[]*CustomAttributeValue          `json:"l,omitempty"`
+		M *map[string]*CustomAttributeValue `json:"m,omitempty"`
+	}{plain: plain(attr)}
+	if attr.L != nil {
+		out.L = &attr.L
+	}
+	if attr.M != nil {
+		out.M = &attr.M
+	}
+	return json.Marshal(out)
+}
+
 // MarshalDynamoAttributeMap only purpose is to create a json-format
 // representation of the AttributeValue map without the empty fields. We
 // wouldn't need that if the fields of the struct was set to
 // `json:",omitempty"` and we can't use the dynamodbattribute package because
 // you can't really do a field for field copy with it.
 func MarshalDynamoAttributeMap(attrs map[string]*dynamodb.AttributeValue) ([]byte, error) {
+	return json.Marshal(toCustomAttributeMap(attrs))
+}
+
+// toCustomAttributeMap translates an AttributeValue map into a
+// CustomAttributeValue map
+func toCustomAttributeMap(attrs map[string]*dynamodb.AttributeValue) map[string]*CustomAttributeValue {
+	if attrs == nil {
+		return nil
+	}
 	resultMap := make(map[string]*CustomAttributeValue)
 
 	for k, v := range attrs {
@@ -108,5 +137,21 @@ func MarshalDynamoAttributeMap(attrs map[string]*dynamodb.AttributeValue) ([]byt
 		custAttr.Marshal(v)
 		resultMap[k] = &custAttr
 	}
-	return json.Marshal(resultMap)
+	return resultMap
+}
+
+// fromCustomAttributeMap translates a CustomAttributeValue map back into an
+// AttributeValue map
+func fromCustomAttributeMap(attrs map[string]*CustomAttributeValue) map[string]*dynamodb.AttributeValue {
+	if attrs == nil {
+		return nil
+	}
+	resultMap := make(map[string]*dynamodb.AttributeValue)
+
+	for k, v := range attrs {
+		attr := dynamodb.AttributeValue{}
+		v.Unmarshal(&attr)
+		resultMap[k] = &attr
+	}
+	return resultMap
 }
@@ -0,0 +1,142 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// deadLetterBufferSize is the size of the dead letter files
+const deadLetterBufferSize = 10 * 1024 * 1024
+
+// deadLetterKey groups the rejected items in files by error code and source
+type deadLetterKey struct {
+	code   string
+	source string
+}
+
+// deadLetterBuffer holds the rejected items not written yet
+type deadLetterBuffer struct {
+	buff      bytes.Buffer
+	itemCount int64
+}
+
+// DeadLetter collects the items rejected during a restore and writes them to
+// an s3 folder in the backup format, so they can be inspected and restored
+// again. Each file holds the items of a single source file rejected with the
+// same error code, both recorded in its manifest entry
+type DeadLetter struct {
+	Bucket string
+	Folder string
+
+	helper  *AwsHelper
+	mu      sync.Mutex
+	buffers map[deadLetterKey]*deadLetterBuffer
+	count   int64
+}
+
+// NewDeadLetter creates a DeadLetter writing to the given s3 folder with the
+// given helper, using its compression, encryption and upload options
+func NewDeadLetter(h *AwsHelper, bucket, folder string) *DeadLetter {
+	return &DeadLetter{Bucket: bucket, Folder: folder, helper: h, buffers: make(map[deadLetterKey]*deadLetterBuffer)}
+}
+
+// Add records an item rejected with the given error code, coming from the
+// given source file
+func (d *DeadLetter) Add(ctx context.Context, code, source string, item map[string]*dynamodb.AttributeValue) error {
+	data, err := MarshalDynamoAttributeMap(item)
+	if err != nil {
+		return fmt.Errorf("while converting to json: %v\nError: %s", item, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := deadLetterKey{code: code, source: source}
+	buffer, ok := d.buffers[key]
+	if !ok {
+		buffer = &deadLetterBuffer{}
+		d.buffers[key] = buffer
+	}
+	buffer.buff.Write(data)
+	buffer.buff.WriteString("\n")
+	buffer.itemCount++
+	d.count++
+	if buffer.buff.Len() >= deadLetterBufferSize {
+		return d.dump(ctx, key, buffer)
+	}
+	return nil
+}
+
+// dump writes the given buffer to a new file of the dead letter
+func (d *DeadLetter) dump(ctx context.Context, key deadLetterKey, buffer *deadLetterBuffer) error {
+	if err := d.helper.DumpBuffer(ctx, d.Bucket, d.Folder, &buffer.buff, buffer.itemCount); err != nil {
+		return err
+	}
+	entry := &d.helper.ManifestS3.Entries[len(d.helper.ManifestS3.Entries)-1]
+	entry.ErrorCode = key.code
+	entry.Source = key.source
+	buffer.itemCount = 0
+	return nil
+}
+
+// Count returns the number of rejected items
+func (d *DeadLetter) Count() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+// Close writes the remaining items, then the manifest and the _SUCCESS flag of
+// the dead letter. Nothing is written if no item was rejected
+func (d *DeadLetter) Close(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.count == 0 {
+		return nil
+	}
+
+	// Sorted so the files are written in a stable order
+	keys := []deadLetterKey{}
+	for key := range d.buffers {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].source != keys[j].source {
+			return keys[i].source < keys[j].source
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, key := range keys {
+		if buffer := d.buffers[key]; buffer.itemCount > 0 {
+			if err := d.dump(ctx, key, buffer); err != nil {
+				return err
+			}
+		}
+	}
+
+	d.helper.ManifestS3.Version = 3
+	d.helper.ManifestS3.Name = "DynamoDB-export"
+	if err := d.helper.uploadControlToS3(ctx, d.Bucket, fmt.Sprintf("%s/_SUCCESS", d.Folder), []byte{}); err != nil {
+		return err
+	}
+	return d.helper.manifestToS3(ctx, d.Bucket, d.Folder, false)
+}
@@ -0,0 +1,304 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// DiffChange is the change of an attribute of an item. From is missing for an
+// added attribute and To for a removed one
+type DiffChange struct {
+	Attribute string                `json:"attribute"`
+	From      *CustomAttributeValue `json:"from,omitempty"`
+	To        *CustomAttributeValue `json:"to,omitempty"`
+}
+
+// DiffItem is an item added, removed or modified, identified by its key
+type DiffItem struct {
+	Key     map[string]*CustomAttributeValue `json:"key"`
+	Changes []DiffChange                     `json:"changes,omitempty"`
+}
+
+// DiffSummary counts the items of each kind of a DiffReport
+type DiffSummary struct {
+	Added     int64 `json:"added"`
+	Removed   int64 `json:"removed"`
+	Modified  int64 `json:"modified"`
+	Unchanged int64 `json:"unchanged"`
+}
+
+// DiffReport is the result of the comparison of two sets of items
+type DiffReport struct {
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Summary  DiffSummary `json:"summary"`
+	Added    []DiffItem  `json:"added,omitempty"`
+	Removed  []DiffItem  `json:"removed,omitempty"`
+	Modified []DiffItem  `json:"modified,omitempty"`
+}
+
+// Identical tells if no difference was found
+func (r *DiffReport) Identical() bool {
+	return r.Summary.Added == 0 && r.Summary.Removed == 0 && r.Summary.Modified == 0
+}
+
+// Differ compares two sets of items, keyed by the primary key of a table. The
+// items of the first set are kept in memory, the ones of the second set are
+// compared as they come
+type Differ struct {
+	keys   *KeySet
+	from   map[string]map[string]*dynamodb.AttributeValue
+	report DiffReport
+}
+
+// NewDiffer creates a Differ keying the items by the key schema of the given
+// table definition
+func NewDiffer(def *TableDefinition, from, to string) *Differ {
+	return &Differ{
+		keys:   NewKeySet(def),
+		from:   make(map[string]map[string]*dynamodb.AttributeValue),
+		report: DiffReport{From: from, To: to},
+	}
+}
+
+// AddFrom records an item of the first set
+func (d *Differ) AddFrom(item map[string]*dynamodb.AttributeValue) error {
+	key, err := d.keys.keyString(item)
+	if err != nil {
+		return err
+	}
+	d.from[key] = item
+	return nil
+}
+
+// CompareTo compares an item of the second set to the item of the first set
+// with the same key, if any
+func (d *Differ) CompareTo(item map[string]*dynamodb.AttributeValue) error {
+	key, err := d.keys.keyString(item)
+	if err != nil {
+		return err
+	}
+	from, ok := d.from[key]
+	if !ok {
+		d.report.Summary.Added++
+		d.report.Added = append(d.report.Added, d.diffItem(item, nil))
+		return nil
+	}
+	delete(d.from, key)
+
+	changes, err := diffAttributes(from, item)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		d.report.Summary.Unchanged++
+		return nil
+	}
+	d.report.Summary.Modified++
+	d.report.Modified = append(d.report.Modified, d.diffItem(item, changes))
+	return nil
+}
+
+// Report returns the report once all the items are compared, the items of the
+// first set missing from the second one being removed. The items are sorted by
+// key
+func (d *Differ) Report() *DiffReport {
+	for _, item := range d.from {
+		d.report.Summary.Removed++
+		d.report.Removed = append(d.report.Removed, d.diffItem(item, nil))
+	}
+	d.from = make(map[string]map[string]*dynamodb.AttributeValue)
+	for _, items := range [][]DiffItem{d.report.Added, d.report.Removed, d.report.Modified} {
+		sortDiffItems(items)
+	}
+	return &d.report
+}
+
+// diffItem returns the DiffItem of the given item
+func (d *Differ) diffItem(item map[string]*dynamodb.AttributeValue, changes []DiffChange) DiffItem {
+	key := make(map[string]*dynamodb.AttributeValue)
+	for _, attribute := range d.keys.attributes {
+		key[attribute] = item[attribute]
+	}
+	return DiffItem{Key: toCustomAttributeMap(key), Changes: changes}
+}
+
+// sortDiffItems sorts the given items by key
+func sortDiffItems(items []DiffItem) {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		data, _ := json.Marshal(item.Key)
+		keys[i] = string(data)
+	}
+	sort.Sort(diffItemsByKey{items: items, keys: keys})
+}
+
+// diffItemsByKey sorts DiffItems along with their json key
+type diffItemsByKey struct {
+	items []DiffItem
+	keys  []string
+}
+
+func (s diffItemsByKey) Len() int           { return len(s.items) }
+func (s diffItemsByKey) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s diffItemsByKey) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// diffAttributes returns the changes of the attributes between two versions of
+// an item, sorted by attribute name
+func diffAttributes(from, to map[string]*dynamodb.AttributeValue) ([]DiffChange, error) {
+	names := []string{}
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, ok := from[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []DiffChange{}
+	for _, name := range names {
+		fromValue, toValue := from[name], to[name]
+		if fromValue != nil && toValue != nil {
+			equal, err := equalAttributeValues(fromValue, toValue)
+			if err != nil {
+				return nil, err
+			}
+			if equal {
+				continue
+			}
+		}
+		changes = append(changes, DiffChange{Attribute: name, From: toCustomAttributeValue(fromValue), To: toCustomAttributeValue(toValue)})
+	}
+	return changes, nil
+}
+
+// toCustomAttributeValue translates an AttributeValue, nil if missing
+func toCustomAttributeValue(av *dynamodb.AttributeValue) *CustomAttributeValue {
+	if av == nil {
+		return nil
+	}
+	custom := &CustomAttributeValue{}
+	custom.Marshal(av)
+	return custom
+}
+
+// equalAttributeValues tells if both attributes hold the same value, ignoring
+// the order of the elements of the sets
+func equalAttributeValues(a, b *dynamodb.AttributeValue) (bool, error) {
+	dataA, err := json.Marshal(canonicalAttributeValue(a))
+	if err != nil {
+		return false, err
+	}
+	dataB, err := json.Marshal(canonicalAttributeValue(b))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(dataA, dataB), nil
+}
+
+// canonicalAttributeValue returns the given attribute with its sets sorted
+func canonicalAttributeValue(av *dynamodb.AttributeValue) *CustomAttributeValue {
+	custom := toCustomAttributeValue(av)
+	var sortSets func(c *CustomAttributeValue)
+	sortSets = func(c *CustomAttributeValue) {
+		c.SS = sortedStrings(c.SS)
+		c.NS = sortedStrings(c.NS)
+		if c.BS != nil {
+			bs := append([][]byte{}, c.BS...)
+			sort.Slice(bs, func(i, j int) bool { return bytes.Compare(bs[i], bs[j]) < 0 })
+			c.BS = bs
+		}
+		for _, child := range c.L {
+			sortSets(child)
+		}
+		for _, child := range c.M {
+			sortSets(child)
+		}
+	}
+	sortSets(custom)
+	return custom
+}
+
+// sortedStrings returns a sorted copy of the given strings
+func sortedStrings(values []*string) []*string {
+	if values == nil {
+		return nil
+	}
+	sorted := append([]*string{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return *sorted[i] < *sorted[j] })
+	return sorted
+}
+
+// BackupItems passes each item of the backup in the given s3 folder to the
+// given function, loading its manifest in AwsHelper.ManifestS3
+func (h *AwsHelper) BackupItems(ctx context.Context, bucketName, s3Folder string, fn func(item map[string]*dynamodb.AttributeValue) error) error {
+	if err := h.LoadManifestFromS3(bucketName, fmt.Sprintf("%s/manifest", s3Folder)); err != nil {
+		return err
+	}
+	for _, entry := range h.ManifestS3.Entries {
+		location, key, ok := splitStorageURL(entry.URL)
+		if !ok {
+			continue
+		}
+		reader, err := h.entryReader(ctx, location, key, entry)
+		if err != nil {
+			return err
+		}
+		scanner := newLineScanner(reader)
+		for scanner.Scan() {
+			item, err := parseItem(scanner.Bytes())
+			if err == nil {
+				err = fn(item)
+			}
+			if err != nil {
+				reader.Close()
+				return fmt.Errorf("%s: %s", entry.URL, err)
+			}
+		}
+		reader.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TableItems scans the given table by pages of batchSize items, waiting
+// waitPeriod between two pages unless the ReadLimiter is set, and passes each
+// item to the given function
+func (h *AwsHelper) TableItems(ctx context.Context, tableName string, batchSize int64, waitPeriod time.Duration, fn func(item map[string]*dynamodb.AttributeValue) error) error {
+	return h.scanItems(ctx, tableName, nil, nil, batchSize, waitPeriod, func(items []map[string]*dynamodb.AttributeValue) error {
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestDiffer(t *testing.T) {
+	def := &TableDefinition{TableName: "myTable", KeySchema: []KeyDefinition{{AttributeName: "artist", KeyType: "HASH"}}}
+	differ := NewDiffer(def, "from", "to")
+	from := []map[string]*dynamodb.AttributeValue{
+		{"artist": {S: aws.String("Queen")}, "year": {N: aws.String("1970")}, "genres": {SS: aws.StringSlice([]string{"rock", "glam"})}},
+		{"artist": {S: aws.String("Muse")}, "year": {N: aws.String("1994")}},
+		{"artist": {S: aws.String("Blur")}, "year": {N: aws.String("1988")}},
+	}
+	to := []map[string]*dynamodb.AttributeValue{
+		// Same sets in another order
+		{"artist": {S: aws.String("Queen")}, "year": {N: aws.String("1970")}, "genres": {SS: aws.StringSlice([]string{"glam", "rock"})}},
+		{"artist": {S: aws.String("Muse")}, "year": {N: aws.String("1995")}, "label": {S: aws.String("Warner")}},
+		{"artist": {S: aws.String("Oasis")}, "year": {N: aws.String("1991")}},
+	}
+	for _, item := range from {
+		if err := differ.AddFrom(item); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	for _, item := range to {
+		if err := differ.CompareTo(item); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := differ.CompareTo(map[string]*dynamodb.AttributeValue{"year": {N: aws.String("1991")}}); err == nil {
+		t.Fatal("Expecting an error for an item without key")
+	}
+
+	report := differ.Report()
+	if report.Identical() {
+		t.Fatal("Expecting differences")
+	}
+	if report.Summary != (DiffSummary{Added: 1, Removed: 1, Modified: 1, Unchanged: 1}) {
+		t.Fatalf("Unexpected summary %+v", report.Summary)
+	}
+	if len(report.Added) != 1 || *report.Added[0].Key["artist"].S != "Oasis" {
+		t.Fatalf("Expecting Oasis to be added. Got: %+v", report.Added)
+	}
+	if len(report.Removed) != 1 || *report.Removed[0].Key["artist"].S != "Blur" {
+		t.Fatalf("Expecting Blur to be removed. Got: %+v", report.Removed)
+	}
+	if len(report.Modified) != 1 || *report.Modified[0].Key["artist"].S != "Muse" {
+		t.Fatalf("Expecting Muse to be modified. Got: %+v", report.Modified)
+	}
+	changes := report.Modified[0].Changes
+	if len(changes) != 2 || changes[0].Attribute != "label" || changes[0].From != nil || *changes[0].To.S != "Warner" ||
+		changes[1].Attribute != "year" || *changes[1].From.N != "1994" || *changes[1].To.N != "1995" {
+		t.Fatalf("Unexpected changes %+v", changes)
+	}
+}
+
+func TestBackupItemsEmptyList(t *testing.T) {
+	location := "file://" + t.TempDir()
+	ctx := context.Background()
+	item := map[string]*dynamodb.AttributeValue{"artist": {S: aws.String("Queen")}, "albums": {L: []*dynamodb.AttributeValue{}}}
+	line, err := MarshalDynamoAttributeMap(item)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	h := &AwsHelper{}
+	if err := h.DumpBuffer(ctx, location, "backup", bytes.NewBuffer(append(line, '\n')), 1); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := h.manifestToS3(ctx, location, "backup", false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The item of the backup is identical to the one backed up
+	def := &TableDefinition{TableName: "myTable", KeySchema: []KeyDefinition{{AttributeName: "artist", KeyType: "HASH"}}}
+	differ := NewDiffer(def, "backup", "table")
+	if err := (&AwsHelper{}).BackupItems(ctx, location, "backup", differ.AddFrom); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := differ.CompareTo(item); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if report := differ.Report(); !report.Identical() {
+		t.Fatalf("Expecting no difference, got %+v", report.Summary)
+	}
+}
@@ -16,6 +16,7 @@ limitations under the License.
 package core
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
@@ -29,41 +30,57 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
 )
 
-// dynamoErrorCheck checks for the error output and waits the given waitError in
-// case of ProvisionedThroughputExceededException
-func dynamoErrorCheck(err error, waitError time.Duration) error {
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case dynamodb.ErrCodeProvisionedThroughputExceededException:
-				log.Printf("[WARNING] ProvisionedThroughputExceededException encountered, will wait %d before retrying: %s", waitError, aerr.Error())
-				// This one is recoverable, just wait the waitTime before retrying
-				time.Sleep(waitError)
-			default:
-				return aerr
-			}
-		} else {
-			return err
-		}
-	}
-	return nil
-}
-
 // AwsHelper supports a set of helpers around DynamoDB and s3
 type AwsHelper struct {
-	AwsSession client.ConfigProvider
-	DynamoSvc  dynamodbiface.DynamoDBAPI
-	Wg         sync.WaitGroup
-	DataPipe   chan map[string]*dynamodb.AttributeValue
-	ManifestS3 S3Manifest
-	RoleCreds  credentials.Credentials
+	AwsSession  client.ConfigProvider
+	DynamoSvc   dynamodbiface.DynamoDBAPI
+	StreamsSvc  StreamsAPI
+	Wg          sync.WaitGroup
+	DataPipe    chan map[string]*dynamodb.AttributeValue
+	ManifestS3  S3Manifest
+	RoleCreds   *credentials.Credentials
+	Progress    *ScanProgress
+	Compression string
+	Keys        KeyProvider
+	Upload      S3UploadOptions
+	// ReadLimiter and WriteLimiter replace the wait periods between batches
+	// when set
+	ReadLimiter  *CapacityLimiter
+	WriteLimiter *CapacityLimiter
+	// DeadLetter receives the items rejected by the table, if set
+	DeadLetter *DeadLetter
+	// Conflicts switches the writes to conditional writes, if set
+	Conflicts *ConflictPolicy
+	// SyncKeys records the keys of the items sent to the channel, if set
+	SyncKeys *KeySet
+	// DryRun skips the writes to the table
+	DryRun bool
+	// Transform is applied to the items before sending them to the channel,
+	// if set
+	Transform *Transform
+	// KeyRemap computes the key attributes of the restored items once
+	// transformed, if set
+	KeyRemap *KeyRemap
+	// ShutdownTimeout is the time given to ChannelToS3 to flush its data once
+	// its context is done
+	ShutdownTimeout time.Duration
+	// StopScan is called by the consumer of the channel once it fails, so the
+	// scan feeding the channel stops instead of being drained, if set
+	StopScan context.CancelFunc
+	// scanErr is the error of the last TableToChannel, set before the channel
+	// is closed
+	scanErr error
+	// Retry is the policy used to retry the failing AWS calls, it can be
+	// shared between several AwsHelper to report all their retries together
+	Retry *RetryPolicy
 }
 
 // NewAwsHelper creates a new AwsHelper, initializing an AWS session and a few
 // objects like a channel or a DynamoDB client
-func NewAwsHelper(region, accountID, accountRole string) *AwsHelper {
+func NewAwsHelper(region, accountID, accountRole string) (*AwsHelper, error) {
 	awsSess, err := session.NewSessionWithOptions(session.Options{
 		// Provide SDK Config options, such as Region.
 		Config: aws.Config{
@@ -75,39 +92,119 @@ func NewAwsHelper(region, accountID, accountRole string) *AwsHelper {
 	})
 
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	dataPipe := make(chan map[string]*dynamodb.AttributeValue)
 
 	var dynamoSvc dynamodbiface.DynamoDBAPI
-	var creds credentials.Credentials
+	var streamsSvc StreamsAPI
+	var creds *credentials.Credentials
 
 	if accountID != "" {
 		arn := "arn:aws:iam::" + accountID + ":role/" + accountRole
-		creds = *stscreds.NewCredentials(awsSess, arn)
-		dynamoSvc = dynamodb.New(awsSess, &aws.Config{Credentials: &creds})
+		creds = stscreds.NewCredentials(awsSess, arn)
+		dynamoSvc = dynamodb.New(awsSess, &aws.Config{Credentials: creds})
+		streamsSvc = dynamodbstreams.New(awsSess, &aws.Config{Credentials: creds})
 	} else {
 		dynamoSvc = dynamodb.New(awsSess)
+		streamsSvc = dynamodbstreams.New(awsSess)
+	}
+	return &AwsHelper{AwsSession: awsSess, DataPipe: dataPipe, DynamoSvc: dynamoSvc, StreamsSvc: streamsSvc, RoleCreds: creds, Retry: NewRetryPolicy()}, nil
+}
+
+// waitPolicy is shared by all the scan workers of a table so they pace
+// themselves with the same wait period, or the same capacity limiter, and all
+// back off together when one of them gets throttled
+type waitPolicy struct {
+	period  time.Duration
+	limiter *CapacityLimiter
+	retry   *RetryPolicy
+	mu      sync.Mutex
+}
+
+// wait sleeps the wait period between two pages, or until the limiter allows
+// the next page, plus as long as another worker is backing off
+func (p *waitPolicy) wait() {
+	if p.limiter != nil {
+		p.limiter.Wait()
+	} else {
+		time.Sleep(p.period)
+	}
+	p.mu.Lock()
+	p.mu.Unlock()
+}
+
+// check returns nil if the scan can be retried after the given error, while
+// holding the policy so the backoff applies to every worker
+func (p *waitPolicy) check(r *retrier, err error) error {
+	if err == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r.retry(err) {
+		return nil
 	}
-	return &AwsHelper{AwsSession: awsSess, DataPipe: dataPipe, DynamoSvc: dynamoSvc, RoleCreds: creds}
+	return r.giveUp(err)
 }
 
 // TableToChannel scans an entire DynamoDB table, putting all the output records to a
-// given channel and increment a given wait group
-func (h *AwsHelper) TableToChannel(tableName string, batchSize int64, waitPeriod time.Duration) error {
+// given channel and increment a given wait group. When segments is greater
+// than 1, the table is scanned by as many parallel workers, each of them
+// taking care of one Segment of the TotalSegments. The scan stops as soon as
+// the context is done, returning its error
+func (h *AwsHelper) TableToChannel(ctx context.Context, tableName string, batchSize int64, waitPeriod time.Duration, segments int64) error {
 	h.Wg.Add(1)
+	h.scanErr = nil
 
-	var errChk error
-	stopScan := false
-	var lastEvaluatedKey map[string]*dynamodb.AttributeValue
-	// var results []map[string]*dynamodb.AttributeValue
+	if segments < 1 {
+		segments = 1
+	}
+	policy := &waitPolicy{period: waitPeriod, limiter: h.ReadLimiter, retry: h.retryPolicy()}
+	errs := make(chan error, segments)
+	var scanWg sync.WaitGroup
+	for segment := int64(0); segment < segments; segment++ {
+		scanWg.Add(1)
+		go func(segment int64) {
+			defer scanWg.Done()
+			errs <- h.scanSegment(ctx, tableName, batchSize, segment, segments, policy)
+		}(segment)
+	}
+	scanWg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil && h.scanErr == nil {
+			h.scanErr = tableError(tableName, err)
+		}
+	}
+	// The consumer of the channel checks scanErr once it is closed
+	close(h.DataPipe)
+	return h.scanErr
+}
+
+// scanSegment scans one segment of a table to the channel. If totalSegments is
+// 1, the whole table is scanned without using the Segment parameters
+func (h *AwsHelper) scanSegment(ctx context.Context, tableName string, batchSize, segment, totalSegments int64, policy *waitPolicy) error {
+	// Starts from the last checkpoint if the backup is resumed. The items
+	// following lastEvaluatedKey that were already sent are skipped, be it
+	// by the interrupted backup or before a retry
+	lastEvaluatedKey, sent, stopScan := h.Progress.segment(segment)
+	if stopScan {
+		log.Printf("Segment: %d/%d already scanned, skipping", segment+1, totalSegments)
+	}
+	r := policy.retry.newRetrier(ctx, "Scan")
+	var transformErr error
 	// Looping to recover on errors
 	for !stopScan {
 		params := &dynamodb.ScanInput{
 			TableName:              aws.String(tableName),
 			ReturnConsumedCapacity: aws.String("TOTAL"),
 		}
+		if totalSegments > 1 {
+			params.Segment = aws.Int64(segment)
+			params.TotalSegments = aws.Int64(totalSegments)
+		}
 
 		// Limit only accepts an int64 >= 1
 		if batchSize > 0 {
@@ -118,30 +215,59 @@ func (h *AwsHelper) TableToChannel(tableName string, batchSize int64, waitPeriod
 			params.ExclusiveStartKey = lastEvaluatedKey
 		}
 
-		err := h.DynamoSvc.ScanPages(params,
+		skip := sent
+		err := h.DynamoSvc.ScanPagesWithContext(ctx, params,
 			func(page *dynamodb.ScanOutput, lastPage bool) bool {
-				log.Printf("Items: %d, Capacity consumed: %f", *page.Count, *page.ConsumedCapacity.CapacityUnits)
+				units := consumedUnits(page.ConsumedCapacity)
+				h.ReadLimiter.Consume(units)
+				log.Printf("Segment: %d/%d, Items: %d, Capacity consumed: %f", segment+1, totalSegments, *page.Count, units)
+				// An interrupted page is not marked as scanned, only the
+				// number of its items already sent is
 				for _, res := range page.Items {
-					h.DataPipe <- res
+					if skip > 0 {
+						skip--
+						continue
+					}
+					if transformErr = h.Transform.Apply(res); transformErr != nil {
+						return false
+					}
+					select {
+					case h.DataPipe <- res:
+						sent++
+						h.Progress.sent(segment)
+					case <-ctx.Done():
+						return false
+					}
 				}
-				time.Sleep(waitPeriod)
+				// The items left to skip follow the end of the page
+				lastEvaluatedKey = page.LastEvaluatedKey
+				sent = skip
 				stopScan = lastPage
+				h.Progress.update(segment, lastEvaluatedKey, sent, lastPage)
+				r.reset()
+				policy.wait()
 				return !lastPage
 			})
 
 		// Error handling
-		if errChk = dynamoErrorCheck(err, waitPeriod*2); errChk != nil {
-			break
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if transformErr != nil {
+			return transformErr
+		}
+		if errChk := policy.check(r, err); errChk != nil {
+			return errChk
 		}
 	}
-	close(h.DataPipe)
-	return errChk
+	return nil
 }
 
 // CheckTableEmpty checks if the table exists and is empty. Returns -1 if does
-// not exist, returns the number of items if exists and -10 in case of an error.
+// not exist, 1 if it holds items, 0 if it is empty and -10 in case of an error.
 // If the table status is not "ACTIVE", the returned number will be -2 for
-// "CREATING", -4 for "UPDATING", -8 for "DELETING"
+// "CREATING", -4 for "UPDATING", -8 for "DELETING". The items are looked for by
+// a scan, the item count of the table being only refreshed every 6 hours
 func (h *AwsHelper) CheckTableEmpty(tbl string) (int64, error) {
 	input := &dynamodb.DescribeTableInput{
 		TableName: aws.String(tbl),
@@ -157,7 +283,22 @@ func (h *AwsHelper) CheckTableEmpty(tbl string) (int64, error) {
 
 	switch *result.Table.TableStatus {
 	case "ACTIVE":
-		return *result.Table.ItemCount, nil
+		var count int64
+		err := h.retryPolicy().Do(context.Background(), "Scan", func() error {
+			page, err := h.DynamoSvc.ScanWithContext(context.Background(), &dynamodb.ScanInput{
+				TableName: aws.String(tbl),
+				Limit:     aws.Int64(1),
+				Select:    aws.String(dynamodb.SelectCount),
+			})
+			if err == nil {
+				count = aws.Int64Value(page.Count)
+			}
+			return err
+		})
+		if err != nil {
+			return -10, err
+		}
+		return count, nil
 	case "CREATING":
 		return -2, nil
 	case "UPDATING":
@@ -191,37 +332,125 @@ func (h *AwsHelper) channelToWriteRequests(batchSize, globalIndex int64) []*dyna
 	return dataReq
 }
 
-// batchToTable sends a BatchWriteItem to Dynamo
-func (h *AwsHelper) batchToTable(wRequest map[string][]*dynamodb.WriteRequest, waitRetry time.Duration) {
-	input := &dynamodb.BatchWriteItemInput{
-		ReturnConsumedCapacity: aws.String("TOTAL"),
-		RequestItems:           wRequest,
-	}
-	result, err := h.DynamoSvc.BatchWriteItem(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case dynamodb.ErrCodeProvisionedThroughputExceededException:
-				log.Printf("[WARNING] ProvisionedThroughputExceededException encountered. Waiting %d before retrying...\n", waitRetry)
-			case dynamodb.ErrCodeItemCollectionSizeLimitExceededException:
-				log.Println("[WARNING] An item collection is too large. This exception is only returned for tables that have one or more local secondary indexes. Skip collection.")
-			default:
-				log.Fatalf("[ERROR] unrecoverable error during batch write: %s\n", aerr.Error())
+// errUnprocessedItems is used to retry the UnprocessedItems of a BatchWriteItem
+var errUnprocessedItems = awserr.New(errCodeUnprocessedItems, "BatchWriteItem returned unprocessed items", nil)
+
+// batchToTable sends a BatchWriteItem to Dynamo, retrying the failed calls and
+// the UnprocessedItems with the retry policy of the helper
+func (h *AwsHelper) batchToTable(ctx context.Context, wRequest map[string][]*dynamodb.WriteRequest) error {
+	r := h.retryPolicy().newRetrier(ctx, "BatchWriteItem")
+	for len(wRequest) > 0 {
+		input := &dynamodb.BatchWriteItemInput{
+			ReturnConsumedCapacity: aws.String("TOTAL"),
+			RequestItems:           wRequest,
+		}
+		result, err := h.DynamoSvc.BatchWriteItemWithContext(ctx, input)
+		if err != nil {
+			if rejectedCodes[errorCode(err)] {
+				return err
+			}
+			h.WriteLimiter.Wait()
+			if r.retry(err) {
+				continue
+			}
+			for table := range wRequest {
+				err = tableError(table, err)
 			}
-		} else {
-			log.Fatalf("[ERROR] unrecoverable error during batch write: %s\n", aerr.Error())
+			return fmt.Errorf("unrecoverable error during batch write: %w", r.giveUp(err))
+		}
+
+		units := consumedUnits(result.ConsumedCapacity...)
+		h.WriteLimiter.Consume(units)
+		log.Printf("Unprocessed items: %d, Capacity consumed: %f\n", len(result.UnprocessedItems), units)
+		if len(result.UnprocessedItems) == 0 {
+			return nil
+		}
+		// Some items went through, the remaining ones get a fresh set of attempts
+		if writeRequestsCount(result.UnprocessedItems) < writeRequestsCount(wRequest) {
+			r.reset()
+		}
+		wRequest = result.UnprocessedItems
+		h.WriteLimiter.Wait()
+		if !r.retry(errUnprocessedItems) {
+			return fmt.Errorf("giving up on %d unprocessed items during batch write: %w", writeRequestsCount(wRequest), r.giveUp(errUnprocessedItems))
 		}
 	}
+	return nil
+}
+
+// rejectedCodes lists the error codes of the BatchWriteItem rejecting some of
+// its items, which can be isolated by writing them one by one
+var rejectedCodes = map[string]bool{
+	dynamodb.ErrCodeItemCollectionSizeLimitExceededException: true,
+	"ValidationException": true,
+}
 
-	log.Printf("Unprocessed items: %d, Capacity consumed: %f\n", len(result.UnprocessedItems), *(result.ConsumedCapacity[0].CapacityUnits))
-	if len(result.UnprocessedItems) > 0 {
-		time.Sleep(waitRetry)
-		h.batchToTable(result.UnprocessedItems, waitRetry)
+// writeBatch writes the given requests to the table, with conditional writes
+// if a ConflictPolicy is set. If the batch is rejected and a DeadLetter is
+// set, the requests are written one by one so that only the rejected ones are
+// sent to the DeadLetter, along with the given source
+func (h *AwsHelper) writeBatch(ctx context.Context, tableName string, reqs []*dynamodb.WriteRequest, source string) error {
+	if h.DryRun {
+		return nil
+	}
+	if h.Conflicts != nil {
+		return h.putItems(ctx, tableName, reqs, source)
+	}
+	err := h.batchToTable(ctx, map[string][]*dynamodb.WriteRequest{tableName: reqs})
+	switch {
+	case err == nil || !rejectedCodes[errorCode(err)]:
+		return err
+	case h.DeadLetter == nil || len(reqs) == 1:
+		if err := h.rejectItem(ctx, err, source, reqs[0].PutRequest.Item); err != nil {
+			return fmt.Errorf("unrecoverable error during batch write: %w", err)
+		}
+		return nil
 	}
+	for _, req := range reqs {
+		if err := h.writeBatch(ctx, tableName, []*dynamodb.WriteRequest{req}, source); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// ChannelToTable puts the data from the channel into the given Dynamo table
-func (h *AwsHelper) ChannelToTable(tableName string, batchSize int64, waitPeriod time.Duration, destination *AwsHelper) {
+// rejectItem sends an item rejected by the table with the given error to the
+// DeadLetter, if set. Without DeadLetter, the item collections too large are
+// skipped and the error is returned otherwise
+func (h *AwsHelper) rejectItem(ctx context.Context, err error, source string, item map[string]*dynamodb.AttributeValue) error {
+	code := errorCode(err)
+	switch {
+	case h.DeadLetter != nil:
+		log.Printf("[WARNING] Item rejected with %s, sent to the dead letter\n", code)
+		return h.DeadLetter.Add(ctx, code, source, item)
+	case code == dynamodb.ErrCodeItemCollectionSizeLimitExceededException:
+		log.Println("[WARNING] An item collection is too large. This exception is only returned for tables that have one or more local secondary indexes. Skip collection.")
+		return nil
+	}
+	return err
+}
+
+// writeRequestsCount returns the number of WriteRequests of a BatchWriteItem
+func writeRequestsCount(wRequest map[string][]*dynamodb.WriteRequest) int {
+	count := 0
+	for _, reqs := range wRequest {
+		count += len(reqs)
+	}
+	return count
+}
+
+// ChannelToTable puts the data from the channel into the given Dynamo table.
+// If the destination has a WriteLimiter, it paces the batches instead of the
+// wait period. If a batch fails or the context is done, the rest of the channel
+// is drained so its producer doesn't block, and the error is returned
+func (h *AwsHelper) ChannelToTable(ctx context.Context, tableName string, batchSize int64, waitPeriod time.Duration, destination *AwsHelper) error {
+	return h.channelToTable(ctx, tableName, batchSize, waitPeriod, destination, "")
+}
+
+// channelToTable is ChannelToTable, tracing the rejected items back to the
+// given source
+func (h *AwsHelper) channelToTable(ctx context.Context, tableName string, batchSize int64, waitPeriod time.Duration, destination *AwsHelper, source string) error {
+	defer h.Wg.Done()
 	var currentIdx int64
 	currentIdx = 0
 	for {
@@ -230,13 +459,33 @@ func (h *AwsHelper) ChannelToTable(tableName string, batchSize int64, waitPeriod
 		if reqSize == 0 {
 			break // Leaves if the queue is closed and no items were found
 		}
+		if err := ctx.Err(); err != nil {
+			h.drain()
+			return err
+		}
+		destination.WriteLimiter.Wait()
 		log.Printf("Sending %d items\n", reqSize)
-		destination.batchToTable(map[string][]*dynamodb.WriteRequest{tableName: dataReq}, waitPeriod*2)
+		if err := destination.writeBatch(ctx, tableName, dataReq, source); err != nil {
+			h.drain()
+			return err
+		}
 		currentIdx += int64(reqSize)
 		if currentIdx >= batchSize {
-			time.Sleep(waitPeriod)
+			if destination.WriteLimiter == nil {
+				time.Sleep(waitPeriod)
+			}
 			currentIdx = 0
 		}
 	}
-	h.Wg.Done()
+	return nil
+}
+
+// drain empties the channel until it is closed, so its producer doesn't block.
+// The scan feeding the channel is stopped first if StopScan is set
+func (h *AwsHelper) drain() {
+	if h.StopScan != nil {
+		h.StopScan()
+	}
+	for range h.DataPipe {
+	}
 }
@@ -16,13 +16,19 @@ limitations under the License.
 package core
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 )
@@ -39,7 +45,7 @@ type mockDynamoDBClient struct {
 	dynamodbiface.DynamoDBAPI
 }
 
-func (m *mockDynamoDBClient) ScanPages(params *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool) error {
+func (m *mockDynamoDBClient) ScanPagesWithContext(ctx aws.Context, params *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
 	dsSize := int64(len(dataSet))
 	dataOut := dynamodb.ScanOutput{
 		ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(23), TableName: params.TableName},
@@ -62,31 +68,321 @@ func TestTableToChannel(t *testing.T) {
 		idx := 0
 		for elem := range h.DataPipe {
 			if !reflect.DeepEqual(elem, dataSet[idx]) {
-				t.Fatalf("Element %d in the channel mismatch. Expecting: %v\nGot: %v\n", idx, dataSet[idx], elem)
+				t.Errorf("Element %d in the channel mismatch. Expecting: %v\nGot: %v\n", idx, dataSet[idx], elem)
 			}
 			idx++
 		}
 		// Checks that all the elements of the dataSet have been parsed
 		if idx != len(dataSet) {
-			t.Fatalf("Size of the dataSet is %d, only got %d elements from the channel\n", len(dataSet), idx)
+			t.Errorf("Size of the dataSet is %d, only got %d elements from the channel\n", len(dataSet), idx)
 		}
 		h.Wg.Done()
 	}()
 
-	h.TableToChannel("myTable", 10, time.Duration(42)*time.Millisecond)
+	h.TableToChannel(context.Background(), "myTable", 10, time.Duration(42)*time.Millisecond, 1)
+	h.Wg.Wait()
 }
 
-func TestDynamoErrorCheck(t *testing.T) {
-	errorTest := []struct{ inputErr, expectedOut error }{
-		{inputErr: nil, expectedOut: nil},
-		{inputErr: fmt.Errorf("Random error"), expectedOut: fmt.Errorf("Random error")},
-		{inputErr: awserr.New(dynamodb.ErrCodeInternalServerError, "Bla bla", nil), expectedOut: awserr.New(dynamodb.ErrCodeInternalServerError, "Bla bla", nil)},
-		{inputErr: awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "Bla bla", nil), expectedOut: nil},
+// struct to mock the Dynamo calls of a segmented scan, each segment returning
+// the element of the dataSet at the same index
+type mockSegmentedDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	mu       sync.Mutex
+	segments []int64
+}
+
+func (m *mockSegmentedDynamoDBClient) ScanPagesWithContext(ctx aws.Context, params *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	if params.Segment == nil || params.TotalSegments == nil || *params.TotalSegments != int64(len(dataSet)) {
+		return fmt.Errorf("Unexpected segment parameters: %v", params)
+	}
+	m.mu.Lock()
+	m.segments = append(m.segments, *params.Segment)
+	m.mu.Unlock()
+	dataOut := dynamodb.ScanOutput{
+		ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1), TableName: params.TableName},
+		Count:            aws.Int64(1),
+		Items:            dataSet[*params.Segment : *params.Segment+1],
+	}
+	pager(&dataOut, true)
+	return nil
+}
+
+func TestTableToChannelSegments(t *testing.T) {
+	h := AwsHelper{}
+
+	mock := &mockSegmentedDynamoDBClient{}
+	h.DynamoSvc = mock
+	h.DataPipe = make(chan map[string]*dynamodb.AttributeValue)
+
+	received := []map[string]*dynamodb.AttributeValue{}
+	go func() {
+		for elem := range h.DataPipe {
+			received = append(received, elem)
+		}
+		h.Wg.Done()
+	}()
+
+	if err := h.TableToChannel(context.Background(), "myTable", 10, time.Millisecond, int64(len(dataSet))); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	h.Wg.Wait()
+
+	if len(mock.segments) != len(dataSet) {
+		t.Fatalf("Expecting %d segments to be scanned, got %v", len(dataSet), mock.segments)
+	}
+	if len(received) != len(dataSet) {
+		t.Fatalf("Expecting %d elements from the channel, got %d", len(dataSet), len(received))
+	}
+	for _, expected := range dataSet {
+		found := false
+		for _, elem := range received {
+			if reflect.DeepEqual(elem, expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Element %v missing from the channel", expected)
+		}
+	}
+}
+
+// struct to mock the BatchWriteItem calls, throttling the first call and
+// leaving one unprocessed item on the second one
+type mockBatchDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	calls   int
+	written int
+}
+
+func (m *mockBatchDynamoDBClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	m.calls++
+	if m.calls == 1 {
+		return nil, awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "Bla bla", nil)
+	}
+	out := &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]*dynamodb.WriteRequest{}}
+	for table, reqs := range input.RequestItems {
+		if m.calls == 2 && len(reqs) > 1 {
+			out.UnprocessedItems[table] = reqs[len(reqs)-1:]
+			reqs = reqs[:len(reqs)-1]
+		}
+		m.written += len(reqs)
+	}
+	return out, nil
+}
+
+func TestBatchToTableRetries(t *testing.T) {
+	mock := &mockBatchDynamoDBClient{}
+	retry := NewRetryPolicy()
+	retry.sleep = func(time.Duration) {}
+	h := &AwsHelper{DynamoSvc: mock, Retry: retry}
+
+	reqs := []*dynamodb.WriteRequest{}
+	for i := 0; i < 3; i++ {
+		item := map[string]*dynamodb.AttributeValue{"id": {N: aws.String(fmt.Sprint(i))}}
+		reqs = append(reqs, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+	}
+	h.batchToTable(context.Background(), map[string][]*dynamodb.WriteRequest{"myTable": reqs})
+
+	if mock.calls != 3 || mock.written != 3 {
+		t.Fatalf("Expecting 3 calls writing 3 items, got %d calls writing %d items", mock.calls, mock.written)
+	}
+	expected := map[string]map[string]int64{"BatchWriteItem": {
+		dynamodb.ErrCodeProvisionedThroughputExceededException: 1,
+		errCodeUnprocessedItems:                                1,
+	}}
+	if retries := retry.Retries(); !reflect.DeepEqual(retries, expected) {
+		t.Fatalf("Expecting retries %v, got %v", expected, retries)
+	}
+}
+
+// struct to mock the BatchWriteItem calls, rejecting the batches holding the
+// Queen
+type mockRejectingDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	written int
+}
+
+func (m *mockRejectingDynamoDBClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	for _, reqs := range input.RequestItems {
+		for _, req := range reqs {
+			if aws.StringValue(req.PutRequest.Item["artist"].S) == "Queen" {
+				return nil, awserr.New("ValidationException", "Bla bla", nil)
+			}
+		}
+		m.written += len(reqs)
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func TestWriteBatchDeadLetter(t *testing.T) {
+	reqs := []*dynamodb.WriteRequest{}
+	for _, item := range dataSet {
+		reqs = append(reqs, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+	}
+
+	mock := &mockRejectingDynamoDBClient{}
+	h := &AwsHelper{DynamoSvc: mock}
+	if err := h.writeBatch(context.Background(), "myTable", reqs, "s3://bucket/file"); err == nil {
+		t.Fatal("Expecting an error without dead letter")
+	}
+
+	h.DeadLetter = NewDeadLetter(&AwsHelper{}, "bucket", "dead-letter")
+	if err := h.writeBatch(context.Background(), "myTable", reqs, "s3://bucket/file"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if mock.written != len(dataSet)-1 || h.DeadLetter.Count() != 1 {
+		t.Fatalf("Expecting %d items written and 1 rejected, got %d and %d", len(dataSet)-1, mock.written, h.DeadLetter.Count())
+	}
+	buffer := h.DeadLetter.buffers[deadLetterKey{code: "ValidationException", source: "s3://bucket/file"}]
+	if buffer == nil || buffer.itemCount != 1 || !bytes.Contains(buffer.buff.Bytes(), []byte("Queen")) {
+		t.Fatalf("Expecting the Queen in the dead letter, got %v", h.DeadLetter.buffers)
+	}
+}
+
+// struct to mock the Dynamo calls always failing with the same error
+type mockFailingDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	err error
+}
+
+func (m *mockFailingDynamoDBClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	return nil, m.err
+}
+
+func (m *mockFailingDynamoDBClient) ScanPagesWithContext(ctx aws.Context, params *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	return m.err
+}
+
+func TestTypedErrors(t *testing.T) {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "Bla bla", nil)
+	notFound := awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Bla bla", nil)
+	reqs := map[string][]*dynamodb.WriteRequest{"myTable": {{PutRequest: &dynamodb.PutRequest{Item: dataSet[0]}}}}
+	newHelper := func(err error) *AwsHelper {
+		retry := NewRetryPolicy()
+		retry.MaxAttempts = 2
+		retry.sleep = func(time.Duration) {}
+		return &AwsHelper{DynamoSvc: &mockFailingDynamoDBClient{err: err}, Retry: retry, DataPipe: make(chan map[string]*dynamodb.AttributeValue)}
+	}
+
+	var throttling *ThrottlingError
+	if err := newHelper(throttled).batchToTable(context.Background(), reqs); !errors.As(err, &throttling) || throttling.Attempts != 2 {
+		t.Errorf("Expecting a ThrottlingError after 2 attempts, got %v", err)
+	}
+	if err := newHelper(notFound).batchToTable(context.Background(), reqs); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Expecting ErrTableNotFound, got %v", err)
+	}
+
+	h := newHelper(notFound)
+	go func() {
+		for range h.DataPipe {
+		}
+	}()
+	if err := h.TableToChannel(context.Background(), "myTable", 10, time.Millisecond, 2); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Expecting ErrTableNotFound from the scan, got %v", err)
+	}
+}
+
+// struct to mock the Dynamo calls, scanning an endless table
+type mockEndlessDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func (m *mockEndlessDynamoDBClient) ScanPagesWithContext(ctx aws.Context, params *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	for ctx.Err() == nil {
+		dataOut := dynamodb.ScanOutput{Count: aws.Int64(int64(len(dataSet))), Items: dataSet}
+		if !pager(&dataOut, false) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestTableToChannelCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &AwsHelper{DynamoSvc: &mockEndlessDynamoDBClient{}, DataPipe: make(chan map[string]*dynamodb.AttributeValue)}
+	go func() {
+		received := 0
+		for range h.DataPipe {
+			if received++; received == 10 {
+				cancel()
+			}
+		}
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- h.TableToChannel(ctx, "myTable", 10, time.Millisecond, 2)
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expecting the scan to be canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The scan didn't stop once canceled")
+	}
+}
+
+// struct to mock the Dynamo calls, recording the scan parameters
+type mockResumedDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	mu     sync.Mutex
+	params []*dynamodb.ScanInput
+}
+
+func (m *mockResumedDynamoDBClient) ScanPagesWithContext(ctx aws.Context, params *dynamodb.ScanInput, pager func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	m.mu.Lock()
+	m.params = append(m.params, params)
+	m.mu.Unlock()
+	dataOut := dynamodb.ScanOutput{
+		ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1), TableName: params.TableName},
+		Count:            aws.Int64(0),
+	}
+	pager(&dataOut, true)
+	return nil
+}
+
+func TestTableToChannelResume(t *testing.T) {
+	startKey := map[string]*dynamodb.AttributeValue{"artist": {S: aws.String("Queen")}}
+	checkpoint := S3Checkpoint{
+		TableName:     "myTable",
+		TotalSegments: 2,
+		Segments: []S3CheckpointSegment{
+			{Segment: 0, LastEvaluatedKey: toCustomAttributeMap(startKey)},
+			{Segment: 1, Done: true},
+		},
+	}
+	// Goes through json as when the checkpoint is loaded from s3
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	loaded := &S3Checkpoint{}
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	mock := &mockResumedDynamoDBClient{}
+	h := AwsHelper{DynamoSvc: mock, DataPipe: make(chan map[string]*dynamodb.AttributeValue), Progress: ResumeScanProgress(loaded)}
+	go func() {
+		for range h.DataPipe {
+		}
+		h.Wg.Done()
+	}()
+	if err := h.TableToChannel(context.Background(), "myTable", 10, time.Millisecond, 2); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	h.Wg.Wait()
+
+	if len(mock.params) != 1 {
+		t.Fatalf("Expecting only the unfinished segment to be scanned, got %d scans", len(mock.params))
+	}
+	if *mock.params[0].Segment != 0 || !reflect.DeepEqual(mock.params[0].ExclusiveStartKey, startKey) {
+		t.Fatalf("Expecting segment 0 to start from %v, got segment %d from %v", startKey, *mock.params[0].Segment, mock.params[0].ExclusiveStartKey)
 	}
-	for _, item := range errorTest {
-		returnedOut := dynamoErrorCheck(item.inputErr, 1)
-		if !reflect.DeepEqual(returnedOut, item.expectedOut) {
-			t.Fatalf("Input %v should return %v. Got: %v\n", item.inputErr, item.expectedOut, returnedOut)
+	for _, seg := range h.Progress.Checkpoint(S3Manifest{}).Segments {
+		if !seg.Done {
+			t.Fatalf("Segment %d should be marked as done", seg.Segment)
 		}
 	}
 }
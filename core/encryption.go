@@ -0,0 +1,229 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+const (
+	// EncryptionAlgorithm is the algorithm used to encrypt the backup files
+	EncryptionAlgorithm = "AES-256-GCM"
+	// localKeyIDPrefix prefixes the ID of the keys read from a local file
+	localKeyIDPrefix = "local:"
+	// encryptedExtension is added to the name of the encrypted files
+	encryptedExtension = ".enc"
+	dataKeySize        = 32
+	gcmNonceSize       = 12
+)
+
+// S3EncryptionInfo holds what is needed to decrypt a backup file, given access
+// to the key that wrapped its data key
+type S3EncryptionInfo struct {
+	Algorithm  string `json:"algorithm"`
+	KeyID      string `json:"keyId"`
+	WrappedKey []byte `json:"wrappedKey"`
+	Nonce      []byte `json:"nonce"`
+}
+
+// KeyProvider wraps and unwraps the data keys used to encrypt each backup file
+type KeyProvider interface {
+	// WrapKey encrypts the given data key, returning the wrapped key and the
+	// ID of the key used to wrap it
+	WrapKey(dataKey []byte) ([]byte, string, error)
+	// UnwrapKey decrypts a data key wrapped by the given key ID
+	UnwrapKey(wrappedKey []byte, keyID string) ([]byte, error)
+}
+
+// sealGCM encrypts the given data with AES-GCM, authenticating the additional
+// data along with it, and returns the nonce and the ciphertext
+func sealGCM(key, data, additionalData []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, data, additionalData), nil
+}
+
+// openGCM decrypts and authenticates the given ciphertext and additional data
+// with AES-GCM
+func openGCM(key, nonce, data, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, data, additionalData)
+}
+
+// LocalKeyProvider wraps the data keys with a 256 bits key read from a local
+// file
+type LocalKeyProvider struct {
+	key   []byte
+	keyID string
+}
+
+// NewLocalKeyProvider reads a 256 bits key from the given file. The key can be
+// stored raw, hex or base64 encoded
+func NewLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := data
+	if len(key) != dataKeySize {
+		text := strings.TrimSpace(string(data))
+		if key, err = hex.DecodeString(text); err != nil || len(key) != dataKeySize {
+			if key, err = base64.StdEncoding.DecodeString(text); err != nil || len(key) != dataKeySize {
+				return nil, fmt.Errorf("The key file %s must contain a 256 bits key, raw, hex or base64 encoded", path)
+			}
+		}
+	}
+	// The fingerprint of the key identifies it without disclosing it
+	fingerprint := sha256.Sum256(key)
+	return &LocalKeyProvider{key: key, keyID: localKeyIDPrefix + hex.EncodeToString(fingerprint[:8])}, nil
+}
+
+// WrapKey encrypts the data key with the local key
+func (p *LocalKeyProvider) WrapKey(dataKey []byte) ([]byte, string, error) {
+	nonce, wrapped, err := sealGCM(p.key, dataKey, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return append(nonce, wrapped...), p.keyID, nil
+}
+
+// UnwrapKey decrypts a data key wrapped with the local key
+func (p *LocalKeyProvider) UnwrapKey(wrappedKey []byte, keyID string) ([]byte, error) {
+	if keyID != p.keyID {
+		return nil, fmt.Errorf("The data key was wrapped by the key %s, not by the provided key %s", keyID, p.keyID)
+	}
+	if len(wrappedKey) < gcmNonceSize {
+		return nil, fmt.Errorf("The wrapped data key is too short")
+	}
+	return openGCM(p.key, wrappedKey[:gcmNonceSize], wrappedKey[gcmNonceSize:], nil)
+}
+
+// KMSKeyProvider wraps the data keys with a KMS key (or any service
+// implementing the KMS API)
+type KMSKeyProvider struct {
+	svc   kmsiface.KMSAPI
+	keyID string
+}
+
+// NewKMSKeyProvider creates a KMSKeyProvider using the session of the given
+// AwsHelper. The keyID is only needed to wrap keys, KMS finds the key by
+// itself when unwrapping
+func NewKMSKeyProvider(h *AwsHelper, keyID string) *KMSKeyProvider {
+	svc := kms.New(h.AwsSession)
+	if h.RoleCreds != nil {
+		svc = kms.New(h.AwsSession, &aws.Config{Credentials: h.RoleCreds})
+	}
+	return &KMSKeyProvider{svc: svc, keyID: keyID}
+}
+
+// WrapKey encrypts the data key with the KMS key
+func (p *KMSKeyProvider) WrapKey(dataKey []byte) ([]byte, string, error) {
+	if p.keyID == "" {
+		return nil, "", fmt.Errorf("A KMS key ID is required to encrypt the data keys")
+	}
+	result, err := p.svc.Encrypt(&kms.EncryptInput{KeyId: aws.String(p.keyID), Plaintext: dataKey})
+	if err != nil {
+		return nil, "", err
+	}
+	return result.CiphertextBlob, aws.StringValue(result.KeyId), nil
+}
+
+// UnwrapKey decrypts a data key wrapped with a KMS key
+func (p *KMSKeyProvider) UnwrapKey(wrappedKey []byte, keyID string) ([]byte, error) {
+	if strings.HasPrefix(keyID, localKeyIDPrefix) {
+		return nil, fmt.Errorf("The data key was wrapped by the local key %s, the key file is required", keyID)
+	}
+	result, err := p.svc.Decrypt(&kms.DecryptInput{CiphertextBlob: wrappedKey, KeyId: aws.String(keyID)})
+	if err != nil {
+		return nil, err
+	}
+	return result.Plaintext, nil
+}
+
+// encrypt encrypts the given data with a new data key, wrapped by the given
+// key provider. The data is bound to the name of its file, so that it can't
+// be passed off as the content of another file
+func encrypt(keys KeyProvider, data []byte, fileName string) ([]byte, *S3EncryptionInfo, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, err
+	}
+	nonce, encrypted, err := sealGCM(dataKey, data, []byte(fileName))
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, keyID, err := keys.WrapKey(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encrypted, &S3EncryptionInfo{Algorithm: EncryptionAlgorithm, KeyID: keyID, WrappedKey: wrapped, Nonce: nonce}, nil
+}
+
+// decryptReader reads and decrypts the whole content of the given reader, which
+// must have been encrypted for the given file name
+func decryptReader(keys KeyProvider, info *S3EncryptionInfo, r io.ReadCloser, fileName string) (io.ReadCloser, error) {
+	defer r.Close()
+	if keys == nil {
+		return nil, fmt.Errorf("The file is encrypted with the key %s but no key was provided", info.KeyID)
+	}
+	if info.Algorithm != EncryptionAlgorithm {
+		return nil, fmt.Errorf("Unsupported encryption algorithm %s", info.Algorithm)
+	}
+	dataKey, err := keys.UnwrapKey(info.WrappedKey, info.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openGCM(dataKey, info.Nonce, encrypted, []byte(fileName))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyFile writes a key file in a temporary directory
+func writeKeyFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unable to write the key file: %s", err)
+	}
+	return path
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keys, err := NewLocalKeyProvider(writeKeyFile(t, "key.hex", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	otherKeys, err := NewLocalKeyProvider(writeKeyFile(t, "key.b64", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := NewLocalKeyProvider(writeKeyFile(t, "key.short", "too short")); err == nil {
+		t.Fatalf("A key that is not 256 bits long should be rejected")
+	}
+
+	data := []byte("{\"artist\":{\"s\":\"Queen\"}}\n")
+	encrypted, info, err := encrypt(keys, data, "file.gz.enc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bytes.Contains(encrypted, []byte("Queen")) || info.Algorithm != EncryptionAlgorithm {
+		t.Fatalf("The data is not encrypted: %s, %v", encrypted, info)
+	}
+
+	r, err := decryptReader(keys, info, ioutil.NopCloser(bytes.NewReader(encrypted)), "file.gz.enc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if out, _ := ioutil.ReadAll(r); !bytes.Equal(out, data) {
+		t.Fatalf("Decrypted data mismatch. Expecting: %s\nGot: %s\n", data, out)
+	}
+
+	if _, err := decryptReader(keys, info, ioutil.NopCloser(bytes.NewReader(encrypted)), "other.gz.enc"); err == nil {
+		t.Fatalf("Decrypting the data of another file should fail")
+	}
+	if _, err := decryptReader(otherKeys, info, ioutil.NopCloser(bytes.NewReader(encrypted)), "file.gz.enc"); err == nil {
+		t.Fatalf("Decrypting with another key should fail")
+	}
+	encrypted[0] ^= 0xff
+	if _, err := decryptReader(keys, info, ioutil.NopCloser(bytes.NewReader(encrypted)), "file.gz.enc"); err == nil {
+		t.Fatalf("Decrypting altered data should fail")
+	}
+}
+
+func TestEncryptedFile(t *testing.T) {
+	keys, err := NewLocalKeyProvider(writeKeyFile(t, "key.hex", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	dir := t.TempDir()
+	location := "file://" + dir
+	ctx := context.Background()
+
+	h := &AwsHelper{Compression: CompressionGzip, Keys: keys}
+	for _, artist := range []string{"Queen", "Muse"} {
+		buff := bytes.NewBufferString("{\"artist\":{\"S\":\"" + artist + "\"}}\n")
+		if err := h.DumpBuffer(ctx, location, "backup", buff, 1); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	entry := h.ManifestS3.Entries[0]
+	if !strings.HasSuffix(entry.URL, ".gz.enc") {
+		t.Fatalf("Expecting the .gz.enc extension, got %s", entry.URL)
+	}
+	location, key, _ := splitStorageURL(entry.URL)
+	if _, err := h.entryReader(ctx, location, key, entry); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The content of a file can't be swapped with another one, the key of a
+	// local file being its path
+	other := h.ManifestS3.Entries[1]
+	_, otherKey, _ := splitStorageURL(other.URL)
+	if err := os.Rename(otherKey, key); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	entry.SHA256, entry.Size, entry.Encryption = other.SHA256, other.Size, other.Encryption
+	if _, err := h.entryReader(ctx, location, key, entry); err == nil {
+		t.Fatal("Expecting an error when decrypting the content of another file")
+	}
+}
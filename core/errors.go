@@ -0,0 +1,98 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	// ErrManifestNotFound is returned when the manifest of a backup can't be
+	// found in the given folder
+	ErrManifestNotFound = errors.New("manifest not found")
+	// ErrTableNotFound is returned when a DynamoDB table does not exist
+	ErrTableNotFound = errors.New("table not found")
+	// ErrChangesTrimmed is returned when changes following the position
+	// reached by the previous incremental backup were trimmed from the stream
+	ErrChangesTrimmed = errors.New("changes trimmed from the stream")
+)
+
+// throttlingCodes lists the error codes returned when a call is throttled
+var throttlingCodes = map[string]bool{
+	dynamodb.ErrCodeProvisionedThroughputExceededException: true,
+	dynamodb.ErrCodeRequestLimitExceeded:                   true,
+	"ThrottlingException":                                  true,
+	"LimitExceededException":                               true,
+	"SlowDown":                                             true,
+	errCodeUnprocessedItems:                                true,
+}
+
+// ThrottlingError is returned when a call is still throttled once the retry
+// policy gave up on it
+type ThrottlingError struct {
+	Op       string
+	Code     string
+	Attempts int
+	Err      error
+}
+
+func (e *ThrottlingError) Error() string {
+	return fmt.Sprintf("%s still throttled after %d attempts: %s", e.Op, e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt
+func (e *ThrottlingError) Unwrap() error {
+	return e.Err
+}
+
+// UploadError is returned when a file can't be uploaded to its storage
+type UploadError struct {
+	Bucket string
+	Key    string
+	Err    error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("unable to upload %s: %s", StorageURL(e.Bucket, e.Key), e.Err)
+}
+
+// Unwrap returns the error of the upload
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// tableError wraps the error of a call on the given table in ErrTableNotFound
+// if the table does not exist
+func tableError(tableName string, err error) error {
+	if errorCode(err) == dynamodb.ErrCodeResourceNotFoundException {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, tableName)
+	}
+	return err
+}
+
+// manifestError wraps the error of the download of a manifest in
+// ErrManifestNotFound if the file does not exist
+func manifestError(bucketName, manifestPath string, err error) error {
+	if errorCode(err) == s3.ErrCodeNoSuchKey || errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrManifestNotFound, StorageURL(bucketName, manifestPath))
+	}
+	return err
+}
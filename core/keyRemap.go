@@ -0,0 +1,190 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// templatePart is either a literal string or the path of an attribute of the
+// item to substitute
+type templatePart struct {
+	literal string
+	path    []pathElement
+}
+
+// keyTemplate computes the value of a key attribute
+type keyTemplate struct {
+	attribute     string
+	attributeType string
+	parts         []templatePart
+}
+
+// KeyRemap computes the key attributes of the items restored into a table
+// with a different key schema than the one of the backup
+type KeyRemap struct {
+	templates []keyTemplate
+	// keys maps the key attributes of the target table to their type
+	keys map[string]string
+}
+
+// NewKeyRemap parses the given templates, indexed by the key attribute they
+// compute, as in {"PK": "USER#${userId}", "SK": "PROFILE"}. ${...} is
+// replaced by the value of the attribute at the given path of the item, which
+// must be a string, a number or a boolean. The templates are checked against
+// the key schema of the given table definition
+func NewKeyRemap(templates map[string]string, def *TableDefinition) (*KeyRemap, error) {
+	r := &KeyRemap{keys: make(map[string]string)}
+	types := make(map[string]string)
+	for _, attr := range def.AttributeDefinitions {
+		types[attr.AttributeName] = attr.AttributeType
+	}
+	for _, key := range def.KeySchema {
+		r.keys[key.AttributeName] = types[key.AttributeName]
+	}
+
+	for attribute, template := range templates {
+		attributeType, ok := r.keys[attribute]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a key attribute of the table %s", attribute, def.TableName)
+		}
+		parts, err := parseTemplate(template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of %s: %s", attribute, err)
+		}
+		r.templates = append(r.templates, keyTemplate{attribute: attribute, attributeType: attributeType, parts: parts})
+	}
+	// Sorted so the errors are stable
+	sort.Slice(r.templates, func(i, j int) bool { return r.templates[i].attribute < r.templates[j].attribute })
+	return r, nil
+}
+
+// parseTemplate splits a template into its literals and its attribute paths
+func parseTemplate(template string) ([]templatePart, error) {
+	parts := []templatePart{}
+	for template != "" {
+		start := strings.Index(template, "${")
+		if start < 0 {
+			parts = append(parts, templatePart{literal: template})
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated ${ in %q", template)
+		}
+		path, err := parsePath(template[start+2 : start+end])
+		if err != nil {
+			return nil, err
+		}
+		if lastWildcard(path) >= 0 {
+			return nil, fmt.Errorf("wildcards can't be used in %q", template)
+		}
+		if start > 0 {
+			parts = append(parts, templatePart{literal: template[:start]})
+		}
+		parts = append(parts, templatePart{path: path})
+		template = template[start+end+1:]
+	}
+	return parts, nil
+}
+
+// Apply computes the key attributes of the given item, in place, then checks
+// that the item holds every key attribute of the table with the right type.
+// The templates are all computed from the original attributes of the item
+func (r *KeyRemap) Apply(item map[string]*dynamodb.AttributeValue) error {
+	if r == nil {
+		return nil
+	}
+	values := make([]*dynamodb.AttributeValue, len(r.templates))
+	for i, t := range r.templates {
+		value, err := t.render(item)
+		if err != nil {
+			return fmt.Errorf("Unable to compute the key attribute %s: %s", t.attribute, err)
+		}
+		values[i] = value
+	}
+	for i, t := range r.templates {
+		item[t.attribute] = values[i]
+	}
+
+	for attribute, attributeType := range r.keys {
+		if !hasType(item[attribute], attributeType) {
+			return fmt.Errorf("the key attribute %s of the item is missing or not of type %s", attribute, attributeType)
+		}
+	}
+	return nil
+}
+
+// render computes the value of the key attribute from the given item
+func (t keyTemplate) render(item map[string]*dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	var b strings.Builder
+	root := &dynamodb.AttributeValue{M: item}
+	for _, part := range t.parts {
+		if part.path == nil {
+			b.WriteString(part.literal)
+			continue
+		}
+		matches := resolve(root, part.path)
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("missing attribute %s", pathString(part.path))
+		}
+		switch av := matches[0]; {
+		case av.S != nil:
+			b.WriteString(*av.S)
+		case av.N != nil:
+			b.WriteString(*av.N)
+		case av.BOOL != nil:
+			b.WriteString(strconv.FormatBool(*av.BOOL))
+		default:
+			return nil, fmt.Errorf("the attribute %s is not a string, a number or a boolean", pathString(part.path))
+		}
+	}
+
+	value := b.String()
+	switch t.attributeType {
+	case dynamodb.ScalarAttributeTypeN:
+		if !isNumber(value) {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return &dynamodb.AttributeValue{N: aws.String(value)}, nil
+	case dynamodb.ScalarAttributeTypeB:
+		return &dynamodb.AttributeValue{B: []byte(value)}, nil
+	}
+	return &dynamodb.AttributeValue{S: aws.String(value)}, nil
+}
+
+// hasType tells if the given attribute is a non empty value of the given
+// scalar type
+func hasType(av *dynamodb.AttributeValue, attributeType string) bool {
+	if av == nil {
+		return false
+	}
+	switch attributeType {
+	case dynamodb.ScalarAttributeTypeS:
+		return av.S != nil && *av.S != ""
+	case dynamodb.ScalarAttributeTypeN:
+		return av.N != nil
+	case dynamodb.ScalarAttributeTypeB:
+		return len(av.B) > 0
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// singleTable is the definition of the table targeted by the key remapping
+var singleTable = &TableDefinition{
+	TableName: "singleTable",
+	KeySchema: []KeyDefinition{{AttributeName: "PK", KeyType: "HASH"}, {AttributeName: "SK", KeyType: "RANGE"}},
+	AttributeDefinitions: []AttributeDefinition{
+		{AttributeName: "PK", AttributeType: "S"},
+		{AttributeName: "SK", AttributeType: "S"},
+	},
+}
+
+func TestKeyRemapApply(t *testing.T) {
+	remap, err := NewKeyRemap(map[string]string{"PK": "USER#${userId}", "SK": "PROFILE#${profile.year}"}, singleTable)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"userId":  {S: aws.String("freddie")},
+		"profile": {M: map[string]*dynamodb.AttributeValue{"year": {N: aws.String("1946")}}},
+	}
+	if err := remap.Apply(item); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if aws.StringValue(item["PK"].S) != "USER#freddie" || aws.StringValue(item["SK"].S) != "PROFILE#1946" {
+		t.Fatalf("Keys mismatch. Expecting: USER#freddie and PROFILE#1946\nGot: %v and %v\n", item["PK"], item["SK"])
+	}
+	if aws.StringValue(item["userId"].S) != "freddie" {
+		t.Fatal("Expecting the source attributes to be kept")
+	}
+
+	if err := remap.Apply(map[string]*dynamodb.AttributeValue{"name": {S: aws.String("brian")}}); err == nil {
+		t.Fatal("Expecting an error for an item missing the templated attributes")
+	}
+}
+
+func TestKeyRemapMissingKey(t *testing.T) {
+	remap, err := NewKeyRemap(map[string]string{"PK": "USER#${userId}"}, singleTable)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := remap.Apply(map[string]*dynamodb.AttributeValue{"userId": {S: aws.String("roger")}}); err == nil {
+		t.Fatal("Expecting an error for an item without SK")
+	}
+	if err := remap.Apply(map[string]*dynamodb.AttributeValue{"userId": {S: aws.String("roger")}, "SK": {S: aws.String("PROFILE")}}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestKeyRemapInvalidTemplates(t *testing.T) {
+	templates := []map[string]string{
+		{"userId": "USER#${userId}"},
+		{"PK": "USER#${userId"},
+		{"PK": "USER#${tracks[*].title}"},
+	}
+	for _, template := range templates {
+		if _, err := NewKeyRemap(template, singleTable); err == nil {
+			t.Fatalf("Expecting an error for %v", template)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// CapacityLimiter is a token bucket limiting the capacity units consumed per
+// second. The capacity consumed by a request is only known once it is done, so
+// the bucket can go in debt and the next requests wait for it to refill
+type CapacityLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+// NewCapacityLimiter creates a CapacityLimiter allowing the given capacity
+// units per second, with a burst of one second worth of capacity
+func NewCapacityLimiter(rate float64) *CapacityLimiter {
+	return &CapacityLimiter{rate: rate, tokens: rate, last: time.Now(), now: time.Now, sleep: time.Sleep}
+}
+
+// refill adds the tokens earned since the last call. Must be called with the
+// lock held
+func (l *CapacityLimiter) refill() {
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+// Wait blocks until the bucket is out of debt
+func (l *CapacityLimiter) Wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.tokens < 0 {
+		l.sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+		l.refill()
+	}
+}
+
+// Consume takes the given capacity units from the bucket
+func (l *CapacityLimiter) Consume(units float64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.tokens -= units
+}
+
+// consumedUnits sums the capacity units of the given ConsumedCapacity
+func consumedUnits(capacities ...*dynamodb.ConsumedCapacity) float64 {
+	units := 0.0
+	for _, c := range capacities {
+		if c != nil {
+			units += aws.Float64Value(c.CapacityUnits)
+		}
+	}
+	return units
+}
+
+// TableCapacity returns the read and write capacity units per second of the
+// given table. For on-demand tables, the maximum throughput set on the table
+// is returned, and the per-table limits of the account, which bound the
+// on-demand capacity, for the maximums it has none of
+func (h *AwsHelper) TableCapacity(tableName string) (float64, float64, error) {
+	result, err := h.DynamoSvc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return 0, 0, tableError(tableName, err)
+	}
+	table := result.Table
+	if table.BillingModeSummary != nil && aws.StringValue(table.BillingModeSummary.BillingMode) == dynamodb.BillingModePayPerRequest {
+		// Unset maximums are missing or -1
+		var read, write int64
+		if table.OnDemandThroughput != nil {
+			read, write = aws.Int64Value(table.OnDemandThroughput.MaxReadRequestUnits), aws.Int64Value(table.OnDemandThroughput.MaxWriteRequestUnits)
+		}
+		if read <= 0 || write <= 0 {
+			limits, err := h.DynamoSvc.DescribeLimits(&dynamodb.DescribeLimitsInput{})
+			if err != nil {
+				return 0, 0, fmt.Errorf("Unable to retrieve the account limits bounding the on-demand table %s: %w", tableName, err)
+			}
+			if read <= 0 {
+				read = aws.Int64Value(limits.TableMaxReadCapacityUnits)
+			}
+			if write <= 0 {
+				write = aws.Int64Value(limits.TableMaxWriteCapacityUnits)
+			}
+		}
+		if read <= 0 || write <= 0 {
+			return 0, 0, fmt.Errorf("The on-demand table %s has no maximum read and write throughput to apply a ratio to", tableName)
+		}
+		return float64(read), float64(write), nil
+	}
+	if table.ProvisionedThroughput == nil {
+		return 0, 0, fmt.Errorf("Unable to determine the capacity of the table %s", tableName)
+	}
+	return float64(aws.Int64Value(table.ProvisionedThroughput.ReadCapacityUnits)), float64(aws.Int64Value(table.ProvisionedThroughput.WriteCapacityUnits)), nil
+}
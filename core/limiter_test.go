@@ -0,0 +1,107 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+func TestCapacityLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	var slept time.Duration
+	l := NewCapacityLimiter(100)
+	l.last = now
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	// The burst of one second doesn't wait
+	l.Consume(100)
+	l.Wait()
+	if slept != 0 {
+		t.Fatalf("Expecting no wait within the burst, waited %s", slept)
+	}
+	// 50 units in debt at 100 units per second waits half a second
+	l.Consume(50)
+	l.Wait()
+	if slept != 500*time.Millisecond {
+		t.Fatalf("Expecting a wait of 500ms, waited %s", slept)
+	}
+	// Time spent elsewhere refills the bucket, up to the burst
+	now = now.Add(10 * time.Second)
+	l.Consume(150)
+	l.Wait()
+	if slept != time.Second {
+		t.Fatalf("Expecting a total wait of 1s, waited %s", slept)
+	}
+
+	var disabled *CapacityLimiter
+	disabled.Consume(1000)
+	disabled.Wait()
+}
+
+// struct to mock the Dynamo calls describing a table of a given capacity, in
+// an account of the given limits
+type mockCapacityDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	table  *dynamodb.TableDescription
+	limits *dynamodb.DescribeLimitsOutput
+}
+
+func (m *mockCapacityDynamoDBClient) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: m.table}, nil
+}
+
+func (m *mockCapacityDynamoDBClient) DescribeLimits(input *dynamodb.DescribeLimitsInput) (*dynamodb.DescribeLimitsOutput, error) {
+	if m.limits == nil {
+		return nil, fmt.Errorf("AccessDeniedException")
+	}
+	return m.limits, nil
+}
+
+func TestTableCapacity(t *testing.T) {
+	onDemand := &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+	limits := &dynamodb.DescribeLimitsOutput{TableMaxReadCapacityUnits: aws.Int64(40000), TableMaxWriteCapacityUnits: aws.Int64(40000)}
+	capacityTest := []struct {
+		table       *dynamodb.TableDescription
+		limits      *dynamodb.DescribeLimitsOutput
+		read, write float64
+		valid       bool
+	}{
+		{table: &dynamodb.TableDescription{ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(10), WriteCapacityUnits: aws.Int64(5)}}, read: 10, write: 5, valid: true},
+		{table: &dynamodb.TableDescription{BillingModeSummary: onDemand, OnDemandThroughput: &dynamodb.OnDemandThroughput{MaxReadRequestUnits: aws.Int64(300), MaxWriteRequestUnits: aws.Int64(100)}}, read: 300, write: 100, valid: true},
+		// The account limits replace the unset maximums
+		{table: &dynamodb.TableDescription{BillingModeSummary: onDemand, OnDemandThroughput: &dynamodb.OnDemandThroughput{MaxReadRequestUnits: aws.Int64(-1), MaxWriteRequestUnits: aws.Int64(100)}}, limits: limits, read: 40000, write: 100, valid: true},
+		{table: &dynamodb.TableDescription{BillingModeSummary: onDemand}, limits: limits, read: 40000, write: 40000, valid: true},
+		{table: &dynamodb.TableDescription{BillingModeSummary: onDemand}},
+		{table: &dynamodb.TableDescription{BillingModeSummary: onDemand}, limits: &dynamodb.DescribeLimitsOutput{}},
+	}
+	for _, test := range capacityTest {
+		h := &AwsHelper{DynamoSvc: &mockCapacityDynamoDBClient{table: test.table, limits: test.limits}}
+		read, write, err := h.TableCapacity("myTable")
+		if (err == nil) != test.valid || read != test.read || write != test.write {
+			t.Fatalf("Expecting %.0f/%.0f (valid: %t) for %v, got %.0f/%.0f (%v)", test.read, test.write, test.valid, test.table, read, write, err)
+		}
+	}
+}
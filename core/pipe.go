@@ -0,0 +1,54 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// ChannelToWriter writes the items of the channel to the given writer until it
+// is closed, one json document per line as in the backup files. On failure,
+// the rest of the channel is drained so its producer doesn't block. Returns
+// the number of items written, and the error of the scan if it failed once
+// the items scanned so far are written
+func (h *AwsHelper) ChannelToWriter(w io.Writer) (int64, error) {
+	defer h.Wg.Done()
+	buff := bufio.NewWriter(w)
+	var count int64
+	for elem := range h.DataPipe {
+		data, err := MarshalDynamoAttributeMap(elem)
+		if err != nil {
+			h.drain()
+			return count, fmt.Errorf("while converting to json: %v\nError: %s", elem, err)
+		}
+		buff.Write(data)
+		// The errors of a bufio.Writer are kept until it is flushed
+		if err := buff.WriteByte('\n'); err != nil {
+			h.drain()
+			return count, err
+		}
+		count++
+	}
+	if err := buff.Flush(); err != nil {
+		return count, err
+	}
+	if h.scanErr != nil {
+		return count, fmt.Errorf("the output is incomplete: %w", h.scanErr)
+	}
+	return count, nil
+}
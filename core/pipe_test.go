@@ -0,0 +1,85 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestChannelToWriter(t *testing.T) {
+	items := []map[string]*dynamodb.AttributeValue{
+		{"artist": {S: aws.String("Queen")}, "year": {N: aws.String("1970")}},
+		{"artist": {S: aws.String("Muse")}, "albums": {L: []*dynamodb.AttributeValue{{S: aws.String("Showbiz")}}}},
+	}
+	send := func(h *AwsHelper, scanErr error) {
+		for _, item := range items {
+			h.DataPipe <- item
+		}
+		h.scanErr = scanErr
+		close(h.DataPipe)
+	}
+
+	var out bytes.Buffer
+	h := &AwsHelper{DataPipe: make(chan map[string]*dynamodb.AttributeValue)}
+	h.Wg.Add(1)
+	go send(h, nil)
+	count, err := h.ChannelToWriter(&out)
+	if err != nil || count != 2 {
+		t.Fatalf("Expecting 2 items written, got %d (%v)", count, err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); len(lines) != 2 {
+		t.Fatalf("Expecting one line per item, got %q", out.String())
+	}
+
+	// The lines are read back as the items of a backup file
+	reader := &AwsHelper{DataPipe: make(chan map[string]*dynamodb.AttributeValue)}
+	read := []map[string]*dynamodb.AttributeValue{}
+	done := make(chan bool)
+	go func() {
+		for item := range reader.DataPipe {
+			read = append(read, item)
+		}
+		done <- true
+	}()
+	input := ioutil.NopCloser(&out)
+	if err := reader.ReaderToChannel(context.Background(), &input); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	close(reader.DataPipe)
+	<-done
+	if len(read) != 2 || *read[0]["artist"].S != "Queen" || *read[1]["albums"].L[0].S != "Showbiz" {
+		t.Fatalf("Unexpected items %v", read)
+	}
+
+	// The items scanned before a failure are written along with its error
+	out.Reset()
+	scanErr := errors.New("scan failed")
+	h = &AwsHelper{DataPipe: make(chan map[string]*dynamodb.AttributeValue)}
+	h.Wg.Add(1)
+	go send(h, scanErr)
+	count, err = h.ChannelToWriter(&out)
+	if !errors.Is(err, scanErr) || count != 2 || out.Len() == 0 {
+		t.Fatalf("Expecting the scan error after 2 items, got %d (%v)", count, err)
+	}
+}
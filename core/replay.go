@@ -0,0 +1,169 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+// ReplayReport sums up the changes replayed on a table. Skipped counts the
+// changes made after the time the table is restored to, and Last is the time
+// of the last change replayed
+type ReplayReport struct {
+	Puts    int64     `json:"puts"`
+	Deletes int64     `json:"deletes"`
+	Skipped int64     `json:"skipped"`
+	Last    time.Time `json:"last"`
+}
+
+// writeRequest returns the request applying the change to a table: a
+// PutRequest of the new image of the item for an INSERT or a MODIFY, and a
+// DeleteRequest of its key for a REMOVE
+func (c *ChangeRecord) writeRequest() (*dynamodb.WriteRequest, error) {
+	switch c.EventName {
+	case dynamodbstreams.OperationTypeInsert, dynamodbstreams.OperationTypeModify:
+		if len(c.NewImage) == 0 {
+			return nil, fmt.Errorf("the %s record %s has no new image", c.EventName, c.SequenceNumber)
+		}
+		return &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: fromCustomAttributeMap(c.NewImage)}}, nil
+	case dynamodbstreams.OperationTypeRemove:
+		return &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: fromCustomAttributeMap(c.Keys)}}, nil
+	}
+	return nil, fmt.Errorf("unknown event %s of the record %s", c.EventName, c.SequenceNumber)
+}
+
+// changeReplayer writes changes to a table with batches of BatchWriteItem. As
+// a BatchWriteItem rejects two requests on the same item and doesn't apply its
+// requests in order, a batch is sent as soon as a change of one of its items
+// comes in
+type changeReplayer struct {
+	destination *AwsHelper
+	tableName   string
+	until       time.Time
+	batchSize   int64
+	waitPeriod  time.Duration
+	report      ReplayReport
+
+	reqs    []*dynamodb.WriteRequest
+	keys    map[string]bool
+	written int64
+}
+
+// add adds the given change to the batch, unless it was made after the until
+// time of the replayer
+func (r *changeReplayer) add(ctx context.Context, change *ChangeRecord) error {
+	if change.Timestamp.After(r.until) {
+		r.report.Skipped++
+		return nil
+	}
+	req, err := change.writeRequest()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(change.Keys)
+	if err != nil {
+		return fmt.Errorf("while converting the key to json: %s", err)
+	}
+	key := string(data)
+	// A BatchWriteItem should not have more than 25 WriteRequests
+	if r.keys[key] || len(r.reqs) >= 25 {
+		if err := r.flush(ctx); err != nil {
+			return err
+		}
+	}
+	if r.keys == nil {
+		r.keys = make(map[string]bool)
+	}
+	r.keys[key] = true
+	r.reqs = append(r.reqs, req)
+	if req.DeleteRequest != nil {
+		r.report.Deletes++
+	} else {
+		r.report.Puts++
+	}
+	if change.Timestamp.After(r.report.Last) {
+		r.report.Last = change.Timestamp
+	}
+	return nil
+}
+
+// flush sends the batch to the table. If the destination has a WriteLimiter,
+// it paces the batches instead of the wait period
+func (r *changeReplayer) flush(ctx context.Context) error {
+	if len(r.reqs) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.destination.WriteLimiter.Wait()
+	log.Printf("Sending %d changes\n", len(r.reqs))
+	if err := r.destination.batchToTable(ctx, map[string][]*dynamodb.WriteRequest{r.tableName: r.reqs}); err != nil {
+		return err
+	}
+	r.written += int64(len(r.reqs))
+	if r.written >= r.batchSize {
+		if r.destination.WriteLimiter == nil {
+			time.Sleep(r.waitPeriod)
+		}
+		r.written = 0
+	}
+	r.reqs = nil
+	r.keys = nil
+	return nil
+}
+
+// ChangesToDynamo replays the changes of the files of AwsHelper.ManifestS3,
+// the manifest of an incremental backup, into the given table in their order.
+// The changes made after until are skipped. The replay stops as soon as the
+// context is done
+func (h *AwsHelper) ChangesToDynamo(ctx context.Context, tableName string, until time.Time, batchSize int64, waitPeriod time.Duration, destination *AwsHelper) (*ReplayReport, error) {
+	r := &changeReplayer{destination: destination, tableName: tableName, until: until, batchSize: batchSize, waitPeriod: waitPeriod}
+	for _, entry := range h.ManifestS3.Entries {
+		location, key, ok := splitStorageURL(entry.URL)
+		if !ok {
+			continue
+		}
+		reader, err := h.entryReader(ctx, location, key, entry)
+		if err != nil {
+			return &r.report, err
+		}
+		scanner := newLineScanner(reader)
+		for scanner.Scan() {
+			change := &ChangeRecord{}
+			err := json.Unmarshal(scanner.Bytes(), change)
+			if err == nil {
+				err = r.add(ctx, change)
+			}
+			if err != nil {
+				reader.Close()
+				return &r.report, fmt.Errorf("%s: %w", entry.URL, err)
+			}
+		}
+		reader.Close()
+		if err := scanner.Err(); err != nil {
+			return &r.report, err
+		}
+	}
+	return &r.report, r.flush(ctx)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// struct to mock a table recording the requests of each BatchWriteItem
+type mockReplayDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	batches [][]string
+}
+
+func (m *mockReplayDynamoDBClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	batch := []string{}
+	for _, req := range input.RequestItems["myTable"] {
+		if req.DeleteRequest != nil {
+			batch = append(batch, "delete "+aws.StringValue(req.DeleteRequest.Key["artist"].S))
+		} else {
+			batch = append(batch, "put "+aws.StringValue(req.PutRequest.Item["artist"].S))
+		}
+	}
+	m.batches = append(m.batches, batch)
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func TestChangeReplayer(t *testing.T) {
+	mock := &mockReplayDynamoDBClient{}
+	start := time.Date(2030, 1, 2, 15, 0, 0, 0, time.UTC)
+	r := &changeReplayer{destination: &AwsHelper{DynamoSvc: mock}, tableName: "myTable", until: start.Add(time.Minute), batchSize: 100}
+
+	change := func(event, artist string, offset time.Duration) *ChangeRecord {
+		c := &ChangeRecord{EventName: event, Timestamp: start.Add(offset), Keys: map[string]*CustomAttributeValue{"artist": {S: aws.String(artist)}}}
+		if event != "REMOVE" {
+			c.NewImage = map[string]*CustomAttributeValue{"artist": {S: aws.String(artist)}, "year": {N: aws.String("1970")}}
+		}
+		return c
+	}
+	changes := []*ChangeRecord{
+		change("INSERT", "Queen", 0),
+		change("INSERT", "Muse", time.Second),
+		// Another change of Queen sends the batch first
+		change("REMOVE", "Queen", 2*time.Second),
+		// Muse is not in the new batch anymore
+		change("MODIFY", "Muse", 3*time.Second),
+		// Made after the until time
+		change("INSERT", "Blur", 2*time.Minute),
+	}
+	for _, c := range changes {
+		if err := r.add(context.Background(), c); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := r.flush(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := [][]string{{"put Queen", "put Muse"}, {"delete Queen", "put Muse"}}
+	if len(mock.batches) != len(expected) {
+		t.Fatalf("Expecting the batches %v, got %v", expected, mock.batches)
+	}
+	for i, batch := range expected {
+		if len(mock.batches[i]) != len(batch) {
+			t.Fatalf("Expecting the batches %v, got %v", expected, mock.batches)
+		}
+		for j, req := range batch {
+			if mock.batches[i][j] != req {
+				t.Fatalf("Expecting the batches %v, got %v", expected, mock.batches)
+			}
+		}
+	}
+	if r.report.Puts != 3 || r.report.Deletes != 1 || r.report.Skipped != 1 || !r.report.Last.Equal(start.Add(3*time.Second)) {
+		t.Fatalf("Unexpected report %+v", r.report)
+	}
+
+	// An INSERT needs the new image of the item
+	invalid := change("INSERT", "Oasis", 0)
+	invalid.NewImage = nil
+	if err := r.add(context.Background(), invalid); err == nil {
+		t.Fatal("Expecting an error for a change without new image")
+	}
+}
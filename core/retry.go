@@ -0,0 +1,299 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// DefaultRetryMaxAttempts is the default number of attempts of a call
+	DefaultRetryMaxAttempts = 10
+	// DefaultRetryBaseDelay is the default delay before the first retry
+	DefaultRetryBaseDelay = 100 * time.Millisecond
+	// DefaultRetryMaxDelay is the default maximum delay between two attempts
+	DefaultRetryMaxDelay = 20 * time.Second
+	// DefaultRetryMaxElapsed is the default maximum time spent retrying a call
+	DefaultRetryMaxElapsed = 5 * time.Minute
+
+	// errCodeUnprocessedItems is the code used to retry the UnprocessedItems
+	// of a BatchWriteItem
+	errCodeUnprocessedItems = "UnprocessedItems"
+)
+
+// defaultRetryCodes lists the error codes retried by default
+var defaultRetryCodes = []string{
+	dynamodb.ErrCodeProvisionedThroughputExceededException,
+	dynamodb.ErrCodeRequestLimitExceeded,
+	dynamodb.ErrCodeInternalServerError,
+	"ThrottlingException",
+	"LimitExceededException",
+	"ServiceUnavailable",
+	"InternalError",
+	"SlowDown",
+	"RequestTimeout",
+	request.ErrCodeRequestError,
+	errCodeUnprocessedItems,
+}
+
+// RetryPolicy retries the AWS calls failing with a retryable error code, using
+// an exponential backoff with full jitter. It keeps count of the retries of
+// each operation, and can be shared between several AwsHelper
+type RetryPolicy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int
+	MaxElapsed  time.Duration
+	// Codes maps the retryable error codes to their own max attempts. 0 uses
+	// MaxAttempts
+	Codes map[string]int
+
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+	sleep  func(time.Duration)
+}
+
+// NewRetryPolicy creates a RetryPolicy with the default settings
+func NewRetryPolicy() *RetryPolicy {
+	p := &RetryPolicy{
+		BaseDelay:   DefaultRetryBaseDelay,
+		MaxDelay:    DefaultRetryMaxDelay,
+		MaxAttempts: DefaultRetryMaxAttempts,
+		MaxElapsed:  DefaultRetryMaxElapsed,
+		Codes:       make(map[string]int),
+	}
+	for _, code := range defaultRetryCodes {
+		p.Codes[code] = 0
+	}
+	return p
+}
+
+// SetCodeAttempts sets the max attempts of the given error codes, making them
+// retryable. Codes set to a negative value are not retried anymore
+func (p *RetryPolicy) SetCodeAttempts(codes map[string]int64) {
+	for code, attempts := range codes {
+		if attempts < 0 {
+			delete(p.Codes, code)
+			continue
+		}
+		p.Codes[code] = int(attempts)
+	}
+}
+
+// Validate checks the settings of the policy
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("the max attempts must be at least 1, got %d", p.MaxAttempts)
+	}
+	if p.BaseDelay < 0 || p.MaxDelay < p.BaseDelay {
+		return fmt.Errorf("the max delay (%s) must be greater than the base delay (%s)", p.MaxDelay, p.BaseDelay)
+	}
+	if p.MaxElapsed <= 0 {
+		return fmt.Errorf("the max elapsed time must be positive, got %s", p.MaxElapsed)
+	}
+	return nil
+}
+
+// maxAttempts returns the max attempts of the given error code, 0 if it is not
+// retryable
+func (p *RetryPolicy) maxAttempts(code string) int {
+	attempts, ok := p.Codes[code]
+	switch {
+	case !ok:
+		return 0
+	case attempts == 0:
+		return p.MaxAttempts
+	default:
+		return attempts
+	}
+}
+
+// backoff returns a random delay between 0 and the exponential backoff of the
+// given attempt, capped to MaxDelay
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	if attempt < 32 {
+		if exp := p.BaseDelay << uint(attempt); exp > 0 && exp < ceiling {
+			ceiling = exp
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// count records a retry of the given operation
+func (p *RetryPolicy) count(op, code string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.counts == nil {
+		p.counts = make(map[string]map[string]int64)
+	}
+	if p.counts[op] == nil {
+		p.counts[op] = make(map[string]int64)
+	}
+	p.counts[op][code]++
+}
+
+// Retries returns the number of retries per operation and error code
+func (p *RetryPolicy) Retries() map[string]map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := make(map[string]map[string]int64)
+	for op, codes := range p.counts {
+		counts[op] = make(map[string]int64)
+		for code, n := range codes {
+			counts[op][code] = n
+		}
+	}
+	return counts
+}
+
+// LogReport logs the number of retries of each operation
+func (p *RetryPolicy) LogReport() {
+	retries := p.Retries()
+	if len(retries) == 0 {
+		log.Println("Retries: none")
+		return
+	}
+	ops := []string{}
+	for op := range retries {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		details := []string{}
+		var total int64
+		for code, n := range retries[op] {
+			details = append(details, fmt.Sprintf("%s=%d", code, n))
+			total += n
+		}
+		sort.Strings(details)
+		log.Printf("Retries of %s: %d (%s)\n", op, total, strings.Join(details, ", "))
+	}
+}
+
+// defaultRetryPolicy is used by the helpers without a retry policy, such as
+// the ones not created by NewAwsHelper
+var defaultRetryPolicy = NewRetryPolicy()
+
+// retryPolicy returns the retry policy of the helper, or the default one. The
+// helper is left untouched, so it is safe to call from concurrent workers
+func (h *AwsHelper) retryPolicy() *RetryPolicy {
+	if h.Retry == nil {
+		return defaultRetryPolicy
+	}
+	return h.Retry
+}
+
+// retrier tracks the attempts of a call, stopping as soon as its context is
+// done
+type retrier struct {
+	ctx     context.Context
+	policy  *RetryPolicy
+	op      string
+	attempt int
+	start   time.Time
+}
+
+// newRetrier starts tracking the attempts of a call of the given operation
+func (p *RetryPolicy) newRetrier(ctx context.Context, op string) *retrier {
+	return &retrier{ctx: ctx, policy: p, op: op, start: time.Now()}
+}
+
+// errorCode returns the AWS error code of the given error, even wrapped
+func errorCode(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// retry returns whether the call failing with the given error should be
+// retried, after waiting the backoff delay
+func (r *retrier) retry(err error) bool {
+	code := errorCode(err)
+	maxAttempts := r.policy.maxAttempts(code)
+	r.attempt++
+	if r.ctx.Err() != nil || maxAttempts == 0 || r.attempt >= maxAttempts || time.Since(r.start) >= r.policy.MaxElapsed {
+		return false
+	}
+	delay := r.policy.backoff(r.attempt)
+	log.Printf("[WARNING] %s failed with %s, attempt %d/%d, retrying in %s\n", r.op, code, r.attempt, maxAttempts, delay)
+	r.policy.count(r.op, code)
+	if r.policy.sleep != nil {
+		r.policy.sleep(delay)
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// giveUp returns the error of a call the policy gave up on, wrapped in a
+// ThrottlingError if the call was throttled. The error of the context is
+// returned instead if it is done
+func (r *retrier) giveUp(err error) error {
+	if ctxErr := r.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	code := errorCode(err)
+	if throttlingCodes[code] && r.policy.maxAttempts(code) > 0 {
+		return &ThrottlingError{Op: r.op, Code: code, Attempts: r.attempt, Err: err}
+	}
+	return err
+}
+
+// reset restarts the attempts count, once the call made some progress
+func (r *retrier) reset() {
+	r.attempt = 0
+	r.start = time.Now()
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable or
+// the policy gives up, returning its last error. A ThrottlingError is returned
+// if the policy gave up on a throttled call
+func (p *RetryPolicy) Do(ctx context.Context, op string, fn func() error) error {
+	r := p.newRetrier(ctx, op)
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !r.retry(err) {
+			return r.giveUp(err)
+		}
+	}
+}
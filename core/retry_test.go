@@ -0,0 +1,102 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestRetryPolicyDo(t *testing.T) {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "Bla bla", nil)
+	limited := awserr.New(dynamodb.ErrCodeRequestLimitExceeded, "Bla bla", nil)
+	retryTest := []struct {
+		name          string
+		errs          []error
+		codes         map[string]int64
+		expectedCalls int
+		expectedErr   bool
+	}{
+		{name: "success", errs: []error{nil}, expectedCalls: 1},
+		{name: "random error", errs: []error{fmt.Errorf("Random error")}, expectedCalls: 1, expectedErr: true},
+		{name: "not retryable code", errs: []error{awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Bla bla", nil)}, expectedCalls: 1, expectedErr: true},
+		{name: "throttled then success", errs: []error{throttled, throttled, nil}, expectedCalls: 3},
+		{name: "max attempts", errs: []error{throttled, throttled, throttled, throttled, nil}, expectedCalls: 3, expectedErr: true},
+		{name: "code override", errs: []error{limited, limited, limited, limited, nil}, codes: map[string]int64{dynamodb.ErrCodeRequestLimitExceeded: 5}, expectedCalls: 5},
+		{name: "code disabled", errs: []error{limited, nil}, codes: map[string]int64{dynamodb.ErrCodeRequestLimitExceeded: -1}, expectedCalls: 1, expectedErr: true},
+	}
+	for _, item := range retryTest {
+		p := NewRetryPolicy()
+		p.MaxAttempts = 3
+		p.sleep = func(time.Duration) {}
+		p.SetCodeAttempts(item.codes)
+
+		calls := 0
+		err := p.Do(context.Background(), "Test", func() error {
+			err := item.errs[calls]
+			calls++
+			return err
+		})
+		if calls != item.expectedCalls {
+			t.Errorf("%s: expecting %d calls, got %d", item.name, item.expectedCalls, calls)
+		}
+		if (err != nil) != item.expectedErr {
+			t.Errorf("%s: unexpected error %v", item.name, err)
+		}
+		var retries int64
+		for _, n := range p.Retries()["Test"] {
+			retries += n
+		}
+		if retries != int64(calls-1) {
+			t.Errorf("%s: expecting %d retries, got %d", item.name, calls-1, retries)
+		}
+	}
+}
+
+func TestRetryPolicyMaxElapsed(t *testing.T) {
+	p := NewRetryPolicy()
+	p.MaxElapsed = 0
+	calls := 0
+	err := p.Do(context.Background(), "Test", func() error {
+		calls++
+		return awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "Bla bla", nil)
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("Expecting a single call and an error, got %d calls and %v", calls, err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := NewRetryPolicy()
+	p.BaseDelay = time.Millisecond
+	p.MaxDelay = 50 * time.Millisecond
+	for attempt := 1; attempt < 40; attempt++ {
+		ceiling := p.MaxDelay
+		if attempt < 6 {
+			ceiling = p.BaseDelay << uint(attempt)
+		}
+		for i := 0; i < 20; i++ {
+			if delay := p.backoff(attempt); delay < 0 || delay > ceiling {
+				t.Fatalf("Attempt %d: delay %s out of [0, %s]", attempt, delay, ceiling)
+			}
+		}
+	}
+}
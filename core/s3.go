@@ -18,35 +18,154 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/url"
+	"path"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/segmentio/ksuid"
 )
 
-// S3ManifestEntry represents an entry in the actions manifest stored in the s3 folder of the actions
+// S3ManifestEntry represents an entry in the actions manifest stored in the s3 folder of the actions.
+// The SHA256, Size and ItemCount are absent from the manifests written by the
+// AWS DataPipeline and older versions of this tool
 type S3ManifestEntry struct {
-	URL       string `json:"url"`
-	Mandatory bool   `json:"mandatory"`
+	URL         string            `json:"url"`
+	Mandatory   bool              `json:"mandatory"`
+	Compression string            `json:"compression,omitempty"`
+	Encryption  *S3EncryptionInfo `json:"encryption,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	Size        *int64            `json:"size,omitempty"`
+	ItemCount   *int64            `json:"itemCount,omitempty"`
+	// ErrorCode and Source are set on the entries of a dead letter, to the
+	// error that rejected the items and the URL of the file they come from
+	ErrorCode string `json:"errorCode,omitempty"`
+	Source    string `json:"source,omitempty"`
+	// Format is set to FormatAWSExport on the entries of a native DynamoDB
+	// export, whose lines wrap each item in an Item attribute, and MD5 to the
+	// base64 MD5 checksum of their file
+	Format string `json:"format,omitempty"`
+	MD5    string `json:"md5,omitempty"`
 }
 
-// S3Manifest represents the actions manifest stored in the s3 folder of the actions
+// S3ManifestTotals sums up the entries of a manifest
+type S3ManifestTotals struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+	Items int64 `json:"items"`
+}
+
+// S3Manifest represents the actions manifest stored in the s3 folder of the actions.
+// Incomplete is set on the manifest of a backup that was interrupted
 type S3Manifest struct {
-	Name    string            `json:"name"`
-	Version int               `json:"version"`
-	Entries []S3ManifestEntry `json:"entries"`
+	Name       string            `json:"name"`
+	Version    int               `json:"version"`
+	Entries    []S3ManifestEntry `json:"entries"`
+	Totals     *S3ManifestTotals `json:"totals,omitempty"`
+	Incomplete bool              `json:"incomplete,omitempty"`
+	// EndTime is set on the manifests of the complete full backups to the
+	// time their scan was over, the earliest point in time they can be
+	// restored to
+	EndTime *time.Time `json:"endTime,omitempty"`
+	// StreamArn, Base, Previous and Shards are set on the manifests of the
+	// incremental backups, to the stream read, the URL of the folder of the
+	// full backup and of the manifest of the incremental backup they follow,
+	// and the position reached in each shard of the stream
+	StreamArn string                  `json:"streamArn,omitempty"`
+	Base      string                  `json:"base,omitempty"`
+	Previous  string                  `json:"previous,omitempty"`
+	Shards    []StreamShardCheckpoint `json:"shards,omitempty"`
+}
+
+// computeTotals sums up the size and item count of the entries
+func (m *S3Manifest) computeTotals() {
+	totals := &S3ManifestTotals{Files: int64(len(m.Entries))}
+	for _, entry := range m.Entries {
+		totals.Bytes += aws.Int64Value(entry.Size)
+		totals.Items += aws.Int64Value(entry.ItemCount)
+	}
+	m.Totals = totals
+}
+
+// verifyChecksum checks that the given data matches the size and the checksum
+// of the entry, when it has them
+func (entry S3ManifestEntry) verifyChecksum(data []byte) error {
+	if entry.Size != nil && *entry.Size != int64(len(data)) {
+		return fmt.Errorf("%s is %d bytes long instead of %d", entry.URL, len(data), *entry.Size)
+	}
+	if entry.SHA256 != "" {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return fmt.Errorf("%s doesn't match its SHA-256 checksum", entry.URL)
+		}
+	}
+	if entry.MD5 != "" {
+		sum := md5.Sum(data)
+		if base64.StdEncoding.EncodeToString(sum[:]) != entry.MD5 {
+			return fmt.Errorf("%s doesn't match its MD5 checksum", entry.URL)
+		}
+	}
+	return nil
+}
+
+// maxLineSize is the maximum size of a line of a backup file. An item is at
+// most 400KB, its json representation can be a few times bigger
+const maxLineSize = 4 * 1024 * 1024
+
+// S3UploadOptions holds the settings applied to every file uploaded to s3
+type S3UploadOptions struct {
+	// StorageClass defaults to STANDARD_IA
+	StorageClass string
+	// SSEKMSKeyID switches the server side encryption from AES256 to SSE-KMS
+	SSEKMSKeyID string
+	Tags        map[string]string
+	// ObjectLockMode is GOVERNANCE or COMPLIANCE, and requires an
+	// ObjectLockRetainUntil date
+	ObjectLockMode        string
+	ObjectLockRetainUntil time.Time
+}
+
+// s3StorageClasses lists the storage classes accepted for the uploads
+var s3StorageClasses = []string{"STANDARD", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER", "GLACIER_IR", "DEEP_ARCHIVE", "REDUCED_REDUNDANCY"}
+
+// Validate checks the consistency of the upload options
+func (o S3UploadOptions) Validate() error {
+	if o.StorageClass != "" {
+		valid := false
+		for _, class := range s3StorageClasses {
+			valid = valid || class == o.StorageClass
+		}
+		if !valid {
+			return fmt.Errorf("Unsupported storage class %s, must be one of %s", o.StorageClass, strings.Join(s3StorageClasses, ", "))
+		}
+	}
+	switch o.ObjectLockMode {
+	case "":
+		if !o.ObjectLockRetainUntil.IsZero() {
+			return fmt.Errorf("An object lock mode is required along with the retain until date")
+		}
+	case s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance:
+		if !o.ObjectLockRetainUntil.After(time.Now()) {
+			return fmt.Errorf("The object lock retain until date must be in the future")
+		}
+	default:
+		return fmt.Errorf("Unsupported object lock mode %s, must be %s or %s", o.ObjectLockMode, s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance)
+	}
+	return nil
 }
 
 // genNewFileName returns a UUID used by the data pipelines
@@ -56,14 +175,11 @@ func genNewFileName() string {
 }
 
 // LoadManifestFromS3 downloads the given manifest file and load it in the
-// ManifestS3 attribute of the struct
+// ManifestS3 attribute of the struct, replacing the manifest loaded before
 func (h *AwsHelper) LoadManifestFromS3(bucketName, manifestPath string) error {
-	doc, err := h.GetFromS3(bucketName, manifestPath)
+	doc, err := h.GetFromS3(context.Background(), bucketName, manifestPath)
 	if err != nil {
-		if err, ok := err.(awserr.Error); ok && err.Code() == s3.ErrCodeNoSuchKey {
-			log.Fatalf("[ERROR] Unable to find a manifest flag in the provided folder. Are you sure the actions was successful?\nAborting...\n")
-		}
-		log.Fatalf("[ERROR] Unable to retrieve the manifest flag information: %s\nAborting...\n", err)
+		return manifestError(bucketName, manifestPath, err)
 	}
 	defer (*doc).Close()
 	buff := bytes.NewBuffer(nil)
@@ -71,153 +187,388 @@ func (h *AwsHelper) LoadManifestFromS3(bucketName, manifestPath string) error {
 		return err
 	}
 
-	return json.Unmarshal(buff.Bytes(), &h.ManifestS3)
+	// Decoding into the previous manifest would keep the fields of its
+	// entries that the new ones don't set
+	manifest := S3Manifest{}
+	if err := json.Unmarshal(buff.Bytes(), &manifest); err != nil {
+		return err
+	}
+	h.ManifestS3 = manifest
+	return nil
 }
 
-// GetFromS3 download a file from s3 to memory (as the files are small by
-// default - just a few Mb).
-func (h *AwsHelper) GetFromS3(bucketName, s3Path string) (*io.ReadCloser, error) {
-	svc := h.CreateServiceClientValue()
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(s3Path),
+// GetFromS3 download a file from the given location, an s3 bucket or a local
+// folder, to memory (as the files are small by default - just a few Mb).
+func (h *AwsHelper) GetFromS3(ctx context.Context, bucketName, s3Path string) (*io.ReadCloser, error) {
+	storage, err := h.Storage(bucketName)
+	if err != nil {
+		return nil, err
 	}
-
-	results, err := svc.GetObject(input)
+	body, err := storage.Get(ctx, s3Path)
 	if err != nil {
 		return nil, err
 	}
-	return &results.Body, nil
+	return &body, nil
 }
 
-// ExistsInS3 checks that a given path in s3 exists as a file
+// ExistsInS3 checks that a given path of the given location exists as a file
 func (h *AwsHelper) ExistsInS3(bucketName, s3Path string) (bool, error) {
-	svc := h.CreateServiceClientValue()
-	input := &s3.HeadObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(s3Path),
+	storage, err := h.Storage(bucketName)
+	if err != nil {
+		return false, err
 	}
+	return storage.Head(context.Background(), s3Path)
+}
 
-	_, err := svc.HeadObject(input)
+// LatestBackupFolder returns the most recent complete backup among the
+// subfolders of the given folder, named after their date by the backups with
+// a date suffix
+func (h *AwsHelper) LatestBackupFolder(ctx context.Context, bucketName, s3Folder string) (string, error) {
+	storage, err := h.Storage(bucketName)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
-			return false, nil
+		return "", err
+	}
+	keys, err := storage.List(ctx, s3Folder)
+	if err != nil {
+		return "", err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") {
+			continue
+		}
+		folder := strings.TrimSuffix(key, "/")
+		exists, err := storage.Head(ctx, fmt.Sprintf("%s/_SUCCESS", folder))
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return folder, nil
 		}
-		return false, err
 	}
-	return true, nil
+	return "", fmt.Errorf("%w: no complete backup in %s", ErrManifestNotFound, StorageURL(bucketName, s3Folder))
 }
 
-// UploadToS3 writes the content of a bytes array to the given s3 path
-func (h *AwsHelper) UploadToS3(bucketName, s3Key string, data []byte) {
-	svc := h.CreateServiceClientValue()
-	uploader := s3manager.NewUploaderWithClient(svc)
+// UploadToS3 writes the content of a bytes array to the given path of the
+// given location, using the upload options of the struct for s3. An
+// UploadError is returned on failure
+func (h *AwsHelper) UploadToS3(ctx context.Context, bucketName, s3Key string, data []byte) error {
+	return h.upload(ctx, bucketName, s3Key, data, false)
+}
 
-	upParams := &s3manager.UploadInput{
-		Bucket:               aws.String(bucketName),
-		Key:                  aws.String(s3Key),
-		Body:                 bytes.NewReader(data),
-		StorageClass:         aws.String("STANDARD_IA"),
-		ServerSideEncryption: aws.String("AES256"),
-		// Expire: ...,
-		// Tagging:
+// uploadControlToS3 is UploadToS3 for the files describing a backup rather
+// than holding its items (manifests, checkpoint, flags...). They are written
+// in the STANDARD storage class, as they are small, often rewritten and must
+// be readable before the data files are restored from an archive class
+func (h *AwsHelper) uploadControlToS3(ctx context.Context, bucketName, s3Key string, data []byte) error {
+	return h.upload(ctx, bucketName, s3Key, data, true)
+}
+
+// upload writes a data or a control file
+func (h *AwsHelper) upload(ctx context.Context, bucketName, s3Key string, data []byte, control bool) error {
+	storage, err := h.Storage(bucketName)
+	if err == nil {
+		if s, ok := storage.(*s3Storage); ok {
+			s.control = control
+		}
+		log.Printf("Writing file: %s\n", StorageURL(bucketName, s3Key))
+		err = storage.Put(ctx, s3Key, data)
+	}
+	if err != nil {
+		return &UploadError{Bucket: bucketName, Key: s3Key, Err: err}
 	}
-	// Set file name and content before upload
-	log.Printf("Writing file: s3://%s/%s\n", *upParams.Bucket, *upParams.Key)
-	_, err := uploader.Upload(upParams)
+	return nil
+}
+
+// DeleteFromS3 removes the given file from the given location
+func (h *AwsHelper) DeleteFromS3(bucketName, s3Path string) error {
+	storage, err := h.Storage(bucketName)
 	if err != nil {
-		log.Fatalf("[ERROR] while uploading to s3: %s", err)
+		return err
 	}
+	return storage.Delete(context.Background(), s3Path)
 }
 
-// ReaderToChannel reads the data from a actions line by line, serializes it and
-// sends it to the struct's channel
-func (h *AwsHelper) ReaderToChannel(dataReader *io.ReadCloser) error {
+// newLineScanner returns a scanner reading the lines of a backup file, each one
+// holding an item that can be much bigger than the default buffer of a scanner
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	return scanner
+}
+
+// ReaderToChannel reads the data from a actions line by line, serializes it,
+// transforms it, remaps its keys and sends it to the struct's channel, until
+// the context is done
+func (h *AwsHelper) ReaderToChannel(ctx context.Context, dataReader *io.ReadCloser) error {
+	return h.readerToChannel(ctx, dataReader, FormatDataPipeline)
+}
+
+// readerToChannel is ReaderToChannel, reading lines of the given format
+func (h *AwsHelper) readerToChannel(ctx context.Context, dataReader *io.ReadCloser, format string) error {
 	defer (*dataReader).Close()
-	scanner := bufio.NewScanner(*dataReader)
+	scanner := newLineScanner(*dataReader)
 	for scanner.Scan() {
-		res := map[string]*dynamodb.AttributeValue{}
-		data := scanner.Bytes()
-		json.Unmarshal(data[:], &res)
-		h.DataPipe <- res
+		res, err := decodeLine(scanner.Bytes(), format)
+		if err != nil {
+			return fmt.Errorf("Unable to decode an item: %s", err)
+		}
+		if err := h.Transform.Apply(res); err != nil {
+			return err
+		}
+		if err := h.KeyRemap.Apply(res); err != nil {
+			return err
+		}
+		if err := h.SyncKeys.Add(res); err != nil {
+			return err
+		}
+		select {
+		case h.DataPipe <- res:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 	return scanner.Err()
 }
 
+// entryReader downloads the file of a manifest entry, returning a reader of its
+// verified, decrypted and decompressed content
+func (h *AwsHelper) entryReader(ctx context.Context, bucketName, s3Path string, entry S3ManifestEntry) (io.ReadCloser, error) {
+	data, err := h.GetFromS3(ctx, bucketName, s3Path)
+	if err != nil {
+		return nil, err
+	}
+	return h.decodeEntry(entry, *data)
+}
+
+// decodeEntry verifies, decrypts and decompresses the content of the file of a
+// manifest entry
+func (h *AwsHelper) decodeEntry(entry S3ManifestEntry, reader io.ReadCloser) (io.ReadCloser, error) {
+	var err error
+	// Checks the file entirely before any of its items is used
+	if entry.SHA256 != "" || entry.MD5 != "" || entry.Size != nil {
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := entry.verifyChecksum(content); err != nil {
+			return nil, err
+		}
+		reader = ioutil.NopCloser(bytes.NewReader(content))
+	}
+	if entry.Encryption != nil {
+		if reader, err = decryptReader(h.Keys, entry.Encryption, reader, path.Base(entry.URL)); err != nil {
+			return nil, fmt.Errorf("Unable to decrypt %s: %s", entry.URL, err)
+		}
+	}
+	decompressed, err := decompressReader(entry.Compression, reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return decompressed, nil
+}
+
 // S3ToDynamo pulls the s3 files from AwsHelper.ManifestS3 and import them
 // inside the given table using the given batch size (and wait period between
-// each batch)
-func (h *AwsHelper) S3ToDynamo(tableName string, batchSize int64, waitPeriod time.Duration, destination *AwsHelper) error {
-	var err error
-	go h.ChannelToTable(tableName, batchSize, waitPeriod, destination)
-	h.Wg.Add(1)
+// each batch). The restore stops as soon as the context is done
+func (h *AwsHelper) S3ToDynamo(ctx context.Context, tableName string, batchSize int64, waitPeriod time.Duration, destination *AwsHelper) error {
 	for _, entry := range h.ManifestS3.Entries {
-		u, _ := url.Parse(entry.URL)
-		if u.Scheme == "s3" {
-			data, err := h.GetFromS3(u.Host, u.Path)
-			if err != nil {
+		if location, key, ok := splitStorageURL(entry.URL); ok {
+			if err := h.entryToDynamo(ctx, location, key, entry, tableName, batchSize, waitPeriod, destination); err != nil {
 				return err
 			}
-			if err = h.ReaderToChannel(data); err != nil {
-				break
-			}
 		}
 
 	}
+	return nil
+}
+
+// entryToDynamo imports the file of a manifest entry through a channel of its
+// own, so the items rejected by the table can be traced back to the file. The
+// error of the download of the file takes precedence over the error of the
+// writes
+func (h *AwsHelper) entryToDynamo(ctx context.Context, location, key string, entry S3ManifestEntry, tableName string, batchSize int64, waitPeriod time.Duration, destination *AwsHelper) error {
+	h.DataPipe = make(chan map[string]*dynamodb.AttributeValue)
+	// The writer signals the wait group before returning its error, which is
+	// passed through a channel instead
+	writeErrs := make(chan error, 1)
+	h.Wg.Add(1)
+	go func() {
+		writeErrs <- h.channelToTable(ctx, tableName, batchSize, waitPeriod, destination, entry.URL)
+	}()
+
+	reader, err := h.entryReader(ctx, location, key, entry)
+	if err == nil {
+		err = h.readerToChannel(ctx, &reader, entry.Format)
+	}
 	close(h.DataPipe)
+	writeErr := <-writeErrs
 	h.Wg.Wait()
-	return err
+	if err != nil {
+		return err
+	}
+	return writeErr
 }
 
 // DumpBuffer dumps the content of the given buffer to a new randomly generated
-// file name in the given s3 path in the given bucket and resets the said buffer
-func (h *AwsHelper) DumpBuffer(bucketName, s3Folder string, buff *bytes.Buffer) {
-	filePath := fmt.Sprintf("%s/%s", s3Folder, genNewFileName())
-	h.UploadToS3(bucketName, filePath, buff.Bytes())
-	h.ManifestS3.Entries = append(h.ManifestS3.Entries, S3ManifestEntry{URL: fmt.Sprintf("s3://%s/%s", bucketName, filePath), Mandatory: true})
+// file name in the given s3 path in the given bucket and resets the said buffer.
+// The file is compressed first if a compression is set on the struct, then
+// encrypted if a key provider is set. The checksum and size of the uploaded
+// file are recorded in the manifest entry, along with its itemCount
+func (h *AwsHelper) DumpBuffer(ctx context.Context, bucketName, s3Folder string, buff *bytes.Buffer, itemCount int64) error {
+	return h.dumpBuffer(ctx, bucketName, s3Folder, genNewFileName(), buff, itemCount)
+}
+
+// dumpBuffer is DumpBuffer, writing to a file of the given name
+func (h *AwsHelper) dumpBuffer(ctx context.Context, bucketName, s3Folder, fileName string, buff *bytes.Buffer, itemCount int64) error {
+	entry := S3ManifestEntry{Mandatory: true, ItemCount: aws.Int64(itemCount)}
+	data := buff.Bytes()
+	var err error
+	if h.Compression != "" && h.Compression != CompressionNone {
+		if data, err = compress(h.Compression, data); err != nil {
+			return fmt.Errorf("while compressing the data with %s: %s", h.Compression, err)
+		}
+		entry.Compression = h.Compression
+	}
+	fileName += compressionExtension(entry.Compression)
+	if h.Keys != nil {
+		fileName += encryptedExtension
+		if data, entry.Encryption, err = encrypt(h.Keys, data, fileName); err != nil {
+			return fmt.Errorf("while encrypting the data: %s", err)
+		}
+	}
+	sum := sha256.Sum256(data)
+	entry.SHA256 = hex.EncodeToString(sum[:])
+	entry.Size = aws.Int64(int64(len(data)))
+	filePath := fmt.Sprintf("%s/%s", s3Folder, fileName)
+	if err := h.UploadToS3(ctx, bucketName, filePath, data); err != nil {
+		return err
+	}
+	entry.URL = StorageURL(bucketName, filePath)
+	h.ManifestS3.Entries = append(h.ManifestS3.Entries, entry)
 	buff.Reset()
+	return nil
 }
 
 // ChannelToS3 reads from the given channel and sends the data the given bucket
-// in files of s3BufferSize max size
-func (h *AwsHelper) ChannelToS3(bucketName, s3Folder string, s3BufferSize int, destination *AwsHelper) {
+// in files of about s3BufferSize (a file is sent as soon as it reaches that
+// size). If a scan progress is attached to the struct, a checkpoint is written
+// after each file so that the backup can be resumed. On failure, the rest of
+// the channel is drained so its producer doesn't block, and the _SUCCESS flag
+// and the manifest are not written. If the scan failed or the context is done,
+// the buffer is still flushed along with the checkpoint, and a manifest marked
+// as incomplete is written instead of the _SUCCESS flag. Once the context is
+// done, the uploads are given the ShutdownTimeout of the struct to complete
+func (h *AwsHelper) ChannelToS3(ctx context.Context, bucketName, s3Folder string, s3BufferSize int, destination *AwsHelper) error {
 	defer h.Wg.Done()
+	uploadCtx, cancel := shutdownContext(ctx, h.shutdownTimeout())
+	defer cancel()
+
 	// buff is the buffer where the data will be stored while before being sent to s3
 	var buff bytes.Buffer
-	destination.ManifestS3 = S3Manifest{Version: 3, Name: "DynamoDB-export"}
+	itemCount, err := h.bufferToS3(uploadCtx, bucketName, s3Folder, s3BufferSize, &buff, destination)
+	if err != nil {
+		h.drain()
+		return err
+	}
+
+	// Upload the rest of the buffer
+	if buff.Len() > 0 || (h.scanErr == nil && len(destination.ManifestS3.Entries) == 0) {
+		if err := destination.DumpBuffer(uploadCtx, bucketName, s3Folder, &buff, itemCount); err != nil {
+			return err
+		}
+	}
+	if h.scanErr != nil {
+		return h.incompleteToS3(uploadCtx, bucketName, s3Folder, destination)
+	}
+
+	end := time.Now().UTC()
+	destination.ManifestS3.EndTime = &end
+
+	// Signal the success of the actions
+	if err := destination.uploadControlToS3(uploadCtx, bucketName, fmt.Sprintf("%s/_SUCCESS", s3Folder), []byte{}); err != nil {
+		return err
+	}
+	// Wrap up the manifest of the actions files
+	if err := destination.manifestToS3(uploadCtx, bucketName, s3Folder, false); err != nil {
+		return err
+	}
+	// The checkpoint is useless once the backup is complete
+	if h.Progress != nil {
+		if err := destination.DeleteFromS3(bucketName, fmt.Sprintf("%s/%s", s3Folder, CheckpointFileName)); err != nil {
+			log.Printf("[WARNING] Unable to remove the checkpoint file: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// bufferToS3 writes the items of the channel to s3 files until it is closed,
+// leaving the last items in the buffer. Returns the number of items left
+func (h *AwsHelper) bufferToS3(ctx context.Context, bucketName, s3Folder string, s3BufferSize int, buff *bytes.Buffer, destination *AwsHelper) (int64, error) {
+	var itemCount int64
+	// The entries of a resumed backup are kept
+	destination.ManifestS3.Version = 3
+	destination.ManifestS3.Name = "DynamoDB-export"
 
 	for elem := range h.DataPipe {
+		h.Progress.received()
 		data, err := MarshalDynamoAttributeMap(elem)
 		if err != nil {
-			log.Fatalf("[ERROR] while converting to json: %v\nError: %s\n", elem, err)
+			return itemCount, fmt.Errorf("while converting to json: %v\nError: %s", elem, err)
 		}
 
-		// before overflowing the buffer, dump to s3 and empty it
-		if buff.Len()+len(data) >= s3BufferSize && buff.Len() > 0 {
-			destination.DumpBuffer(bucketName, s3Folder, &buff)
-		}
 		// add the data to the buffer
 		buff.Write(data)
 		buff.WriteString("\n")
+		itemCount++
+		// once the buffer is full, dump to s3 and empty it. Everything
+		// received from the channel so far is then in s3, which makes it a
+		// safe point for a checkpoint
+		if buff.Len() >= s3BufferSize {
+			if err := destination.DumpBuffer(ctx, bucketName, s3Folder, buff, itemCount); err != nil {
+				return itemCount, err
+			}
+			itemCount = 0
+			if err := h.checkpointToS3(ctx, bucketName, s3Folder, destination); err != nil {
+				return itemCount, err
+			}
+		}
 	}
+	return itemCount, nil
+}
 
-	// Upload the rest of the buffer
-	destination.DumpBuffer(bucketName, s3Folder, &buff)
-	// Signal the success of the actions
-	destination.UploadToS3(bucketName, fmt.Sprintf("%s/_SUCCESS", s3Folder), []byte{})
-	// Wrap up the manifest of the actions files
-	manifestData, err := json.Marshal(destination.ManifestS3)
+// incompleteToS3 writes the checkpoint and a manifest marked as incomplete of
+// a backup whose scan failed or was interrupted, and returns the error of the
+// scan
+func (h *AwsHelper) incompleteToS3(ctx context.Context, bucketName, s3Folder string, destination *AwsHelper) error {
+	if err := h.checkpointToS3(ctx, bucketName, s3Folder, destination); err != nil {
+		return err
+	}
+	if err := destination.manifestToS3(ctx, bucketName, s3Folder, true); err != nil {
+		return err
+	}
+	log.Printf("[WARNING] The backup is incomplete, %d files were written\n", len(destination.ManifestS3.Entries))
+	return fmt.Errorf("the backup is incomplete: %w", h.scanErr)
+}
+
+// manifestToS3 computes the totals of the manifest of the struct and writes it
+// to the given s3 folder
+func (h *AwsHelper) manifestToS3(ctx context.Context, bucketName, s3Folder string, incomplete bool) error {
+	h.ManifestS3.Incomplete = incomplete
+	h.ManifestS3.computeTotals()
+	manifestData, err := json.Marshal(h.ManifestS3)
 	if err != nil {
-		log.Fatalf("[ERROR] while doing a marshal on the manifest: %v\nError: %s\n", destination.ManifestS3, err)
+		return fmt.Errorf("while doing a marshal on the manifest: %s", err)
 	}
-	destination.UploadToS3(bucketName, fmt.Sprintf("%s/manifest", s3Folder), manifestData)
+	return h.uploadControlToS3(ctx, bucketName, fmt.Sprintf("%s/manifest", s3Folder), manifestData)
 }
 
 // Check if credentials has been initialised and return a Service Client Value
 func (h *AwsHelper) CreateServiceClientValue() s3iface.S3API {
-	if h.RoleCreds == (credentials.Credentials{}) {
+	if h.RoleCreds == nil {
 		return s3.New(h.AwsSession)
-	} else {
-		return s3.New(h.AwsSession, &aws.Config{Credentials: &h.RoleCreds})
 	}
+	return s3.New(h.AwsSession, &aws.Config{Credentials: h.RoleCreds})
 }
@@ -0,0 +1,179 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestS3UploadOptionsValidate(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour)
+	optionsTest := []struct {
+		options S3UploadOptions
+		valid   bool
+	}{
+		{options: S3UploadOptions{}, valid: true},
+		{options: S3UploadOptions{StorageClass: "GLACIER_IR", SSEKMSKeyID: "alias/backups", Tags: map[string]string{"team": "music"}}, valid: true},
+		{options: S3UploadOptions{StorageClass: "COLD"}, valid: false},
+		{options: S3UploadOptions{ObjectLockMode: "COMPLIANCE", ObjectLockRetainUntil: future}, valid: true},
+		{options: S3UploadOptions{ObjectLockMode: "COMPLIANCE"}, valid: false},
+		{options: S3UploadOptions{ObjectLockMode: "FOREVER", ObjectLockRetainUntil: future}, valid: false},
+		{options: S3UploadOptions{ObjectLockRetainUntil: future}, valid: false},
+	}
+	for _, item := range optionsTest {
+		if err := item.options.Validate(); (err == nil) != item.valid {
+			t.Fatalf("Options %+v validity should be %t. Got: %v\n", item.options, item.valid, err)
+		}
+	}
+}
+
+func TestManifestEntryVerifyChecksum(t *testing.T) {
+	// Manifest written by the AWS DataPipeline, without checksums
+	oldManifest := []byte(`{"name":"DynamoDB-export","version":3,"entries":[{"url":"s3://bucket/folder/file","mandatory":true}]}`)
+	manifest := S3Manifest{}
+	if err := json.Unmarshal(oldManifest, &manifest); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := manifest.Entries[0].verifyChecksum([]byte("anything")); err != nil {
+		t.Fatalf("An entry without checksum should not be verified. Got: %s", err)
+	}
+
+	data := []byte("{\"artist\":{\"s\":\"Queen\"}}\n")
+	sum := sha256.Sum256(data)
+	entry := S3ManifestEntry{URL: "s3://bucket/folder/file", SHA256: hex.EncodeToString(sum[:]), Size: aws.Int64(int64(len(data))), ItemCount: aws.Int64(1)}
+	if err := entry.verifyChecksum(data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := entry.verifyChecksum(append(data, '\n')); err == nil {
+		t.Fatalf("A file of a different size should be rejected")
+	}
+	altered := []byte(string(data))
+	altered[3] = 'A'
+	if err := entry.verifyChecksum(altered); err == nil {
+		t.Fatalf("An altered file should be rejected")
+	}
+
+	manifest.Entries = append(manifest.Entries, entry)
+	manifest.computeTotals()
+	if *manifest.Totals != (S3ManifestTotals{Files: 2, Bytes: int64(len(data)), Items: 1}) {
+		t.Fatalf("Unexpected totals: %+v", *manifest.Totals)
+	}
+}
+
+func TestLoadManifestFromS3(t *testing.T) {
+	location := "file://" + t.TempDir()
+	ctx := context.Background()
+	h := &AwsHelper{}
+	manifests := map[string]string{
+		"first/manifest":  `{"name":"DynamoDB-export","version":3,"incomplete":true,"entries":[{"url":"s3://bucket/first/file.gz","mandatory":true,"compression":"gzip","sha256":"abcd"}]}`,
+		"second/manifest": `{"name":"DynamoDB-export","version":3,"entries":[{"url":"s3://bucket/second/file","mandatory":true}]}`,
+	}
+	for key, data := range manifests {
+		if err := h.UploadToS3(ctx, location, key, []byte(data)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	// Nothing of the first manifest is kept in the second one
+	for _, key := range []string{"first/manifest", "second/manifest"} {
+		if err := h.LoadManifestFromS3(location, key); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	entry := h.ManifestS3.Entries[0]
+	if h.ManifestS3.Incomplete || entry.URL != "s3://bucket/second/file" || entry.Compression != "" || entry.SHA256 != "" {
+		t.Fatalf("Unexpected manifest %+v", h.ManifestS3)
+	}
+}
+
+func TestChannelWriterFailureStopsScan(t *testing.T) {
+	// A folder can't be created in a regular file
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	location := "file://" + file
+	writers := map[string]func(h *AwsHelper, ctx context.Context) error{
+		"ChannelToS3": func(h *AwsHelper, ctx context.Context) error {
+			return h.ChannelToS3(ctx, location, "backup", 1, &AwsHelper{})
+		},
+		"ChannelToExport": func(h *AwsHelper, ctx context.Context) error {
+			return h.ChannelToExport(ctx, location, "backup", 1, &AwsHelper{})
+		},
+	}
+	for name, writer := range writers {
+		scanCtx, cancel := context.WithCancel(context.Background())
+		h := &AwsHelper{DataPipe: make(chan map[string]*dynamodb.AttributeValue), StopScan: cancel}
+		// An endless scan, only stopped once its context is done
+		go func() {
+			defer close(h.DataPipe)
+			for {
+				select {
+				case h.DataPipe <- map[string]*dynamodb.AttributeValue{"artist": {S: aws.String("Queen")}}:
+				case <-scanCtx.Done():
+					return
+				}
+			}
+		}()
+
+		done := make(chan error)
+		h.Wg.Add(1)
+		go func() {
+			done <- writer(h, context.Background())
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatalf("%s: expecting the error of the upload", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the scan didn't stop once the upload failed", name)
+		}
+		cancel()
+	}
+}
+
+func TestChannelToS3EndTime(t *testing.T) {
+	location := "file://" + t.TempDir()
+	h := &AwsHelper{DataPipe: make(chan map[string]*dynamodb.AttributeValue)}
+	go func() {
+		h.DataPipe <- map[string]*dynamodb.AttributeValue{"artist": {S: aws.String("Queen")}}
+		close(h.DataPipe)
+	}()
+	start := time.Now()
+	h.Wg.Add(1)
+	if err := h.ChannelToS3(context.Background(), location, "backup", 1, &AwsHelper{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The restores can't stop before the end of the backup
+	if err := h.LoadManifestFromS3(location, "backup/manifest"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if end := h.ManifestS3.EndTime; end == nil || end.Before(start) || end.After(time.Now()) {
+		t.Fatalf("Unexpected end time %v of the backup started at %s", end, start)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultShutdownTimeout is the default time given to a backup to flush its
+// data once it is interrupted
+const DefaultShutdownTimeout = 30 * time.Second
+
+// shutdownTimeout returns the ShutdownTimeout of the struct, or the default one
+func (h *AwsHelper) shutdownTimeout() time.Duration {
+	if h.ShutdownTimeout <= 0 {
+		return DefaultShutdownTimeout
+	}
+	return h.ShutdownTimeout
+}
+
+// shutdownContext returns a context that is canceled the given timeout after
+// the parent context is done, giving a deadline to the work that must still be
+// done once interrupted
+func shutdownContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,40 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShutdownContext(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := shutdownContext(parent, 50*time.Millisecond)
+	defer cancel()
+
+	cancelParent()
+	select {
+	case <-ctx.Done():
+		t.Fatal("The shutdown context should outlive its parent until the timeout")
+	case <-time.After(10 * time.Millisecond):
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("The shutdown context should be canceled once the timeout is over")
+	}
+}
@@ -0,0 +1,342 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// S3Scheme is the scheme of the URLs of the files stored in s3
+	S3Scheme = "s3"
+	// FileScheme is the scheme of the URLs of the files stored in a local
+	// folder
+	FileScheme = "file"
+)
+
+// Storage holds the files of the backups, under keys made of slash separated
+// folder and file names
+type Storage interface {
+	// Put writes the given data to the file of the given key
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns a reader of the file of the given key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Head checks that the file of the given key exists
+	Head(ctx context.Context, key string) (bool, error)
+	// List returns the keys of the files directly in the given folder, and of
+	// its subfolders followed by a slash, sorted
+	List(ctx context.Context, folder string) ([]string, error)
+	// Delete removes the file of the given key, if it exists
+	Delete(ctx context.Context, key string) error
+}
+
+// Storage returns the storage of the given location: the name of an s3
+// bucket, or an s3:// or file:// URL. A file:// URL points to a local folder,
+// the root of the keys
+func (h *AwsHelper) Storage(location string) (Storage, error) {
+	switch {
+	case strings.HasPrefix(location, FileScheme+"://"):
+		return &localStorage{root: filepath.FromSlash(strings.TrimPrefix(location, FileScheme+"://"))}, nil
+	case strings.HasPrefix(location, S3Scheme+"://"):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(location, S3Scheme+"://"), "/")
+		if bucket == "" || strings.Contains(bucket, "/") {
+			return nil, fmt.Errorf("Invalid location %s, an s3 location is a bucket", location)
+		}
+		return &s3Storage{helper: h, bucket: bucket}, nil
+	case strings.Contains(location, "://"):
+		return nil, fmt.Errorf("Unsupported location %s, must be an s3 bucket or a file:// URL", location)
+	}
+	return &s3Storage{helper: h, bucket: location}, nil
+}
+
+// IsLocalStorage tells if the given location is a file:// URL of a local
+// folder, which needs no s3 region
+func IsLocalStorage(location string) bool {
+	return strings.HasPrefix(location, FileScheme+"://")
+}
+
+// StorageURL returns the URL of the file of the given key in the given
+// location, recorded in the manifests. The URL of a local file is absolute
+func StorageURL(location, key string) string {
+	if strings.HasPrefix(location, FileScheme+"://") {
+		path := filepath.Join(filepath.FromSlash(strings.TrimPrefix(location, FileScheme+"://")), filepath.FromSlash(key))
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		return fmt.Sprintf("%s://%s", FileScheme, filepath.ToSlash(path))
+	}
+	return fmt.Sprintf("%s://%s/%s", S3Scheme, strings.TrimSuffix(strings.TrimPrefix(location, S3Scheme+"://"), "/"), key)
+}
+
+// splitStorageURL returns the location and the key of the file of the given
+// URL, as understood by AwsHelper.Storage. ok is false for the URLs of an
+// unsupported scheme
+func splitStorageURL(rawURL string) (location, key string, ok bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", false
+	}
+	switch u.Scheme {
+	case S3Scheme:
+		return u.Host, strings.TrimPrefix(u.Path, "/"), true
+	case FileScheme:
+		// The key of a local file is its absolute path
+		return FileScheme + "://", u.Path, true
+	}
+	return "", "", false
+}
+
+// s3Storage stores the files in an s3 bucket, with the credentials, the retry
+// policy and the upload options of its helper. The control files are stored
+// in the STANDARD storage class whatever the upload options
+type s3Storage struct {
+	helper  *AwsHelper
+	bucket  string
+	control bool
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, data []byte) error {
+	h := s.helper
+	uploader := s3manager.NewUploaderWithClient(h.CreateServiceClientValue())
+
+	storageClass := h.Upload.StorageClass
+	switch {
+	case s.control:
+		storageClass = "STANDARD"
+	case storageClass == "":
+		storageClass = "STANDARD_IA"
+	}
+	upParams := &s3manager.UploadInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(data),
+		StorageClass:         aws.String(storageClass),
+		ServerSideEncryption: aws.String("AES256"),
+	}
+	if h.Upload.SSEKMSKeyID != "" {
+		upParams.ServerSideEncryption = aws.String("aws:kms")
+		upParams.SSEKMSKeyId = aws.String(h.Upload.SSEKMSKeyID)
+	}
+	if len(h.Upload.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range h.Upload.Tags {
+			tags.Set(k, v)
+		}
+		upParams.Tagging = aws.String(tags.Encode())
+	}
+	if h.Upload.ObjectLockMode != "" {
+		upParams.ObjectLockMode = aws.String(h.Upload.ObjectLockMode)
+		upParams.ObjectLockRetainUntilDate = aws.Time(h.Upload.ObjectLockRetainUntil)
+		// Object Lock requires the Content-MD5 of the object, which is only
+		// sent for single part uploads
+		sum := md5.Sum(data)
+		upParams.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		if int64(len(data)) >= uploader.PartSize {
+			uploader.PartSize = int64(len(data)) + 1
+		}
+	}
+	return h.retryPolicy().Do(ctx, "PutObject", func() error {
+		// Every attempt needs to read the body from the start
+		upParams.Body = bytes.NewReader(data)
+		_, err := uploader.UploadWithContext(ctx, upParams)
+		return err
+	})
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	svc := s.helper.CreateServiceClientValue()
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+
+	var results *s3.GetObjectOutput
+	err := s.helper.retryPolicy().Do(ctx, "GetObject", func() (err error) {
+		results, err = svc.GetObjectWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results.Body, nil
+}
+
+func (s *s3Storage) Head(ctx context.Context, key string) (bool, error) {
+	svc := s.helper.CreateServiceClientValue()
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+
+	_, err := svc.HeadObjectWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *s3Storage) List(ctx context.Context, folder string) ([]string, error) {
+	svc := s.helper.CreateServiceClientValue()
+	// The empty folder is the root of the bucket
+	prefix := folder + "/"
+	if folder == "" {
+		prefix = ""
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	keys := []string{}
+	err := s.helper.retryPolicy().Do(ctx, "ListObjectsV2", func() error {
+		keys = keys[:0]
+		return svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, prefix := range page.CommonPrefixes {
+				keys = append(keys, aws.StringValue(prefix.Prefix))
+			}
+			for _, object := range page.Contents {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	svc := s.helper.CreateServiceClientValue()
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+
+	_, err := svc.DeleteObjectWithContext(ctx, input)
+	return err
+}
+
+// localStorage stores the files in a local folder, creating the subfolders as
+// needed. The upload options only apply to s3 and are ignored
+type localStorage struct {
+	root string
+}
+
+// path returns the path of the file of the given key
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *localStorage) Put(ctx context.Context, key string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// The file is written next to its final path then renamed, so that a
+	// reader never sees a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *localStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(s.path(key))
+}
+
+func (s *localStorage) Head(ctx context.Context, key string) (bool, error) {
+	info, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+func (s *localStorage) List(ctx context.Context, folder string) ([]string, error) {
+	files, err := ioutil.ReadDir(s.path(folder))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, file := range files {
+		// Skips the files being written
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		key := file.Name()
+		if folder != "" {
+			key = fmt.Sprintf("%s/%s", folder, key)
+		}
+		if file.IsDir() {
+			key += "/"
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
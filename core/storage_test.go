@@ -0,0 +1,138 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestStorageLocation(t *testing.T) {
+	h := &AwsHelper{}
+	locationTest := []struct {
+		location string
+		local    bool
+		valid    bool
+	}{
+		{location: "bucket-name", valid: true},
+		{location: "s3://bucket-name", valid: true},
+		{location: "s3://bucket-name/folder", valid: false},
+		{location: "file:///var/backups", local: true, valid: true},
+		{location: "gs://bucket-name", valid: false},
+	}
+	for _, item := range locationTest {
+		storage, err := h.Storage(item.location)
+		if (err == nil) != item.valid {
+			t.Fatalf("Location %s validity should be %t. Got: %v", item.location, item.valid, err)
+		}
+		if _, local := storage.(*localStorage); err == nil && local != item.local {
+			t.Fatalf("Location %s should be local: %t", item.location, item.local)
+		}
+	}
+
+	urlTest := []struct {
+		location string
+		url      string
+	}{
+		{location: "bucket-name", url: "s3://bucket-name/folder/manifest"},
+		{location: "s3://bucket-name", url: "s3://bucket-name/folder/manifest"},
+		{location: "file:///var/backups", url: "file:///var/backups/folder/manifest"},
+	}
+	for _, item := range urlTest {
+		u := StorageURL(item.location, "folder/manifest")
+		if u != item.url {
+			t.Fatalf("Expecting the URL %s, got %s", item.url, u)
+		}
+		location, key, ok := splitStorageURL(u)
+		if !ok || StorageURL(location, key) != u {
+			t.Fatalf("Unable to split the URL %s, got %s and %s", u, location, key)
+		}
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynamodump")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	location := "file://" + dir
+	ctx := context.Background()
+	h := &AwsHelper{}
+
+	// Only the complete backups are candidates for the latest one
+	for _, folder := range []string{"backups/2030-01-01-00-00-00", "backups/2030-01-02-00-00-00"} {
+		if err := h.UploadToS3(ctx, location, folder+"/_SUCCESS", []byte{}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := h.UploadToS3(ctx, location, "backups/2030-01-03-00-00-00/checkpoint", []byte("{}")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	latest, err := h.LatestBackupFolder(ctx, location, "backups")
+	if err != nil || latest != "backups/2030-01-02-00-00-00" {
+		t.Fatalf("Expecting the latest backup backups/2030-01-02-00-00-00, got %s (%v)", latest, err)
+	}
+	if err := h.UploadToS3(ctx, location, "2030-01-04-00-00-00/_SUCCESS", []byte{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	latest, err = h.LatestBackupFolder(ctx, location, "")
+	if err != nil || latest != "2030-01-04-00-00-00" {
+		t.Fatalf("Expecting the latest backup 2030-01-04-00-00-00 at the root, got %s (%v)", latest, err)
+	}
+	if _, err := h.LatestBackupFolder(ctx, location, "missing"); !errors.Is(err, ErrManifestNotFound) {
+		t.Fatalf("Expecting ErrManifestNotFound, got %v", err)
+	}
+
+	// A backup written to disk is read back through the URLs of its manifest
+	folder := "backups/2030-01-02-00-00-00"
+	buff := bytes.NewBufferString("{\"artist\":{\"S\":\"Queen\"}}\n")
+	if err := h.DumpBuffer(ctx, location, folder, buff, 1); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := h.manifestToS3(ctx, location, folder, false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(h.ManifestS3.Entries[0].URL, "file://"+dir+"/"+folder+"/") {
+		t.Fatalf("Unexpected URL %s", h.ManifestS3.Entries[0].URL)
+	}
+	reader := &AwsHelper{}
+	artists := []string{}
+	err = reader.BackupItems(ctx, location, folder, func(item map[string]*dynamodb.AttributeValue) error {
+		artists = append(artists, *item["artist"].S)
+		return nil
+	})
+	if err != nil || len(artists) != 1 || artists[0] != "Queen" {
+		t.Fatalf("Expecting the item of the backup, got %v (%v)", artists, err)
+	}
+
+	if err := h.DeleteFromS3(location, folder+"/_SUCCESS"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if exists, err := h.ExistsInS3(location, folder+"/_SUCCESS"); err != nil || exists {
+		t.Fatalf("Expecting the file to be deleted, got %t (%v)", exists, err)
+	}
+	if err := h.LoadManifestFromS3(location, "missing/manifest"); !errors.Is(err, ErrManifestNotFound) {
+		t.Fatalf("Expecting ErrManifestNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,417 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+const (
+	// ChangesFolderName is the folder of a full backup holding the incremental
+	// backups that follow it, each one in a folder named after its UTC date
+	ChangesFolderName = "incremental"
+	// ChangesManifestName is the name of the manifests of the incremental
+	// backups
+	ChangesManifestName = "DynamoDB-changes"
+)
+
+// StreamsAPI is the part of the DynamoDB Streams API used to read the changes
+// of a table. It is implemented by the dynamodbstreams client and can be faked
+// locally
+type StreamsAPI interface {
+	DescribeStreamWithContext(aws.Context, *dynamodbstreams.DescribeStreamInput, ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIteratorWithContext(aws.Context, *dynamodbstreams.GetShardIteratorInput, ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecordsWithContext(aws.Context, *dynamodbstreams.GetRecordsInput, ...request.Option) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+// ChangeRecord is a change of an item read from the stream of a table, as
+// written in the change files of an incremental backup. EventName is INSERT,
+// MODIFY or REMOVE, and NewImage is missing from the REMOVE records
+type ChangeRecord struct {
+	EventName      string                           `json:"eventName"`
+	ShardID        string                           `json:"shardId"`
+	SequenceNumber string                           `json:"sequenceNumber"`
+	Timestamp      time.Time                        `json:"timestamp"`
+	Keys           map[string]*CustomAttributeValue `json:"keys"`
+	NewImage       map[string]*CustomAttributeValue `json:"newImage,omitempty"`
+	OldImage       map[string]*CustomAttributeValue `json:"oldImage,omitempty"`
+}
+
+// StreamShardCheckpoint is the position reached in a shard of a stream: the
+// sequence number of the last record read, if any, and whether the shard is
+// closed and was read entirely
+type StreamShardCheckpoint struct {
+	ShardID        string `json:"shardId"`
+	SequenceNumber string `json:"sequenceNumber,omitempty"`
+	Done           bool   `json:"done"`
+}
+
+// StreamProgress keeps track of the position reached in each shard of a
+// stream, so that the next incremental backup starts where the previous one
+// stopped
+type StreamProgress struct {
+	mu     sync.Mutex
+	shards map[string]StreamShardCheckpoint
+}
+
+// NewStreamProgress creates a StreamProgress reading the stream from its
+// oldest record
+func NewStreamProgress() *StreamProgress {
+	return &StreamProgress{shards: make(map[string]StreamShardCheckpoint)}
+}
+
+// ResumeStreamProgress creates a StreamProgress starting where the given
+// checkpoints stopped
+func ResumeStreamProgress(checkpoints []StreamShardCheckpoint) *StreamProgress {
+	p := NewStreamProgress()
+	for _, checkpoint := range checkpoints {
+		p.shards[checkpoint.ShardID] = checkpoint
+	}
+	return p
+}
+
+// shard returns the checkpoint of the given shard
+func (p *StreamProgress) shard(shardID string) StreamShardCheckpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	checkpoint, ok := p.shards[shardID]
+	if !ok {
+		checkpoint.ShardID = shardID
+	}
+	return checkpoint
+}
+
+// update records the position reached in the given shard
+func (p *StreamProgress) update(checkpoint StreamShardCheckpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.shards[checkpoint.ShardID] = checkpoint
+}
+
+// prune forgets the shards read entirely that are not listed anymore, as their
+// records were trimmed from the stream. Returns an error if a shard that was
+// not read entirely is not listed anymore, as some of its records are lost
+func (p *StreamProgress) prune(listed map[string]bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for shardID, checkpoint := range p.shards {
+		if listed[shardID] {
+			continue
+		}
+		if !checkpoint.Done {
+			return fmt.Errorf("%w: shard %s", ErrChangesTrimmed, shardID)
+		}
+		delete(p.shards, shardID)
+	}
+	return nil
+}
+
+// Checkpoints returns the position reached in each shard, sorted by shard ID
+func (p *StreamProgress) Checkpoints() []StreamShardCheckpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	checkpoints := []StreamShardCheckpoint{}
+	for _, checkpoint := range p.shards {
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].ShardID < checkpoints[j].ShardID })
+	return checkpoints
+}
+
+// TableStreamArn returns the ARN of the stream of the given table, checking
+// that its records hold the new image of the items
+func (h *AwsHelper) TableStreamArn(tableName string) (string, error) {
+	result, err := h.DynamoSvc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return "", tableError(tableName, err)
+	}
+	spec := result.Table.StreamSpecification
+	if spec == nil || !aws.BoolValue(spec.StreamEnabled) || result.Table.LatestStreamArn == nil {
+		return "", fmt.Errorf("The stream of the table %s is not enabled", tableName)
+	}
+	switch viewType := aws.StringValue(spec.StreamViewType); viewType {
+	case dynamodb.StreamViewTypeNewImage, dynamodb.StreamViewTypeNewAndOldImages:
+	default:
+		return "", fmt.Errorf("The stream of the table %s must hold the new images of the items, its view type is %s", tableName, viewType)
+	}
+	return *result.Table.LatestStreamArn, nil
+}
+
+// streamShards lists the shards of the given stream
+func (h *AwsHelper) streamShards(ctx context.Context, streamArn string) ([]*dynamodbstreams.Shard, error) {
+	shards := []*dynamodbstreams.Shard{}
+	input := &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(streamArn)}
+	for {
+		var out *dynamodbstreams.DescribeStreamOutput
+		err := h.retryPolicy().Do(ctx, "DescribeStream", func() (err error) {
+			out, err = h.StreamsSvc.DescribeStreamWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, out.StreamDescription.Shards...)
+		if out.StreamDescription.LastEvaluatedShardId == nil {
+			return shards, nil
+		}
+		input.ExclusiveStartShardId = out.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// ReadStream passes the records of the given stream to the given function,
+// starting from the positions of the given progress and updating them. The
+// shards are read one at a time, a child shard once its parent was read
+// entirely so that the changes of an item are passed in order. The open
+// shards are read until no record is left, waiting waitPeriod between two
+// pages
+func (h *AwsHelper) ReadStream(ctx context.Context, streamArn string, progress *StreamProgress, waitPeriod time.Duration, fn func(change *ChangeRecord) error) error {
+	shards, err := h.streamShards(ctx, streamArn)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, shard := range shards {
+		listed[aws.StringValue(shard.ShardId)] = true
+	}
+	if err := progress.prune(listed); err != nil {
+		return err
+	}
+
+	for len(shards) > 0 {
+		var waiting []*dynamodbstreams.Shard
+		for _, shard := range shards {
+			parent := aws.StringValue(shard.ParentShardId)
+			if listed[parent] && !progress.shard(parent).Done {
+				waiting = append(waiting, shard)
+				continue
+			}
+			if err := h.readShard(ctx, streamArn, shard, progress, waitPeriod, fn); err != nil {
+				return err
+			}
+		}
+		// The children of an open shard wait for the next backup
+		if len(waiting) == len(shards) {
+			break
+		}
+		shards = waiting
+	}
+	return nil
+}
+
+// readShard passes the records of a shard to the given function, from the
+// position of the given progress. A closed shard is read entirely, an open
+// one until no record is left
+func (h *AwsHelper) readShard(ctx context.Context, streamArn string, shard *dynamodbstreams.Shard, progress *StreamProgress, waitPeriod time.Duration, fn func(change *ChangeRecord) error) error {
+	checkpoint := progress.shard(aws.StringValue(shard.ShardId))
+	if checkpoint.Done {
+		return nil
+	}
+	closed := shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil
+	iterator, err := h.shardIterator(ctx, streamArn, checkpoint)
+	if err != nil {
+		return err
+	}
+	var changes int64
+	r := h.retryPolicy().newRetrier(ctx, "GetRecords")
+	for iterator != nil {
+		out, err := h.StreamsSvc.GetRecordsWithContext(ctx, &dynamodbstreams.GetRecordsInput{ShardIterator: iterator})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// The iterators expire 15 minutes after being issued
+			if errorCode(err) == dynamodbstreams.ErrCodeExpiredIteratorException {
+				if iterator, err = h.shardIterator(ctx, streamArn, checkpoint); err != nil {
+					return err
+				}
+				continue
+			}
+			if r.retry(err) {
+				continue
+			}
+			return r.giveUp(err)
+		}
+		r.reset()
+		for _, record := range out.Records {
+			change := newChangeRecord(checkpoint.ShardID, record)
+			if err := fn(change); err != nil {
+				return err
+			}
+			checkpoint.SequenceNumber = change.SequenceNumber
+			changes++
+		}
+		iterator = out.NextShardIterator
+		checkpoint.Done = iterator == nil
+		progress.update(checkpoint)
+		if len(out.Records) == 0 && !closed {
+			break
+		}
+		if iterator != nil {
+			time.Sleep(waitPeriod)
+		}
+	}
+	log.Printf("Shard: %s, Changes: %d, Closed: %t\n", checkpoint.ShardID, changes, checkpoint.Done)
+	return nil
+}
+
+// shardIterator returns an iterator reading a shard after the position of the
+// given checkpoint, or from its oldest record if the shard was never read
+func (h *AwsHelper) shardIterator(ctx context.Context, streamArn string, checkpoint StreamShardCheckpoint) (*string, error) {
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(streamArn),
+		ShardId:           aws.String(checkpoint.ShardID),
+		ShardIteratorType: aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon),
+	}
+	if checkpoint.SequenceNumber != "" {
+		input.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeAfterSequenceNumber)
+		input.SequenceNumber = aws.String(checkpoint.SequenceNumber)
+	}
+	var out *dynamodbstreams.GetShardIteratorOutput
+	err := h.retryPolicy().Do(ctx, "GetShardIterator", func() (err error) {
+		out, err = h.StreamsSvc.GetShardIteratorWithContext(ctx, input)
+		return err
+	})
+	if errorCode(err) == dynamodbstreams.ErrCodeTrimmedDataAccessException {
+		return nil, fmt.Errorf("%w: shard %s", ErrChangesTrimmed, checkpoint.ShardID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.ShardIterator, nil
+}
+
+// newChangeRecord translates a record of the given shard
+func newChangeRecord(shardID string, record *dynamodbstreams.Record) *ChangeRecord {
+	change := &ChangeRecord{EventName: aws.StringValue(record.EventName), ShardID: shardID}
+	if data := record.Dynamodb; data != nil {
+		change.SequenceNumber = aws.StringValue(data.SequenceNumber)
+		change.Timestamp = aws.TimeValue(data.ApproximateCreationDateTime).UTC()
+		change.Keys = toCustomAttributeMap(data.Keys)
+		change.NewImage = toCustomAttributeMap(data.NewImage)
+		change.OldImage = toCustomAttributeMap(data.OldImage)
+	}
+	return change
+}
+
+// changeFileName returns the name of a change file starting with a change at
+// the given time
+func changeFileName(first time.Time) string {
+	return fmt.Sprintf("%s-%s", first.UTC().Format("20060102T150405Z"), genNewFileName())
+}
+
+// StreamToS3 reads the changes of the given stream from the positions of the
+// given progress, and writes them to the given s3 folder in change files of
+// about s3BufferSize named after their first change. Once the stream is read,
+// or the context is done, the manifest of the destination is written along
+// with the positions reached in each shard, within the ShutdownTimeout of the
+// struct. The Base and Previous of the manifest must be set by the caller.
+// Returns the number of changes written
+func (h *AwsHelper) StreamToS3(ctx context.Context, streamArn string, progress *StreamProgress, waitPeriod time.Duration, bucketName, s3Folder string, s3BufferSize int, destination *AwsHelper) (int64, error) {
+	uploadCtx, cancel := shutdownContext(ctx, h.shutdownTimeout())
+	defer cancel()
+	destination.ManifestS3.Version = 3
+	destination.ManifestS3.Name = ChangesManifestName
+	destination.ManifestS3.StreamArn = streamArn
+
+	var buff bytes.Buffer
+	var itemCount, total int64
+	var first time.Time
+	var writeErr error
+	readErr := h.ReadStream(ctx, streamArn, progress, waitPeriod, func(change *ChangeRecord) error {
+		data, err := json.Marshal(change)
+		if err != nil {
+			writeErr = fmt.Errorf("while converting to json: %v\nError: %s", change, err)
+			return writeErr
+		}
+		if itemCount == 0 {
+			first = change.Timestamp
+		}
+		buff.Write(data)
+		buff.WriteString("\n")
+		itemCount++
+		total++
+		if buff.Len() >= s3BufferSize {
+			if writeErr = destination.dumpBuffer(uploadCtx, bucketName, s3Folder, changeFileName(first), &buff, itemCount); writeErr != nil {
+				return writeErr
+			}
+			itemCount = 0
+		}
+		return nil
+	})
+	// The positions only match the changes written if the stream was read
+	// entirely or interrupted
+	if writeErr != nil {
+		return total, writeErr
+	}
+	if readErr != nil && !errors.Is(readErr, ctx.Err()) {
+		return total, readErr
+	}
+
+	if buff.Len() > 0 {
+		if err := destination.dumpBuffer(uploadCtx, bucketName, s3Folder, changeFileName(first), &buff, itemCount); err != nil {
+			return total, err
+		}
+	}
+	destination.ManifestS3.Shards = progress.Checkpoints()
+	if err := destination.manifestToS3(uploadCtx, bucketName, s3Folder, false); err != nil {
+		return total, err
+	}
+	return total, readErr
+}
+
+// ChangesManifests returns the paths of the manifests of the incremental
+// backups following the full backup in the given folder, oldest first
+func (h *AwsHelper) ChangesManifests(ctx context.Context, bucketName, s3Folder string) ([]string, error) {
+	storage, err := h.Storage(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := storage.List(ctx, fmt.Sprintf("%s/%s", s3Folder, ChangesFolderName))
+	if err != nil {
+		return nil, err
+	}
+	// The folders are named after their date, and have no manifest if the
+	// incremental backup failed
+	manifests := []string{}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") {
+			continue
+		}
+		manifest := key + "manifest"
+		exists, err := storage.Head(ctx, manifest)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			manifests = append(manifests, manifest)
+		}
+	}
+	return manifests, nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+// struct to mock a stream whose closed shard "parent" has 3 records and its
+// open child shard "child" 2 records, returned by pages of 2 records
+type mockStreamsClient struct {
+	shards  []*dynamodbstreams.Shard
+	records map[string][]*dynamodbstreams.Record
+}
+
+func newMockStreamsClient() *mockStreamsClient {
+	m := &mockStreamsClient{
+		// The child is listed first
+		shards: []*dynamodbstreams.Shard{
+			{ShardId: aws.String("child"), ParentShardId: aws.String("parent"), SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{StartingSequenceNumber: aws.String("200")}},
+			{ShardId: aws.String("parent"), SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{StartingSequenceNumber: aws.String("100"), EndingSequenceNumber: aws.String("102")}},
+		},
+		records: make(map[string][]*dynamodbstreams.Record),
+	}
+	events := map[string][]string{"parent": {"INSERT", "MODIFY", "REMOVE"}, "child": {"INSERT", "MODIFY"}}
+	for shard, start := range map[string]int{"parent": 100, "child": 200} {
+		for i, event := range events[shard] {
+			data := &dynamodbstreams.StreamRecord{
+				SequenceNumber: aws.String(strconv.Itoa(start + i)),
+				Keys:           map[string]*dynamodb.AttributeValue{"artist": {S: aws.String("Queen")}},
+			}
+			if event != "REMOVE" {
+				data.NewImage = map[string]*dynamodb.AttributeValue{
+					"artist": {S: aws.String("Queen")},
+					"albums": {L: []*dynamodb.AttributeValue{{M: map[string]*dynamodb.AttributeValue{"year": {N: aws.String(strconv.Itoa(1970 + i))}}}}},
+				}
+			}
+			m.records[shard] = append(m.records[shard], &dynamodbstreams.Record{EventName: aws.String(event), Dynamodb: data})
+		}
+	}
+	return m
+}
+
+func (m *mockStreamsClient) DescribeStreamWithContext(ctx aws.Context, input *dynamodbstreams.DescribeStreamInput, opts ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error) {
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: &dynamodbstreams.StreamDescription{Shards: m.shards}}, nil
+}
+
+func (m *mockStreamsClient) GetShardIteratorWithContext(ctx aws.Context, input *dynamodbstreams.GetShardIteratorInput, opts ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	shardID := aws.StringValue(input.ShardId)
+	position := 0
+	if aws.StringValue(input.ShardIteratorType) == dynamodbstreams.ShardIteratorTypeAfterSequenceNumber {
+		position = -1
+		for i, record := range m.records[shardID] {
+			if aws.StringValue(record.Dynamodb.SequenceNumber) == aws.StringValue(input.SequenceNumber) {
+				position = i + 1
+			}
+		}
+		if position < 0 {
+			return nil, fmt.Errorf("Unknown sequence number %s", aws.StringValue(input.SequenceNumber))
+		}
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s/%d", shardID, position))}, nil
+}
+
+func (m *mockStreamsClient) GetRecordsWithContext(ctx aws.Context, input *dynamodbstreams.GetRecordsInput, opts ...request.Option) (*dynamodbstreams.GetRecordsOutput, error) {
+	parts := strings.Split(aws.StringValue(input.ShardIterator), "/")
+	shardID := parts[0]
+	position, _ := strconv.Atoi(parts[1])
+	records := m.records[shardID]
+	end := position + 2
+	if end > len(records) {
+		end = len(records)
+	}
+	out := &dynamodbstreams.GetRecordsOutput{Records: records[position:end]}
+	if shardID == "child" || end < len(records) {
+		out.NextShardIterator = aws.String(fmt.Sprintf("%s/%d", shardID, end))
+	}
+	return out, nil
+}
+
+func TestReadStream(t *testing.T) {
+	h := &AwsHelper{StreamsSvc: newMockStreamsClient()}
+	progress := NewStreamProgress()
+	var changes []*ChangeRecord
+	err := h.ReadStream(context.Background(), "arn", progress, 0, func(change *ChangeRecord) error {
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The parent is read before its child
+	expected := []string{"100", "101", "102", "200", "201"}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expecting %d changes, got %d", len(expected), len(changes))
+	}
+	for i, change := range changes {
+		if change.SequenceNumber != expected[i] {
+			t.Fatalf("Expecting the change %s at %d, got %s", expected[i], i, change.SequenceNumber)
+		}
+	}
+	if changes[2].EventName != "REMOVE" || changes[2].NewImage != nil || *changes[2].Keys["artist"].S != "Queen" {
+		t.Fatalf("Unexpected REMOVE record %+v", changes[2])
+	}
+	if *changes[1].NewImage["albums"].L[0].M["year"].N != "1971" {
+		t.Fatalf("Unexpected new image %+v", changes[1].NewImage)
+	}
+
+	checkpoints := progress.Checkpoints()
+	if len(checkpoints) != 2 || checkpoints[0] != (StreamShardCheckpoint{ShardID: "child", SequenceNumber: "201"}) ||
+		checkpoints[1] != (StreamShardCheckpoint{ShardID: "parent", SequenceNumber: "102", Done: true}) {
+		t.Fatalf("Unexpected checkpoints %+v", checkpoints)
+	}
+
+	// A new record of the child is the only one read from the checkpoints
+	mock := newMockStreamsClient()
+	mock.records["child"] = append(mock.records["child"], &dynamodbstreams.Record{
+		EventName: aws.String("REMOVE"),
+		Dynamodb:  &dynamodbstreams.StreamRecord{SequenceNumber: aws.String("202"), Keys: map[string]*dynamodb.AttributeValue{"artist": {S: aws.String("Queen")}}},
+	})
+	h.StreamsSvc = mock
+	changes = nil
+	err = h.ReadStream(context.Background(), "arn", ResumeStreamProgress(checkpoints), 0, func(change *ChangeRecord) error {
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(changes) != 1 || changes[0].SequenceNumber != "202" {
+		t.Fatalf("Expecting only the new change to be read, got %d changes", len(changes))
+	}
+}
+
+func TestReadStreamTrimmed(t *testing.T) {
+	mock := newMockStreamsClient()
+	h := &AwsHelper{StreamsSvc: mock}
+
+	// The parent read entirely is trimmed from the stream
+	mock.shards = mock.shards[:1]
+	progress := ResumeStreamProgress([]StreamShardCheckpoint{{ShardID: "parent", SequenceNumber: "102", Done: true}, {ShardID: "child", SequenceNumber: "200"}})
+	if err := h.ReadStream(context.Background(), "arn", progress, 0, func(change *ChangeRecord) error { return nil }); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if checkpoints := progress.Checkpoints(); len(checkpoints) != 1 || checkpoints[0].ShardID != "child" {
+		t.Fatalf("Expecting the parent to be forgotten, got %+v", checkpoints)
+	}
+
+	// The child is trimmed before being read entirely
+	mock.shards = nil
+	err := h.ReadStream(context.Background(), "arn", progress, 0, func(change *ChangeRecord) error { return nil })
+	if !errors.Is(err, ErrChangesTrimmed) {
+		t.Fatalf("Expecting ErrChangesTrimmed, got %v", err)
+	}
+}
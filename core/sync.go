@@ -0,0 +1,142 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// KeySet records the keys of the items of a backup, so the items of a table
+// missing from the backup can be found. The keys are kept in memory
+type KeySet struct {
+	attributes []string
+
+	mu    sync.Mutex
+	keys  map[string]struct{}
+	items int64
+}
+
+// NewKeySet creates a KeySet recording the key attributes of the table of the
+// given definition
+func NewKeySet(def *TableDefinition) *KeySet {
+	s := &KeySet{keys: make(map[string]struct{})}
+	for _, key := range def.KeySchema {
+		s.attributes = append(s.attributes, key.AttributeName)
+	}
+	return s
+}
+
+// keyString returns the key of the given item as a string, the json
+// representation of its key attributes
+func (s *KeySet) keyString(item map[string]*dynamodb.AttributeValue) (string, error) {
+	key := make(map[string]*dynamodb.AttributeValue, len(s.attributes))
+	for _, attribute := range s.attributes {
+		value, ok := item[attribute]
+		if !ok {
+			return "", fmt.Errorf("the item has no key attribute %s", attribute)
+		}
+		key[attribute] = value
+	}
+	data, err := MarshalDynamoAttributeMap(key)
+	if err != nil {
+		return "", fmt.Errorf("while converting the key to json: %s", err)
+	}
+	return string(data), nil
+}
+
+// Add records the key of the given item
+func (s *KeySet) Add(item map[string]*dynamodb.AttributeValue) error {
+	if s == nil {
+		return nil
+	}
+	key, err := s.keyString(item)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key] = struct{}{}
+	s.items++
+	return nil
+}
+
+// Contains tells if the key of the given item was recorded
+func (s *KeySet) Contains(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	key, err := s.keyString(item)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.keys[key]
+	return ok, nil
+}
+
+// Items returns the number of items recorded, including the ones sharing the
+// same key
+func (s *KeySet) Items() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items
+}
+
+// SyncReport sums up the writes and the deletes making a table match a
+// backup. The keys to delete are only listed by a dry run
+type SyncReport struct {
+	DryRun      bool                               `json:"dryRun"`
+	Puts        int64                              `json:"puts"`
+	Deletes     int64                              `json:"deletes"`
+	DeletedKeys []map[string]*CustomAttributeValue `json:"deletedKeys,omitempty"`
+}
+
+// DeleteExtraItems deletes the items of the table of the given definition
+// whose key is not in the given KeySet, scanning the keys of the table as
+// TruncateTable does. When dryRun is set, nothing is deleted and the keys are
+// listed in the report instead
+func (h *AwsHelper) DeleteExtraItems(ctx context.Context, def *TableDefinition, backupKeys *KeySet, batchSize int64, waitPeriod time.Duration, dryRun bool) (*SyncReport, error) {
+	report := &SyncReport{DryRun: dryRun, Puts: backupKeys.Items()}
+	err := h.scanKeys(ctx, def, batchSize, waitPeriod, func(keys []map[string]*dynamodb.AttributeValue) error {
+		extra := []map[string]*dynamodb.AttributeValue{}
+		for _, key := range keys {
+			found, err := backupKeys.Contains(key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				extra = append(extra, key)
+			}
+		}
+		if dryRun {
+			for _, key := range extra {
+				report.DeletedKeys = append(report.DeletedKeys, toCustomAttributeMap(key))
+			}
+		} else if err := h.deleteKeys(ctx, def.TableName, extra); err != nil {
+			return err
+		}
+		report.Deletes += int64(len(extra))
+		if len(extra) > 0 {
+			log.Printf("%d items of %s missing from the backup found\n", report.Deletes, def.TableName)
+		}
+		return nil
+	})
+	return report, err
+}
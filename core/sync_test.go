@@ -0,0 +1,61 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestDeleteExtraItems(t *testing.T) {
+	def := &TableDefinition{TableName: "myTable", KeySchema: []KeyDefinition{{AttributeName: "artist", KeyType: "HASH"}}}
+	// The backup holds the first 50 of the 60 items of the table
+	keys := NewKeySet(def)
+	for i := 0; i < 50; i++ {
+		if err := keys.Add(map[string]*dynamodb.AttributeValue{"artist": {S: aws.String(fmt.Sprintf("artist%d", i))}, "year": {N: aws.String("1970")}}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		mock := &mockTruncateDynamoDBClient{}
+		h := &AwsHelper{DynamoSvc: mock}
+		report, err := h.DeleteExtraItems(context.Background(), def, keys, 40, 0, dryRun)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if report.Puts != 50 || report.Deletes != 10 {
+			t.Fatalf("Expecting 50 puts and 10 deletes, got %d and %d", report.Puts, report.Deletes)
+		}
+		if dryRun && (len(mock.deleted) != 0 || len(report.DeletedKeys) != 10) {
+			t.Fatalf("Expecting the 10 keys listed by the dry run, got %d listed and %d deleted", len(report.DeletedKeys), len(mock.deleted))
+		}
+		if !dryRun && (len(mock.deleted) != 10 || mock.deleted[0] != "artist50" || report.DeletedKeys != nil) {
+			t.Fatalf("Expecting the 10 items missing from the backup deleted, got %v", mock.deleted)
+		}
+	}
+}
+
+func TestKeySetMissingKey(t *testing.T) {
+	keys := NewKeySet(&TableDefinition{KeySchema: []KeyDefinition{{AttributeName: "artist", KeyType: "HASH"}}})
+	if err := keys.Add(map[string]*dynamodb.AttributeValue{"band": {S: aws.String("Queen")}}); err == nil {
+		t.Fatal("Expecting an error for an item without key")
+	}
+}
@@ -0,0 +1,466 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// TableDefinitionFileName is the name of the file describing the table,
+	// stored next to the manifest of a backup
+	TableDefinitionFileName = "table-definition.json"
+	// TableDefinitionVersion is the version of the table definition format
+	TableDefinitionVersion = 1
+)
+
+// tableStatusPollInterval is the time to wait between two checks of the
+// status of a table being created
+var tableStatusPollInterval = 5 * time.Second
+
+// KeyDefinition represents an element of a key schema
+type KeyDefinition struct {
+	AttributeName string `json:"attributeName"`
+	KeyType       string `json:"keyType"`
+}
+
+// AttributeDefinition represents the type of an attribute used in a key schema
+type AttributeDefinition struct {
+	AttributeName string `json:"attributeName"`
+	AttributeType string `json:"attributeType"`
+}
+
+// CapacityDefinition represents the provisioned throughput of a table or an
+// index
+type CapacityDefinition struct {
+	ReadCapacityUnits  int64 `json:"readCapacityUnits"`
+	WriteCapacityUnits int64 `json:"writeCapacityUnits"`
+}
+
+// ProjectionDefinition represents the attributes projected in an index
+type ProjectionDefinition struct {
+	ProjectionType   string   `json:"projectionType"`
+	NonKeyAttributes []string `json:"nonKeyAttributes,omitempty"`
+}
+
+// IndexDefinition represents a global or local secondary index
+type IndexDefinition struct {
+	IndexName             string               `json:"indexName"`
+	KeySchema             []KeyDefinition      `json:"keySchema"`
+	Projection            ProjectionDefinition `json:"projection"`
+	ProvisionedThroughput *CapacityDefinition  `json:"provisionedThroughput,omitempty"`
+}
+
+// StreamDefinition represents the stream settings of a table
+type StreamDefinition struct {
+	StreamEnabled  bool   `json:"streamEnabled"`
+	StreamViewType string `json:"streamViewType,omitempty"`
+}
+
+// TTLDefinition represents the time to live settings of a table
+type TTLDefinition struct {
+	AttributeName string `json:"attributeName"`
+	Enabled       bool   `json:"enabled"`
+}
+
+// TableDefinition represents the schema and settings of a table, stored
+// alongside a backup so that the table can be recreated
+type TableDefinition struct {
+	Version                int                   `json:"version"`
+	TableName              string                `json:"tableName"`
+	KeySchema              []KeyDefinition       `json:"keySchema"`
+	AttributeDefinitions   []AttributeDefinition `json:"attributeDefinitions"`
+	BillingMode            string                `json:"billingMode"`
+	ProvisionedThroughput  *CapacityDefinition   `json:"provisionedThroughput,omitempty"`
+	GlobalSecondaryIndexes []IndexDefinition     `json:"globalSecondaryIndexes,omitempty"`
+	LocalSecondaryIndexes  []IndexDefinition     `json:"localSecondaryIndexes,omitempty"`
+	StreamSpecification    *StreamDefinition     `json:"streamSpecification,omitempty"`
+	TimeToLive             *TTLDefinition        `json:"timeToLive,omitempty"`
+	PointInTimeRecovery    bool                  `json:"pointInTimeRecovery"`
+	Tags                   map[string]string     `json:"tags,omitempty"`
+}
+
+// newKeyDefinitions translates a key schema from its DescribeTable form
+func newKeyDefinitions(schema []*dynamodb.KeySchemaElement) []KeyDefinition {
+	keys := []KeyDefinition{}
+	for _, k := range schema {
+		keys = append(keys, KeyDefinition{AttributeName: aws.StringValue(k.AttributeName), KeyType: aws.StringValue(k.KeyType)})
+	}
+	return keys
+}
+
+// newCapacityDefinition translates a provisioned throughput from its
+// DescribeTable form. Returns nil for on-demand tables
+func newCapacityDefinition(billingMode string, throughput *dynamodb.ProvisionedThroughputDescription) *CapacityDefinition {
+	if billingMode != dynamodb.BillingModeProvisioned || throughput == nil {
+		return nil
+	}
+	return &CapacityDefinition{
+		ReadCapacityUnits:  aws.Int64Value(throughput.ReadCapacityUnits),
+		WriteCapacityUnits: aws.Int64Value(throughput.WriteCapacityUnits),
+	}
+}
+
+// newProjectionDefinition translates an index projection from its
+// DescribeTable form
+func newProjectionDefinition(projection *dynamodb.Projection) ProjectionDefinition {
+	if projection == nil {
+		return ProjectionDefinition{ProjectionType: dynamodb.ProjectionTypeAll}
+	}
+	return ProjectionDefinition{
+		ProjectionType:   aws.StringValue(projection.ProjectionType),
+		NonKeyAttributes: aws.StringValueSlice(projection.NonKeyAttributes),
+	}
+}
+
+// newTableDefinition translates the output of a DescribeTable into a
+// TableDefinition. TTL, point in time recovery and tags are not part of it
+func newTableDefinition(table *dynamodb.TableDescription) *TableDefinition {
+	def := &TableDefinition{
+		Version:     TableDefinitionVersion,
+		TableName:   aws.StringValue(table.TableName),
+		KeySchema:   newKeyDefinitions(table.KeySchema),
+		BillingMode: dynamodb.BillingModeProvisioned,
+	}
+	if table.BillingModeSummary != nil && table.BillingModeSummary.BillingMode != nil {
+		def.BillingMode = *table.BillingModeSummary.BillingMode
+	}
+	def.ProvisionedThroughput = newCapacityDefinition(def.BillingMode, table.ProvisionedThroughput)
+	for _, attr := range table.AttributeDefinitions {
+		def.AttributeDefinitions = append(def.AttributeDefinitions, AttributeDefinition{AttributeName: aws.StringValue(attr.AttributeName), AttributeType: aws.StringValue(attr.AttributeType)})
+	}
+	for _, gsi := range table.GlobalSecondaryIndexes {
+		def.GlobalSecondaryIndexes = append(def.GlobalSecondaryIndexes, IndexDefinition{
+			IndexName:             aws.StringValue(gsi.IndexName),
+			KeySchema:             newKeyDefinitions(gsi.KeySchema),
+			Projection:            newProjectionDefinition(gsi.Projection),
+			ProvisionedThroughput: newCapacityDefinition(def.BillingMode, gsi.ProvisionedThroughput),
+		})
+	}
+	for _, lsi := range table.LocalSecondaryIndexes {
+		def.LocalSecondaryIndexes = append(def.LocalSecondaryIndexes, IndexDefinition{
+			IndexName:  aws.StringValue(lsi.IndexName),
+			KeySchema:  newKeyDefinitions(lsi.KeySchema),
+			Projection: newProjectionDefinition(lsi.Projection),
+		})
+	}
+	if table.StreamSpecification != nil {
+		def.StreamSpecification = &StreamDefinition{
+			StreamEnabled:  aws.BoolValue(table.StreamSpecification.StreamEnabled),
+			StreamViewType: aws.StringValue(table.StreamSpecification.StreamViewType),
+		}
+	}
+	return def
+}
+
+// DescribeTableDefinition retrieves the schema and settings of the given
+// table. Only the DescribeTable call is mandatory, a warning is logged if the
+// TTL, the continuous backups or the tags can't be retrieved
+func (h *AwsHelper) DescribeTableDefinition(tableName string) (*TableDefinition, error) {
+	result, err := h.DynamoSvc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return nil, tableError(tableName, err)
+	}
+	def := newTableDefinition(result.Table)
+
+	ttl, err := h.DynamoSvc.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+	if err != nil {
+		log.Printf("[WARNING] Unable to retrieve the TTL settings of %s: %s\n", tableName, err)
+	} else if ttl.TimeToLiveDescription != nil && ttl.TimeToLiveDescription.AttributeName != nil {
+		status := aws.StringValue(ttl.TimeToLiveDescription.TimeToLiveStatus)
+		def.TimeToLive = &TTLDefinition{
+			AttributeName: *ttl.TimeToLiveDescription.AttributeName,
+			Enabled:       status == dynamodb.TimeToLiveStatusEnabled || status == dynamodb.TimeToLiveStatusEnabling,
+		}
+	}
+
+	backups, err := h.DynamoSvc.DescribeContinuousBackups(&dynamodb.DescribeContinuousBackupsInput{TableName: aws.String(tableName)})
+	if err != nil {
+		log.Printf("[WARNING] Unable to retrieve the continuous backups settings of %s: %s\n", tableName, err)
+	} else if desc := backups.ContinuousBackupsDescription; desc != nil && desc.PointInTimeRecoveryDescription != nil {
+		def.PointInTimeRecovery = aws.StringValue(desc.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus) == dynamodb.PointInTimeRecoveryStatusEnabled
+	}
+
+	tagsInput := &dynamodb.ListTagsOfResourceInput{ResourceArn: result.Table.TableArn}
+	for {
+		tags, err := h.DynamoSvc.ListTagsOfResource(tagsInput)
+		if err != nil {
+			log.Printf("[WARNING] Unable to retrieve the tags of %s: %s\n", tableName, err)
+			break
+		}
+		for _, tag := range tags.Tags {
+			if def.Tags == nil {
+				def.Tags = make(map[string]string)
+			}
+			def.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		if tags.NextToken == nil {
+			break
+		}
+		tagsInput.NextToken = tags.NextToken
+	}
+	return def, nil
+}
+
+// DescribeKeySchema retrieves the definition of the given table, without the
+// settings that need calls other than DescribeTable
+func (h *AwsHelper) DescribeKeySchema(tableName string) (*TableDefinition, error) {
+	result, err := h.DynamoSvc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return nil, tableError(tableName, err)
+	}
+	return newTableDefinition(result.Table), nil
+}
+
+// TableDefinitionToS3 writes the given table definition in the given s3 folder
+func (h *AwsHelper) TableDefinitionToS3(ctx context.Context, bucketName, s3Folder string, def *TableDefinition) error {
+	data, err := json.MarshalIndent(def, "", "  ")
+	if err != nil {
+		return fmt.Errorf("while doing a marshal on the table definition: %s", err)
+	}
+	return h.uploadControlToS3(ctx, bucketName, fmt.Sprintf("%s/%s", s3Folder, TableDefinitionFileName), data)
+}
+
+// ParseTableDefinition decodes a table definition document
+func ParseTableDefinition(data []byte) (*TableDefinition, error) {
+	def := &TableDefinition{}
+	if err := json.Unmarshal(data, def); err != nil {
+		return nil, err
+	}
+	if def.Version > TableDefinitionVersion {
+		return nil, fmt.Errorf("Unsupported table definition version %d", def.Version)
+	}
+	if len(def.KeySchema) == 0 {
+		return nil, fmt.Errorf("The table definition has no key schema")
+	}
+	return def, nil
+}
+
+// LoadTableDefinitionFromS3 downloads and decodes the given table definition
+// file
+func (h *AwsHelper) LoadTableDefinitionFromS3(bucketName, definitionPath string) (*TableDefinition, error) {
+	doc, err := h.GetFromS3(context.Background(), bucketName, definitionPath)
+	if err != nil {
+		return nil, err
+	}
+	defer (*doc).Close()
+	buff := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buff, *doc); err != nil {
+		return nil, err
+	}
+	return ParseTableDefinition(buff.Bytes())
+}
+
+// Override changes the name, the billing mode and the capacity of the table
+// definition. Empty or zero values leave the current settings untouched. The
+// indexes of a provisioned table without capacity get the one of the table
+func (def *TableDefinition) Override(tableName, billingMode string, readCapacity, writeCapacity int64) error {
+	if tableName != "" {
+		def.TableName = tableName
+	}
+	if billingMode != "" {
+		if billingMode != dynamodb.BillingModeProvisioned && billingMode != dynamodb.BillingModePayPerRequest {
+			return fmt.Errorf("Unknown billing mode %s", billingMode)
+		}
+		def.BillingMode = billingMode
+	}
+	if def.BillingMode == dynamodb.BillingModePayPerRequest {
+		def.ProvisionedThroughput = nil
+		for i := range def.GlobalSecondaryIndexes {
+			def.GlobalSecondaryIndexes[i].ProvisionedThroughput = nil
+		}
+		return nil
+	}
+
+	if def.ProvisionedThroughput == nil {
+		def.ProvisionedThroughput = &CapacityDefinition{}
+	}
+	if readCapacity > 0 {
+		def.ProvisionedThroughput.ReadCapacityUnits = readCapacity
+	}
+	if writeCapacity > 0 {
+		def.ProvisionedThroughput.WriteCapacityUnits = writeCapacity
+	}
+	if def.ProvisionedThroughput.ReadCapacityUnits < 1 || def.ProvisionedThroughput.WriteCapacityUnits < 1 {
+		return fmt.Errorf("A read and write capacity is required for a provisioned table")
+	}
+	for i := range def.GlobalSecondaryIndexes {
+		if def.GlobalSecondaryIndexes[i].ProvisionedThroughput == nil {
+			capacity := *def.ProvisionedThroughput
+			def.GlobalSecondaryIndexes[i].ProvisionedThroughput = &capacity
+		}
+	}
+	return nil
+}
+
+// keySchemaElements translates key definitions to their CreateTable form
+func keySchemaElements(keys []KeyDefinition) []*dynamodb.KeySchemaElement {
+	schema := []*dynamodb.KeySchemaElement{}
+	for _, k := range keys {
+		schema = append(schema, &dynamodb.KeySchemaElement{AttributeName: aws.String(k.AttributeName), KeyType: aws.String(k.KeyType)})
+	}
+	return schema
+}
+
+// provisionedThroughput translates a capacity definition to its CreateTable
+// form
+func provisionedThroughput(capacity *CapacityDefinition) *dynamodb.ProvisionedThroughput {
+	if capacity == nil {
+		return nil
+	}
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(capacity.ReadCapacityUnits),
+		WriteCapacityUnits: aws.Int64(capacity.WriteCapacityUnits),
+	}
+}
+
+// projection translates a projection definition to its CreateTable form
+func projection(proj ProjectionDefinition) *dynamodb.Projection {
+	out := &dynamodb.Projection{ProjectionType: aws.String(proj.ProjectionType)}
+	if len(proj.NonKeyAttributes) > 0 {
+		out.NonKeyAttributes = aws.StringSlice(proj.NonKeyAttributes)
+	}
+	return out
+}
+
+// createTableInput translates the table definition into the input of a
+// CreateTable. TTL, point in time recovery and tags can only be set once the
+// table exists
+func (def *TableDefinition) createTableInput() *dynamodb.CreateTableInput {
+	input := &dynamodb.CreateTableInput{
+		TableName:             aws.String(def.TableName),
+		KeySchema:             keySchemaElements(def.KeySchema),
+		BillingMode:           aws.String(def.BillingMode),
+		ProvisionedThroughput: provisionedThroughput(def.ProvisionedThroughput),
+	}
+	for _, attr := range def.AttributeDefinitions {
+		input.AttributeDefinitions = append(input.AttributeDefinitions, &dynamodb.AttributeDefinition{AttributeName: aws.String(attr.AttributeName), AttributeType: aws.String(attr.AttributeType)})
+	}
+	for _, gsi := range def.GlobalSecondaryIndexes {
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndex{
+			IndexName:             aws.String(gsi.IndexName),
+			KeySchema:             keySchemaElements(gsi.KeySchema),
+			Projection:            projection(gsi.Projection),
+			ProvisionedThroughput: provisionedThroughput(gsi.ProvisionedThroughput),
+		})
+	}
+	for _, lsi := range def.LocalSecondaryIndexes {
+		input.LocalSecondaryIndexes = append(input.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndex{
+			IndexName:  aws.String(lsi.IndexName),
+			KeySchema:  keySchemaElements(lsi.KeySchema),
+			Projection: projection(lsi.Projection),
+		})
+	}
+	if def.StreamSpecification != nil && def.StreamSpecification.StreamEnabled {
+		input.StreamSpecification = &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(def.StreamSpecification.StreamViewType),
+		}
+	}
+	return input
+}
+
+// CreateTableFromDefinition creates the table described by the given
+// definition and waits for it, and all its global secondary indexes, to be
+// ACTIVE
+func (h *AwsHelper) CreateTableFromDefinition(def *TableDefinition) error {
+	log.Printf("Creating the table %s\n", def.TableName)
+	if _, err := h.DynamoSvc.CreateTable(def.createTableInput()); err != nil {
+		return err
+	}
+	return h.waitTableActive(def.TableName)
+}
+
+// waitTableActive polls the given table until it is ACTIVE along with all its
+// global secondary indexes
+func (h *AwsHelper) waitTableActive(tableName string) error {
+	for {
+		result, err := h.DynamoSvc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		if err != nil {
+			return err
+		}
+		active := aws.StringValue(result.Table.TableStatus) == dynamodb.TableStatusActive
+		for _, gsi := range result.Table.GlobalSecondaryIndexes {
+			active = active && aws.StringValue(gsi.IndexStatus) == dynamodb.IndexStatusActive
+		}
+		if active {
+			return nil
+		}
+		log.Printf("Waiting for the table %s to be ACTIVE...\n", tableName)
+		time.Sleep(tableStatusPollInterval)
+	}
+}
+
+// DeleteTable deletes the given table and waits for it to be gone
+func (h *AwsHelper) DeleteTable(tableName string) error {
+	log.Printf("Deleting the table %s\n", tableName)
+	if _, err := h.DynamoSvc.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(tableName)}); err != nil {
+		return tableError(tableName, err)
+	}
+	for {
+		_, err := h.DynamoSvc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		if errorCode(err) == dynamodb.ErrCodeResourceNotFoundException {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Waiting for the table %s to be deleted...\n", tableName)
+		time.Sleep(tableStatusPollInterval)
+	}
+}
+
+// ApplyTableSettings sets the TTL and the tags of the table definition on the
+// existing table of the same name
+func (h *AwsHelper) ApplyTableSettings(def *TableDefinition) error {
+	if def.TimeToLive != nil && def.TimeToLive.Enabled {
+		log.Printf("Enabling the TTL on the attribute %s\n", def.TimeToLive.AttributeName)
+		_, err := h.DynamoSvc.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+			TableName: aws.String(def.TableName),
+			TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+				AttributeName: aws.String(def.TimeToLive.AttributeName),
+				Enabled:       aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(def.Tags) == 0 {
+		return nil
+	}
+	result, err := h.DynamoSvc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(def.TableName)})
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.TagResourceInput{ResourceArn: result.Table.TableArn}
+	for k, v := range def.Tags {
+		input.Tags = append(input.Tags, &dynamodb.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	log.Printf("Tagging the table %s\n", def.TableName)
+	_, err = h.DynamoSvc.TagResource(input)
+	return err
+}
@@ -0,0 +1,138 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// struct to mock the Dynamo calls describing a table
+type mockDescribeDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func (m *mockDescribeDynamoDBClient) DescribeTable(params *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		TableName: params.TableName,
+		TableArn:  aws.String("arn:aws:dynamodb:eu-west-1:123456789012:table/myTable"),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("artist"), KeyType: aws.String("HASH")},
+		},
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("artist"), AttributeType: aws.String("S")},
+			{AttributeName: aws.String("year"), AttributeType: aws.String("N")},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(5), WriteCapacityUnits: aws.Int64(10)},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndexDescription{{
+			IndexName:             aws.String("byYear"),
+			IndexStatus:           aws.String("ACTIVE"),
+			KeySchema:             []*dynamodb.KeySchemaElement{{AttributeName: aws.String("year"), KeyType: aws.String("HASH")}},
+			Projection:            &dynamodb.Projection{ProjectionType: aws.String("KEYS_ONLY")},
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(1), WriteCapacityUnits: aws.Int64(2)},
+		}},
+		StreamSpecification: &dynamodb.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: aws.String("NEW_IMAGE")},
+	}}, nil
+}
+
+func (m *mockDescribeDynamoDBClient) DescribeTimeToLive(params *dynamodb.DescribeTimeToLiveInput) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &dynamodb.TimeToLiveDescription{
+		AttributeName:    aws.String("expiresAt"),
+		TimeToLiveStatus: aws.String("ENABLED"),
+	}}, nil
+}
+
+func (m *mockDescribeDynamoDBClient) DescribeContinuousBackups(params *dynamodb.DescribeContinuousBackupsInput) (*dynamodb.DescribeContinuousBackupsOutput, error) {
+	return nil, fmt.Errorf("AccessDeniedException")
+}
+
+func (m *mockDescribeDynamoDBClient) ListTagsOfResource(params *dynamodb.ListTagsOfResourceInput) (*dynamodb.ListTagsOfResourceOutput, error) {
+	if params.NextToken == nil {
+		return &dynamodb.ListTagsOfResourceOutput{Tags: []*dynamodb.Tag{{Key: aws.String("team"), Value: aws.String("music")}}, NextToken: aws.String("next")}, nil
+	}
+	return &dynamodb.ListTagsOfResourceOutput{Tags: []*dynamodb.Tag{{Key: aws.String("env"), Value: aws.String("prod")}}}, nil
+}
+
+func TestDescribeTableDefinition(t *testing.T) {
+	h := AwsHelper{DynamoSvc: &mockDescribeDynamoDBClient{}}
+
+	def, err := h.DescribeTableDefinition("myTable")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &TableDefinition{
+		Version:   TableDefinitionVersion,
+		TableName: "myTable",
+		KeySchema: []KeyDefinition{{AttributeName: "artist", KeyType: "HASH"}},
+		AttributeDefinitions: []AttributeDefinition{
+			{AttributeName: "artist", AttributeType: "S"},
+			{AttributeName: "year", AttributeType: "N"},
+		},
+		BillingMode:           "PROVISIONED",
+		ProvisionedThroughput: &CapacityDefinition{ReadCapacityUnits: 5, WriteCapacityUnits: 10},
+		GlobalSecondaryIndexes: []IndexDefinition{{
+			IndexName:             "byYear",
+			KeySchema:             []KeyDefinition{{AttributeName: "year", KeyType: "HASH"}},
+			Projection:            ProjectionDefinition{ProjectionType: "KEYS_ONLY", NonKeyAttributes: []string{}},
+			ProvisionedThroughput: &CapacityDefinition{ReadCapacityUnits: 1, WriteCapacityUnits: 2},
+		}},
+		StreamSpecification: &StreamDefinition{StreamEnabled: true, StreamViewType: "NEW_IMAGE"},
+		TimeToLive:          &TTLDefinition{AttributeName: "expiresAt", Enabled: true},
+		Tags:                map[string]string{"team": "music", "env": "prod"},
+	}
+	if !reflect.DeepEqual(def, expected) {
+		t.Fatalf("Expecting: %+v\nGot: %+v\n", expected, def)
+	}
+}
+
+func TestTableDefinitionOverride(t *testing.T) {
+	data := []byte(`{"version":1,"tableName":"myTable","billingMode":"PAY_PER_REQUEST",
+		"keySchema":[{"attributeName":"artist","keyType":"HASH"}],
+		"attributeDefinitions":[{"attributeName":"artist","attributeType":"S"},{"attributeName":"year","attributeType":"N"}],
+		"globalSecondaryIndexes":[{"indexName":"byYear","keySchema":[{"attributeName":"year","keyType":"HASH"}],"projection":{"projectionType":"ALL"}}]}`)
+	def, err := ParseTableDefinition(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if err := def.Override("", "PROVISIONED", 0, 0); err == nil {
+		t.Fatalf("A provisioned table without capacity should be rejected")
+	}
+	if err := def.Override("otherTable", "PROVISIONED", 3, 4); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	input := def.createTableInput()
+	if *input.TableName != "otherTable" || *input.BillingMode != "PROVISIONED" {
+		t.Fatalf("Unexpected table name or billing mode: %v", input)
+	}
+	expected := &dynamodb.ProvisionedThroughput{ReadCapacityUnits: aws.Int64(3), WriteCapacityUnits: aws.Int64(4)}
+	if !reflect.DeepEqual(input.ProvisionedThroughput, expected) || !reflect.DeepEqual(input.GlobalSecondaryIndexes[0].ProvisionedThroughput, expected) {
+		t.Fatalf("The table and its index should get a capacity of %v. Got: %v", expected, input)
+	}
+
+	if err := def.Override("", "PAY_PER_REQUEST", 0, 0); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	input = def.createTableInput()
+	if input.ProvisionedThroughput != nil || input.GlobalSecondaryIndexes[0].ProvisionedThroughput != nil {
+		t.Fatalf("An on-demand table should have no capacity. Got: %v", input)
+	}
+}
@@ -0,0 +1,546 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Operations of a TransformRule
+const (
+	TransformRename  = "rename"
+	TransformDelete  = "delete"
+	TransformSet     = "set"
+	TransformCopy    = "copy"
+	TransformConvert = "convert"
+)
+
+// TransformRule is an operation applied to the attribute at the given path of
+// every item. A path is made of attribute names separated by dots, and of list
+// indexes between brackets, [*] matching every element of a list, as in
+// "address.lines[0]" or "tracks[*].title"
+type TransformRule struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// To is the destination path of the rename and copy operations. Its
+	// wildcards must match the ones of Path
+	To string `json:"to,omitempty"`
+	// Value is the attribute set by the set operation, in the format of the
+	// backup files, as in {"s": "foo"}
+	Value *dynamodb.AttributeValue `json:"value,omitempty"`
+	// Type is the type the convert operation converts to: S, N, BOOL, SS or NS
+	Type string `json:"type,omitempty"`
+}
+
+// Transform is a list of rules applied in order to the items going through a
+// backup or a restore
+type Transform struct {
+	Rules []TransformRule `json:"rules"`
+
+	compiled []compiledRule
+}
+
+// pathElement is an element of a path: an attribute name, a list index, or
+// all the elements of a list
+type pathElement struct {
+	name  string
+	index int
+	all   bool
+}
+
+// isIndex tells if the element points into a list
+func (e pathElement) isIndex() bool {
+	return e.name == ""
+}
+
+// compiledRule is a TransformRule with its paths parsed. The rule is applied
+// to each attribute matching base, with path and to relative to it
+type compiledRule struct {
+	TransformRule
+	base []pathElement
+	path []pathElement
+	to   []pathElement
+}
+
+// NewTransform validates the given rules and returns the Transform applying
+// them
+func NewTransform(rules []TransformRule) (*Transform, error) {
+	t := &Transform{Rules: rules}
+	if err := t.compile(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadTransformFile loads the Transform described by the given json file, as
+// in {"rules": [{"op": "rename", "path": "name", "to": "title"}]}
+func LoadTransformFile(path string) (*Transform, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transform{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("while decoding the transform: %s", err)
+	}
+	if err := t.compile(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// compile validates the rules and parses their paths
+func (t *Transform) compile() error {
+	t.compiled = nil
+	for i, rule := range t.Rules {
+		c, err := compileRule(rule)
+		if err != nil {
+			return fmt.Errorf("invalid transform rule %d: %s", i+1, err)
+		}
+		t.compiled = append(t.compiled, c)
+	}
+	return nil
+}
+
+// compileRule validates a rule and parses its paths
+func compileRule(rule TransformRule) (compiledRule, error) {
+	c := compiledRule{TransformRule: rule}
+	path, err := parsePath(rule.Path)
+	if err != nil {
+		return c, err
+	}
+	switch rule.Op {
+	case TransformRename, TransformCopy:
+		to, err := parsePath(rule.To)
+		if err != nil {
+			return c, fmt.Errorf("to: %s", err)
+		}
+		// Both paths are applied from the attribute matched by their
+		// wildcards, so the wildcards must be shared
+		shared := lastWildcard(path) + 1
+		if lastWildcard(to) >= shared || len(to) <= shared || !samePath(path[:shared], to[:shared]) {
+			return c, fmt.Errorf("the wildcards of %q and %q don't match", rule.Path, rule.To)
+		}
+		if len(path) == shared {
+			return c, fmt.Errorf("%q can't end with a wildcard", rule.Path)
+		}
+		c.base, c.path, c.to = path[:shared], path[shared:], to[shared:]
+	case TransformSet:
+		if rule.Value == nil {
+			return c, fmt.Errorf("missing value to set at %q", rule.Path)
+		}
+		// The maps missing after the last wildcard are created
+		shared := lastWildcard(path) + 1
+		if shared == len(path) {
+			shared--
+		}
+		c.base, c.path = path[:shared], path[shared:]
+	case TransformDelete:
+		c.base, c.path = path[:len(path)-1], path[len(path)-1:]
+	case TransformConvert:
+		if _, ok := converters[rule.Type]; !ok {
+			return c, fmt.Errorf("unsupported type %q, expecting S, N, BOOL, SS or NS", rule.Type)
+		}
+		c.base, c.path = path[:len(path)-1], path[len(path)-1:]
+	default:
+		return c, fmt.Errorf("unknown operation %q", rule.Op)
+	}
+	return c, nil
+}
+
+// parsePath parses a path such as "tracks[*].title"
+func parsePath(path string) ([]pathElement, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+	elements := []pathElement{}
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		if i := strings.Index(part, "["); i >= 0 {
+			name = part[:i]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("missing attribute name in %q", path)
+		}
+		elements = append(elements, pathElement{name: name})
+		for rest := part[len(name):]; rest != ""; {
+			end := strings.Index(rest, "]")
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid list index in %q", path)
+			}
+			if index := rest[1:end]; index == "*" {
+				elements = append(elements, pathElement{all: true})
+			} else if n, err := strconv.Atoi(index); err == nil && n >= 0 {
+				elements = append(elements, pathElement{index: n})
+			} else {
+				return nil, fmt.Errorf("invalid list index %q in %q", index, path)
+			}
+			rest = rest[end+1:]
+		}
+	}
+	return elements, nil
+}
+
+// lastWildcard returns the position of the last wildcard of a path, -1 if
+// there is none
+func lastWildcard(path []pathElement) int {
+	last := -1
+	for i, e := range path {
+		if e.all {
+			last = i
+		}
+	}
+	return last
+}
+
+// samePath tells if both paths are equal
+func samePath(a, b []pathElement) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply applies the rules to the given item, in place. Attributes missing from
+// the item are ignored, except by the set operation which creates them
+func (t *Transform) Apply(item map[string]*dynamodb.AttributeValue) error {
+	if t == nil {
+		return nil
+	}
+	root := &dynamodb.AttributeValue{M: item}
+	for _, rule := range t.compiled {
+		for _, base := range resolve(root, rule.base) {
+			if err := rule.apply(base); err != nil {
+				return fmt.Errorf("Unable to %s %s: %s", rule.Op, rule.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolve returns the attributes matching the given path from the given
+// attribute
+func resolve(av *dynamodb.AttributeValue, path []pathElement) []*dynamodb.AttributeValue {
+	if av == nil {
+		return nil
+	}
+	if len(path) == 0 {
+		return []*dynamodb.AttributeValue{av}
+	}
+	e := path[0]
+	switch {
+	case !e.isIndex():
+		return resolve(av.M[e.name], path[1:])
+	case e.all:
+		matches := []*dynamodb.AttributeValue{}
+		for _, child := range av.L {
+			matches = append(matches, resolve(child, path[1:])...)
+		}
+		return matches
+	case e.index < len(av.L):
+		return resolve(av.L[e.index], path[1:])
+	}
+	return nil
+}
+
+// apply applies the rule to the given base attribute
+func (r compiledRule) apply(base *dynamodb.AttributeValue) error {
+	switch r.Op {
+	case TransformRename, TransformCopy:
+		matches := resolve(base, r.path)
+		if len(matches) == 0 {
+			return nil
+		}
+		value := matches[0]
+		if r.Op == TransformRename {
+			remove(base, r.path)
+		} else {
+			value = copyAttributeValue(value)
+		}
+		return put(base, r.to, value)
+	case TransformSet:
+		return put(base, r.path, copyAttributeValue(r.Value))
+	case TransformDelete:
+		remove(base, r.path)
+		return nil
+	case TransformConvert:
+		for _, av := range resolve(base, r.path) {
+			if err := converters[r.Type](av); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// slot is a place holding an attribute, either in a map or in a list
+type slot struct {
+	parent *dynamodb.AttributeValue
+	name   string
+	index  int
+}
+
+// get returns the attribute held by the slot
+func (s slot) get() *dynamodb.AttributeValue {
+	if s.name != "" {
+		return s.parent.M[s.name]
+	}
+	return s.parent.L[s.index]
+}
+
+// set sets the attribute held by the slot
+func (s slot) set(av *dynamodb.AttributeValue) {
+	if s.name != "" {
+		s.parent.M[s.name] = av
+		return
+	}
+	s.parent.L[s.index] = av
+}
+
+// slots returns the slots of the given parent attribute matching the given
+// element. A missing attribute name of a map is matched, as it can be set
+func slots(parent *dynamodb.AttributeValue, e pathElement) []slot {
+	switch {
+	case !e.isIndex():
+		if parent.M == nil {
+			return nil
+		}
+		return []slot{{parent: parent, name: e.name}}
+	case e.all:
+		slots := []slot{}
+		for i := range parent.L {
+			slots = append(slots, slot{parent: parent, index: i})
+		}
+		return slots
+	case e.index < len(parent.L):
+		return []slot{{parent: parent, index: e.index}}
+	}
+	return nil
+}
+
+// remove removes the attribute at the given path, if any
+func remove(base *dynamodb.AttributeValue, path []pathElement) {
+	last := path[len(path)-1]
+	for _, parent := range resolve(base, path[:len(path)-1]) {
+		switch {
+		case !last.isIndex():
+			delete(parent.M, last.name)
+		case last.all:
+			// An empty list is still a list, unlike a nil one
+			if parent.L != nil {
+				parent.L = []*dynamodb.AttributeValue{}
+			}
+		case last.index < len(parent.L):
+			parent.L = append(parent.L[:last.index], parent.L[last.index+1:]...)
+		}
+	}
+}
+
+// put sets the attribute at the given path, creating the missing maps on the
+// way. The path can only end with a wildcard, setting a copy of the attribute
+// in every element of the list
+func put(base *dynamodb.AttributeValue, path []pathElement, value *dynamodb.AttributeValue) error {
+	parent := base
+	for i, e := range path[:len(path)-1] {
+		matches := slots(parent, e)
+		if len(matches) == 0 {
+			return fmt.Errorf("no attribute matching %s", pathString(path[:i+1]))
+		}
+		if matches[0].get() == nil {
+			matches[0].set(&dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{}})
+		}
+		parent = matches[0].get()
+	}
+	for i, s := range slots(parent, path[len(path)-1]) {
+		if i > 0 {
+			value = copyAttributeValue(value)
+		}
+		s.set(value)
+	}
+	return nil
+}
+
+// pathString formats a parsed path back
+func pathString(path []pathElement) string {
+	var b strings.Builder
+	for i, e := range path {
+		switch {
+		case !e.isIndex():
+			if i > 0 {
+				b.WriteString(".")
+			}
+			b.WriteString(e.name)
+		case e.all:
+			b.WriteString("[*]")
+		default:
+			fmt.Fprintf(&b, "[%d]", e.index)
+		}
+	}
+	return b.String()
+}
+
+// copyAttributeValue returns a deep copy of the lists and maps of the given
+// attribute, sharing its scalar values which are never modified in place
+func copyAttributeValue(av *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	out := *av
+	if av.L != nil {
+		out.L = make([]*dynamodb.AttributeValue, len(av.L))
+		for i, child := range av.L {
+			out.L[i] = copyAttributeValue(child)
+		}
+	}
+	if av.M != nil {
+		out.M = make(map[string]*dynamodb.AttributeValue, len(av.M))
+		for k, child := range av.M {
+			out.M[k] = copyAttributeValue(child)
+		}
+	}
+	return &out
+}
+
+// converters convert an attribute in place to the type they are named after.
+// An attribute already of that type is left untouched
+var converters = map[string]func(av *dynamodb.AttributeValue) error{
+	dynamodb.ScalarAttributeTypeS: func(av *dynamodb.AttributeValue) error {
+		switch {
+		case av.S != nil:
+			return nil
+		case av.N != nil:
+			*av = dynamodb.AttributeValue{S: av.N}
+		case av.BOOL != nil:
+			*av = dynamodb.AttributeValue{S: aws.String(strconv.FormatBool(*av.BOOL))}
+		default:
+			return fmt.Errorf("can't convert to S")
+		}
+		return nil
+	},
+	dynamodb.ScalarAttributeTypeN: func(av *dynamodb.AttributeValue) error {
+		switch {
+		case av.N != nil:
+			return nil
+		case av.S != nil:
+			n := strings.TrimSpace(*av.S)
+			if !isNumber(n) {
+				return fmt.Errorf("%q is not a number", *av.S)
+			}
+			*av = dynamodb.AttributeValue{N: aws.String(n)}
+		case av.BOOL != nil:
+			n := "0"
+			if *av.BOOL {
+				n = "1"
+			}
+			*av = dynamodb.AttributeValue{N: aws.String(n)}
+		default:
+			return fmt.Errorf("can't convert to N")
+		}
+		return nil
+	},
+	"BOOL": func(av *dynamodb.AttributeValue) error {
+		var value string
+		switch {
+		case av.BOOL != nil:
+			return nil
+		case av.S != nil:
+			value = *av.S
+		case av.N != nil:
+			value = *av.N
+		default:
+			return fmt.Errorf("can't convert to BOOL")
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*av = dynamodb.AttributeValue{BOOL: aws.Bool(b)}
+		return nil
+	},
+	"SS": func(av *dynamodb.AttributeValue) error {
+		switch {
+		case av.SS != nil:
+			return nil
+		case av.NS != nil:
+			*av = dynamodb.AttributeValue{SS: av.NS}
+		default:
+			return fmt.Errorf("can't convert to SS")
+		}
+		return nil
+	},
+	"NS": func(av *dynamodb.AttributeValue) error {
+		switch {
+		case av.NS != nil:
+			return nil
+		case av.SS != nil:
+			for _, s := range av.SS {
+				if !isNumber(*s) {
+					return fmt.Errorf("%q is not a number", *s)
+				}
+			}
+			*av = dynamodb.AttributeValue{NS: av.SS}
+		default:
+			return fmt.Errorf("can't convert to NS")
+		}
+		return nil
+	},
+}
+
+// numberPattern is the grammar of the DynamoDB numbers, a decimal number with
+// an optional exponent
+var numberPattern = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)(?:[eE]([+-]?\d+))?$`)
+
+// isNumber tells if the given string is a valid DynamoDB number: at most 38
+// significant digits, and unless zero a magnitude between 1E-130 and
+// 9.9999999999999999999999999999999999999E+125
+func isNumber(s string) bool {
+	m := numberPattern.FindStringSubmatch(s)
+	if m == nil {
+		return false
+	}
+	exponent := 0
+	if m[2] != "" {
+		var err error
+		if exponent, err = strconv.Atoi(m[2]); err != nil {
+			return false
+		}
+	}
+	point := strings.IndexByte(m[1], '.')
+	if point < 0 {
+		point = len(m[1])
+	}
+	digits := strings.Replace(m[1], ".", "", 1)
+	significant := strings.TrimLeft(digits, "0")
+	if significant == "" {
+		return true
+	}
+	if len(strings.TrimRight(significant, "0")) > 38 {
+		return false
+	}
+	// The number is between 10^(magnitude-1) and 10^magnitude
+	magnitude := point - (len(digits) - len(significant)) + exponent
+	return magnitude >= -129 && magnitude <= 126
+}
@@ -0,0 +1,125 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestTransformApply(t *testing.T) {
+	tests := []struct {
+		rule     TransformRule
+		expected string
+	}{
+		{TransformRule{Op: TransformRename, Path: "artist", To: "band"},
+			`{"band":{"s":"Queen"},"year":{"s":"1973"},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[{"m":{"title":{"s":"Mustapha"}}},{"m":{"title":{"s":"Bicycle Race"}}}]}}}}`},
+		{TransformRule{Op: TransformDelete, Path: "album.tracks[0]"},
+			`{"artist":{"s":"Queen"},"year":{"s":"1973"},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[{"m":{"title":{"s":"Bicycle Race"}}}]}}}}`},
+		{TransformRule{Op: TransformSet, Path: "label.name", Value: &dynamodb.AttributeValue{S: aws.String("EMI")}},
+			`{"artist":{"s":"Queen"},"year":{"s":"1973"},"label":{"m":{"name":{"s":"EMI"}}},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[{"m":{"title":{"s":"Mustapha"}}},{"m":{"title":{"s":"Bicycle Race"}}}]}}}}`},
+		{TransformRule{Op: TransformSet, Path: "album.tracks[*].live", Value: &dynamodb.AttributeValue{BOOL: aws.Bool(false)}},
+			`{"artist":{"s":"Queen"},"year":{"s":"1973"},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[{"m":{"title":{"s":"Mustapha"},"live":{"bool":false}}},{"m":{"title":{"s":"Bicycle Race"},"live":{"bool":false}}}]}}}}`},
+		{TransformRule{Op: TransformCopy, Path: "album.title", To: "title"},
+			`{"artist":{"s":"Queen"},"year":{"s":"1973"},"title":{"s":"Jazz"},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[{"m":{"title":{"s":"Mustapha"}}},{"m":{"title":{"s":"Bicycle Race"}}}]}}}}`},
+		{TransformRule{Op: TransformRename, Path: "album.tracks[*].title", To: "album.tracks[*].name"},
+			`{"artist":{"s":"Queen"},"year":{"s":"1973"},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[{"m":{"name":{"s":"Mustapha"}}},{"m":{"name":{"s":"Bicycle Race"}}}]}}}}`},
+		{TransformRule{Op: TransformConvert, Path: "year", Type: "N"},
+			`{"artist":{"s":"Queen"},"year":{"n":"1973"},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[{"m":{"title":{"s":"Mustapha"}}},{"m":{"title":{"s":"Bicycle Race"}}}]}}}}`},
+		{TransformRule{Op: TransformDelete, Path: "album.tracks[*]"},
+			`{"artist":{"s":"Queen"},"year":{"s":"1973"},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[]}}}}`},
+		{TransformRule{Op: TransformDelete, Path: "missing.attribute"},
+			`{"artist":{"s":"Queen"},"year":{"s":"1973"},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[{"m":{"title":{"s":"Mustapha"}}},{"m":{"title":{"s":"Bicycle Race"}}}]}}}}`},
+	}
+
+	for _, test := range tests {
+		item := map[string]*dynamodb.AttributeValue{}
+		json.Unmarshal([]byte(`{"artist":{"s":"Queen"},"year":{"s":"1973"},"album":{"m":{"title":{"s":"Jazz"},"tracks":{"l":[{"m":{"title":{"s":"Mustapha"}}},{"m":{"title":{"s":"Bicycle Race"}}}]}}}}`), &item)
+		transform, err := NewTransform([]TransformRule{test.rule})
+		if err != nil {
+			t.Fatalf("Unexpected error compiling %v: %s", test.rule, err)
+		}
+		if err := transform.Apply(item); err != nil {
+			t.Fatalf("Unexpected error applying %v: %s", test.rule, err)
+		}
+
+		expected := map[string]*dynamodb.AttributeValue{}
+		json.Unmarshal([]byte(test.expected), &expected)
+		got, _ := MarshalDynamoAttributeMap(item)
+		want, _ := MarshalDynamoAttributeMap(expected)
+		if string(got) != string(want) {
+			t.Fatalf("%s %s mismatch. Expecting: %s\nGot: %s\n", test.rule.Op, test.rule.Path, want, got)
+		}
+	}
+}
+
+func TestTransformConvertError(t *testing.T) {
+	transform, err := NewTransform([]TransformRule{{Op: TransformConvert, Path: "artist", Type: "N"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := transform.Apply(map[string]*dynamodb.AttributeValue{"artist": {S: aws.String("Queen")}}); err == nil {
+		t.Fatal("Expecting an error converting a name to a number")
+	}
+}
+
+func TestIsNumber(t *testing.T) {
+	numbers := map[string]bool{
+		"1973":   true,
+		"-1.5":   true,
+		"-.5e-3": true,
+		"0.000":  true,
+		"1E-130": true,
+		"9.9999999999999999999999999999999999999E+125": true,
+		"12345678901234567890123456789012345678000":    true,
+		"1E-131": false,
+		"1E126":  false,
+		"123456789012345678901234567890123456789": false,
+		"Inf":    false,
+		"NaN":    false,
+		"0x1p-2": false,
+		"1_000":  false,
+		" 1":     false,
+		".":      false,
+		"1e":     false,
+	}
+	for s, valid := range numbers {
+		if isNumber(s) != valid {
+			t.Fatalf("%q validity should be %t", s, valid)
+		}
+	}
+}
+
+func TestTransformInvalidRules(t *testing.T) {
+	rules := []TransformRule{
+		{Op: "uppercase", Path: "artist"},
+		{Op: TransformDelete, Path: ""},
+		{Op: TransformDelete, Path: "tracks[x]"},
+		{Op: TransformDelete, Path: "tracks.[0]"},
+		{Op: TransformSet, Path: "artist"},
+		{Op: TransformConvert, Path: "artist", Type: "B"},
+		{Op: TransformRename, Path: "tracks[*].title", To: "title"},
+		{Op: TransformCopy, Path: "tracks[*]", To: "songs[*]"},
+	}
+	for _, rule := range rules {
+		if _, err := NewTransform([]TransformRule{rule}); err == nil {
+			t.Fatalf("Expecting an error for %v", rule)
+		}
+	}
+}
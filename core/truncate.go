@@ -0,0 +1,127 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// keyProjection returns the projection expression and its attribute names
+// reading only the key attributes of the given table definition
+func keyProjection(def *TableDefinition) (*string, map[string]*string) {
+	names := make(map[string]*string)
+	projection := []string{}
+	for i, key := range def.KeySchema {
+		name := fmt.Sprintf("#key%d", i)
+		names[name] = aws.String(key.AttributeName)
+		projection = append(projection, name)
+	}
+	return aws.String(strings.Join(projection, ", ")), names
+}
+
+// TruncateTable deletes all the items of the table of the given definition,
+// scanning their keys by pages of batchSize items and deleting them with
+// BatchWriteItem DeleteRequests. The ReadLimiter and the WriteLimiter pace the
+// scan and the deletes if set, otherwise it waits waitPeriod between two pages.
+// Returns the number of items deleted
+func (h *AwsHelper) TruncateTable(ctx context.Context, def *TableDefinition, batchSize int64, waitPeriod time.Duration) (int64, error) {
+	var deleted int64
+	err := h.scanKeys(ctx, def, batchSize, waitPeriod, func(keys []map[string]*dynamodb.AttributeValue) error {
+		if err := h.deleteKeys(ctx, def.TableName, keys); err != nil {
+			return err
+		}
+		deleted += int64(len(keys))
+		log.Printf("Deleted %d items from %s\n", deleted, def.TableName)
+		return nil
+	})
+	return deleted, err
+}
+
+// scanKeys scans the keys of the table of the given definition by pages of
+// batchSize items, passing each page to the given function, as scanItems does
+func (h *AwsHelper) scanKeys(ctx context.Context, def *TableDefinition, batchSize int64, waitPeriod time.Duration, fn func(keys []map[string]*dynamodb.AttributeValue) error) error {
+	projection, names := keyProjection(def)
+	return h.scanItems(ctx, def.TableName, projection, names, batchSize, waitPeriod, fn)
+}
+
+// scanItems scans the given table by pages of batchSize items, reading only
+// the attributes of the projection if set, and passes each page to the given
+// function. The ReadLimiter paces the scan if set, otherwise it waits
+// waitPeriod between two pages unless the WriteLimiter is set
+func (h *AwsHelper) scanItems(ctx context.Context, tableName string, projection *string, names map[string]*string, batchSize int64, waitPeriod time.Duration, fn func(items []map[string]*dynamodb.AttributeValue) error) error {
+	var lastEvaluatedKey map[string]*dynamodb.AttributeValue
+	r := h.retryPolicy().newRetrier(ctx, "Scan")
+	for {
+		params := &dynamodb.ScanInput{
+			TableName:                aws.String(tableName),
+			ProjectionExpression:     projection,
+			ExpressionAttributeNames: names,
+			ExclusiveStartKey:        lastEvaluatedKey,
+			ReturnConsumedCapacity:   aws.String("TOTAL"),
+		}
+		if batchSize > 0 {
+			params.Limit = aws.Int64(batchSize)
+		}
+		h.ReadLimiter.Wait()
+		page, err := h.DynamoSvc.ScanWithContext(ctx, params)
+		if err != nil {
+			if r.retry(err) {
+				continue
+			}
+			return r.giveUp(tableError(tableName, err))
+		}
+		r.reset()
+		h.ReadLimiter.Consume(consumedUnits(page.ConsumedCapacity))
+
+		if err := fn(page.Items); err != nil {
+			return err
+		}
+		if len(page.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		lastEvaluatedKey = page.LastEvaluatedKey
+		if h.ReadLimiter == nil && h.WriteLimiter == nil {
+			time.Sleep(waitPeriod)
+		}
+	}
+}
+
+// deleteKeys deletes the items of the given keys from the table, by batches
+// of 25 DeleteRequests
+func (h *AwsHelper) deleteKeys(ctx context.Context, tableName string, keys []map[string]*dynamodb.AttributeValue) error {
+	for start := 0; start < len(keys); start += 25 {
+		end := start + 25
+		if end > len(keys) {
+			end = len(keys)
+		}
+		reqs := []*dynamodb.WriteRequest{}
+		for _, key := range keys[start:end] {
+			reqs = append(reqs, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: key}})
+		}
+		h.WriteLimiter.Wait()
+		if err := h.batchToTable(ctx, map[string][]*dynamodb.WriteRequest{tableName: reqs}); err != nil {
+			return fmt.Errorf("unrecoverable error during batch delete: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// struct to mock a table of 60 items scanned by pages of 40 keys
+type mockTruncateDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	deleted []string
+}
+
+func (m *mockTruncateDynamoDBClient) ScanWithContext(ctx aws.Context, params *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	if aws.StringValue(params.ProjectionExpression) != "#key0" || aws.StringValue(params.ExpressionAttributeNames["#key0"]) != "artist" {
+		return nil, fmt.Errorf("Unexpected projection %s", params)
+	}
+	start := 0
+	if params.ExclusiveStartKey != nil {
+		start = 40
+	}
+	out := &dynamodb.ScanOutput{}
+	for i := start; i < start+40 && i < 60; i++ {
+		out.Items = append(out.Items, map[string]*dynamodb.AttributeValue{"artist": {S: aws.String(fmt.Sprintf("artist%d", i))}})
+	}
+	if start == 0 {
+		out.LastEvaluatedKey = out.Items[len(out.Items)-1]
+	}
+	return out, nil
+}
+
+func (m *mockTruncateDynamoDBClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	for _, reqs := range input.RequestItems {
+		if len(reqs) > 25 {
+			return nil, fmt.Errorf("Too many requests: %d", len(reqs))
+		}
+		for _, req := range reqs {
+			m.deleted = append(m.deleted, aws.StringValue(req.DeleteRequest.Key["artist"].S))
+		}
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func TestTruncateTable(t *testing.T) {
+	mock := &mockTruncateDynamoDBClient{}
+	h := &AwsHelper{DynamoSvc: mock}
+	def := &TableDefinition{TableName: "myTable", KeySchema: []KeyDefinition{{AttributeName: "artist", KeyType: "HASH"}}}
+
+	deleted, err := h.TruncateTable(context.Background(), def, 40, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if deleted != 60 || len(mock.deleted) != 60 || mock.deleted[59] != "artist59" {
+		t.Fatalf("Expecting the 60 items deleted, got %d: %v", deleted, mock.deleted)
+	}
+}
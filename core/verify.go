@@ -0,0 +1,189 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// VerifyFileReport is the result of the verification of a backup file
+type VerifyFileReport struct {
+	URL              string   `json:"url"`
+	Bytes            int64    `json:"bytes"`
+	Items            int64    `json:"items"`
+	ChecksumVerified bool     `json:"checksumVerified"`
+	Problems         []string `json:"problems,omitempty"`
+}
+
+// VerifyReport is the result of the verification of a backup
+type VerifyReport struct {
+	Manifest       string             `json:"manifest"`
+	Success        bool               `json:"success"`
+	Files          []VerifyFileReport `json:"files"`
+	Totals         S3ManifestTotals   `json:"totals"`
+	ExpectedTotals *S3ManifestTotals  `json:"expectedTotals,omitempty"`
+	Problems       []string           `json:"problems,omitempty"`
+	Valid          bool               `json:"valid"`
+}
+
+// validAttributeValue checks that exactly one type is set on the given
+// AttributeValue, and on its children
+func validAttributeValue(attr *dynamodb.AttributeValue) bool {
+	if attr == nil {
+		return false
+	}
+	types := 0
+	for _, set := range []bool{attr.B != nil, attr.BOOL != nil, attr.BS != nil, attr.N != nil, attr.NS != nil, attr.NULL != nil, attr.S != nil, attr.SS != nil, attr.L != nil, attr.M != nil} {
+		if set {
+			types++
+		}
+	}
+	for _, child := range attr.L {
+		if !validAttributeValue(child) {
+			return false
+		}
+	}
+	for _, child := range attr.M {
+		if !validAttributeValue(child) {
+			return false
+		}
+	}
+	return types == 1
+}
+
+// parseItem decodes a line of a backup file into an item, checking that every
+// attribute is a valid AttributeValue
+func parseItem(line []byte) (map[string]*dynamodb.AttributeValue, error) {
+	item := map[string]*dynamodb.AttributeValue{}
+	if err := json.Unmarshal(line, &item); err != nil {
+		return nil, err
+	}
+	if len(item) == 0 {
+		return nil, fmt.Errorf("empty item")
+	}
+	for k, v := range item {
+		if !validAttributeValue(v) {
+			return nil, fmt.Errorf("invalid attribute %s", k)
+		}
+	}
+	return item, nil
+}
+
+// VerifyEntry downloads the file of a manifest entry and checks its checksum,
+// its size, that each of its lines is a valid item and its item count
+func (h *AwsHelper) VerifyEntry(entry S3ManifestEntry) VerifyFileReport {
+	report := VerifyFileReport{URL: entry.URL}
+	problem := func(format string, args ...interface{}) VerifyFileReport {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+		return report
+	}
+
+	location, key, ok := splitStorageURL(entry.URL)
+	if !ok {
+		return problem("unsupported url")
+	}
+	doc, err := h.GetFromS3(context.Background(), location, key)
+	if err != nil {
+		return problem("unable to download the file: %s", err)
+	}
+	content, err := ioutil.ReadAll(*doc)
+	(*doc).Close()
+	if err != nil {
+		return problem("unable to download the file: %s", err)
+	}
+	report.Bytes = int64(len(content))
+
+	reader, err := h.decodeEntry(entry, ioutil.NopCloser(bytes.NewReader(content)))
+	if err != nil {
+		return problem("%s", err)
+	}
+	defer reader.Close()
+	report.ChecksumVerified = entry.SHA256 != ""
+
+	scanner := newLineScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if _, err := parseItem(scanner.Bytes()); err != nil {
+			problem("line %d: %s", line, err)
+			continue
+		}
+		report.Items++
+	}
+	if err := scanner.Err(); err != nil {
+		return problem("unable to read the file: %s", err)
+	}
+	if entry.ItemCount != nil && *entry.ItemCount != report.Items {
+		problem("%d valid items instead of %d", report.Items, *entry.ItemCount)
+	}
+	return report
+}
+
+// VerifyBackup checks the _SUCCESS flag and the manifest of the backup in the
+// given s3 folder, then each of its files
+func (h *AwsHelper) VerifyBackup(bucketName, s3Folder string) *VerifyReport {
+	manifestPath := fmt.Sprintf("%s/manifest", s3Folder)
+	report := &VerifyReport{Manifest: StorageURL(bucketName, manifestPath), Files: []VerifyFileReport{}}
+
+	success, err := h.ExistsInS3(bucketName, fmt.Sprintf("%s/_SUCCESS", s3Folder))
+	switch {
+	case err != nil:
+		report.Problems = append(report.Problems, fmt.Sprintf("unable to retrieve the _SUCCESS flag: %s", err))
+	case !success:
+		report.Problems = append(report.Problems, "the _SUCCESS flag is missing")
+	}
+	report.Success = success
+
+	if exists, err := h.ExistsInS3(bucketName, manifestPath); err != nil || !exists {
+		report.Problems = append(report.Problems, "the manifest is missing")
+		return report
+	}
+	if err := h.LoadManifestFromS3(bucketName, manifestPath); err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("unable to load the manifest: %s", err))
+		return report
+	}
+
+	if h.ManifestS3.Incomplete {
+		report.Problems = append(report.Problems, "the manifest belongs to an interrupted backup")
+	}
+
+	for _, entry := range h.ManifestS3.Entries {
+		file := h.VerifyEntry(entry)
+		report.Files = append(report.Files, file)
+		report.Totals.Files++
+		report.Totals.Bytes += file.Bytes
+		report.Totals.Items += file.Items
+		if len(file.Problems) > 0 {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s: %s", file.URL, strings.Join(file.Problems, ", ")))
+		}
+	}
+
+	if expected := h.ManifestS3.Totals; expected != nil {
+		report.ExpectedTotals = expected
+		if *expected != report.Totals {
+			report.Problems = append(report.Problems, fmt.Sprintf("the totals of the manifest %+v don't match the files %+v", *expected, report.Totals))
+		}
+	}
+	report.Valid = len(report.Problems) == 0
+	return report
+}
@@ -0,0 +1,70 @@
+/*
+Copyright © 2019 AltoStack <info@altostack.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestParseItem(t *testing.T) {
+	for _, item := range dataSet {
+		line, err := MarshalDynamoAttributeMap(item)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if _, err := parseItem(line); err != nil {
+			t.Fatalf("Line %s should be valid. Got: %s", line, err)
+		}
+	}
+
+	// Empty lists and maps are valid values, kept by the backups
+	empty := map[string]*dynamodb.AttributeValue{
+		"artist":  {S: aws.String("Queen")},
+		"albums":  {L: []*dynamodb.AttributeValue{}},
+		"members": {M: map[string]*dynamodb.AttributeValue{}},
+	}
+	line, err := MarshalDynamoAttributeMap(empty)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	item, err := parseItem(line)
+	if err != nil {
+		t.Fatalf("Line %s should be valid. Got: %s", line, err)
+	}
+	if item["albums"].L == nil || len(item["albums"].L) != 0 || item["members"].M == nil || len(item["members"].M) != 0 {
+		t.Fatalf("Expecting the empty list and map to be kept, got %s", line)
+	}
+
+	itemsTest := []struct {
+		line  string
+		valid bool
+	}{
+		{line: `{"artist":{"s":"Queen"},"albums":{"l":[{"m":{"year":{"n":"1975"}}}]}}`, valid: true},
+		{line: `{"artist":{"s":"Queen"`, valid: false},
+		{line: `{}`, valid: false},
+		{line: `{"artist":{}}`, valid: false},
+		{line: `{"artist":{"s":"Queen","n":"1"}}`, valid: false},
+		{line: `{"albums":{"l":[{"m":{"year":{}}}]}}`, valid: false},
+	}
+	for _, item := range itemsTest {
+		if _, err := parseItem([]byte(item.line)); (err == nil) != item.valid {
+			t.Fatalf("Line %s validity should be %t. Got: %v", item.line, item.valid, err)
+		}
+	}
+}